@@ -0,0 +1,159 @@
+// browser.go - Target browser related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Browser represents a target browser of native messaging host manifest.
+type Browser int
+
+// The supported target browsers.
+const (
+	// Chrome is Google Chrome, it is the default target browser.
+	Chrome Browser = iota
+	// Chromium is the open source Chromium.
+	Chromium
+	// Edge is the Chromium based Microsoft Edge.
+	Edge
+	// Brave is the Brave browser.
+	Brave
+	// Firefox is Mozilla Firefox, AllowedExts are extension IDs for it.
+	Firefox
+)
+
+// browserNames are the display names of the supported target browsers.
+var browserNames = map[Browser]string{
+	Brave:    "Brave",
+	Chrome:   "Chrome",
+	Chromium: "Chromium",
+	Edge:     "Edge",
+	Firefox:  "Firefox",
+}
+
+// browserDir represents system-wide manifest folder and per-user manifest
+// folder relative to user home folder.
+type browserDir struct {
+	system string
+	user   string
+}
+
+// String is an implementation of fmt.Stringer.String and returns browser name.
+func (b Browser) String() string {
+	if name, ok := browserNames[b]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// firefoxManifest represents native messaging host manifest for Firefox, which
+// has allowed_extensions instead of allowed_origins.
+type firefoxManifest struct {
+	AppName     string   `json:"name"`
+	AppDesc     string   `json:"description"`
+	ExecName    string   `json:"path"`
+	AppType     string   `json:"type"`
+	AllowedExts []string `json:"allowed_extensions"`
+}
+
+// Manifest returns native messaging host manifest content of configured
+// Browser, which is the same content Install writes, without any filesystem
+// side effects. The Extra keys are merged into it, except the ones that
+// collide with the canonical keys. It will return error when it come across
+// one.
+//
+// See https://developer.mozilla.org/en-US/docs/Mozilla/Add-ons/WebExtensions/Native_manifests
+func (h *Host) Manifest() ([]byte, error) {
+	var v interface{} = h
+
+	if h.Browser == Firefox {
+		v = &firefoxManifest{
+			AllowedExts: h.AllowedExts,
+			AppDesc:     h.AppDesc,
+			AppName:     h.AppName,
+			AppType:     h.AppType,
+			ExecName:    h.ExecName,
+		}
+	}
+
+	if len(h.Extra) == 0 {
+		return json.MarshalIndent(v, "", "  ")
+	}
+
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := map[string]json.RawMessage{}
+	if err := json.Unmarshal(canonical, &merged); err != nil {
+		return nil, err
+	}
+
+	for key, value := range h.Extra {
+		// The canonical keys are set through their respective fields.
+		if _, ok := merged[key]; ok {
+			continue
+		}
+
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		merged[key] = raw
+	}
+
+	return json.MarshalIndent(merged, "", "  ")
+}
+
+// UninstallFor removes native-messaging manifest file, and windows registry
+// entry on Windows, of each given browser on configured Scope. The configured
+// Browser is used when none is given. Unlike Uninstall, it keeps the executable
+// and doesn't exit, as the host might still be installed for other browsers.
+// It will return error when it come across one, after every browser is
+// attempted.
+//
+//   messaging := (&host.Host{}).Init()
+//
+//   if err := messaging.UninstallFor(host.Chrome, host.Edge, host.Firefox); err != nil {
+//     log.Fatalf("messaging.UninstallFor error: %v", err)
+//   }
+func (h *Host) UninstallFor(browsers ...Browser) error {
+	if len(browsers) == 0 {
+		browsers = []Browser{h.Browser}
+	}
+
+	var err error
+	removed := []string{}
+
+	for _, browser := range browsers {
+		target := *h
+		target.Browser = browser
+
+		names, rmErr := target.removeManifest()
+		if rmErr != nil {
+			err = appendError(err, fmt.Errorf("%s: %w", browser, rmErr))
+			continue
+		}
+
+		h.logger().Printf("Uninstalled %s: %s", browser, names[len(names)-1])
+		removed = append(removed, names...)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if h.OnUninstall != nil {
+		h.OnUninstall(removed)
+	}
+
+	return nil
+}
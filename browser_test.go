@@ -0,0 +1,91 @@
+// browser_test.go - Test for target browser related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"encoding/json"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestBrowserString(t *testing.T) {
+	t.Parallel()
+
+	compare := func(browser Browser, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			if got := browser.String(); got != want {
+				t.Errorf("mismatch (want: %s, got: %s)", want, got)
+			}
+		}
+	}
+
+	t.Run("with Brave", compare(Brave, "Brave"))
+	t.Run("with Chrome", compare(Chrome, "Chrome"))
+	t.Run("with Chromium", compare(Chromium, "Chromium"))
+	t.Run("with Edge", compare(Edge, "Edge"))
+	t.Run("with Firefox", compare(Firefox, "Firefox"))
+	t.Run("with unknown browser", compare(Browser(-1), "Unknown"))
+}
+
+func TestBrowserManifest(t *testing.T) {
+	t.Parallel()
+
+	compare := func(browser Browser, allowedExts []string, extra, want H) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			h := &Host{
+				AllowedExts: allowedExts,
+				AppDesc:     "Description",
+				AppName:     "app",
+				AppType:     "stdio",
+				Browser:     browser,
+				ExecName:    "/opt/app",
+				Extra:       extra,
+			}
+
+			manifest, err := h.Manifest()
+			if want == nil {
+				if err == nil {
+					t.Error("want error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("manifest error: %v", err)
+			}
+
+			got := H{}
+			if err := json.Unmarshal(manifest, &got); err != nil {
+				t.Fatalf("unmarshal error: %v", err)
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with Chrome", compare(Chrome, []string{"chrome-extension://XXX/"}, nil, H{
+		"allowed_origins": []interface{}{"chrome-extension://XXX/"}, "description": "Description",
+		"name": "app", "path": "/opt/app", "type": "stdio"}))
+	t.Run("with Firefox", compare(Firefox, []string{"app@domain.tld"}, nil, H{
+		"allowed_extensions": []interface{}{"app@domain.tld"}, "description": "Description",
+		"name": "app", "path": "/opt/app", "type": "stdio"}))
+	t.Run("with extra keys", compare(Chrome, []string{"chrome-extension://XXX/"},
+		H{"vendor_key": H{"enabled": true}}, H{
+			"allowed_origins": []interface{}{"chrome-extension://XXX/"}, "description": "Description",
+			"name": "app", "path": "/opt/app", "type": "stdio",
+			"vendor_key": map[string]interface{}{"enabled": true}}))
+	t.Run("with colliding extra keys", compare(Firefox, []string{"app@domain.tld"},
+		H{"name": "other", "path": "/tmp/other", "vendor_key": "value"}, H{
+			"allowed_extensions": []interface{}{"app@domain.tld"}, "description": "Description",
+			"name": "app", "path": "/opt/app", "type": "stdio", "vendor_key": "value"}))
+	t.Run("with unmarshalable extra keys", compare(Chrome, nil, H{"invalid": func() {}}, nil))
+}
@@ -0,0 +1,104 @@
+// cache.go - Conditional update check related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+)
+
+// An updateCache is the last updates.xml response of configured UpdateUrl
+// along with its ETag and Last-Modified validators. It is stored in .cache file
+// as MIME header followed by the response body.
+type updateCache struct {
+	body   []byte
+	header http.Header
+}
+
+// getConditionalHeader returns conditional request headers of the cached
+// validators, otherwise nil.
+func (c *updateCache) getConditionalHeader() http.Header {
+	if c == nil {
+		return nil
+	}
+
+	header := http.Header{}
+	if etag := c.header.Get("ETag"); etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if modified := c.header.Get("Last-Modified"); modified != "" {
+		header.Set("If-Modified-Since", modified)
+	}
+
+	return header
+}
+
+// readUpdateCache returns the cached updates.xml response of configured
+// UpdateUrl, otherwise nil.
+func (h *Host) readUpdateCache() *updateCache {
+	buf, err := ioutil.ReadFile(h.getStateName(".cache"))
+	if err != nil {
+		return nil
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(buf))
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil || header.Get("Url") != h.UpdateUrl {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil
+	}
+
+	return &updateCache{body: body, header: http.Header(header)}
+}
+
+// writeUpdateCache writes given updates.xml response body of configured
+// UpdateUrl along with ETag and Last-Modified validators in given response
+// header. The stale cache is removed when there is no validator. It will
+// return error when it come across one.
+func (h *Host) writeUpdateCache(header http.Header, body []byte) error {
+	cacheName := h.getStateName(".cache")
+
+	etag, modified := header.Get("ETag"), header.Get("Last-Modified")
+	if etag == "" && modified == "" {
+		if err := osRemove(cacheName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if h.StateDir != "" {
+		if err := osMkdirAll(h.StateDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	cached := http.Header{"Url": {h.UpdateUrl}}
+	if etag != "" {
+		cached.Set("ETag", etag)
+	}
+	if modified != "" {
+		cached.Set("Last-Modified", modified)
+	}
+
+	var buf bytes.Buffer
+	if err := cached.Write(&buf); err != nil {
+		return err
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	return ioutil.WriteFile(cacheName, buf.Bytes(), 0644)
+}
@@ -0,0 +1,124 @@
+// cache_test.go - Test for conditional update check related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheGetLatestUpdate(t *testing.T) {
+	t.Parallel()
+
+	log.SetOutput(ioutil.Discard)
+
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	compare := func(name string, etags []string, modifieds []time.Time, want *H) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			// The manifest body always changes, only the validators tell.
+			versions := []string{"1.0.1", "1.0.2"}
+			conditions := [][]string{}
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				i := len(conditions)
+				conditions = append(conditions, []string{req.Header.Get("If-None-Match"),
+					req.Header.Get("If-Modified-Since")})
+				if etags[i] != "" {
+					rw.Header().Set("ETag", etags[i])
+				}
+				http.ServeContent(rw, req, "updates.xml", modifieds[i], strings.NewReader(updatesXml(`
+    <updatecheck codebase='https://sub.domain.tld/app' version='`+versions[i]+`' />
+  `)))
+			}))
+			defer server.Close()
+
+			execName := "testdata/cache-" + name
+			defer func() { os.Remove(execName + ".cache") }()
+
+			h := &Host{AppName: "tld.domain.sub.app.name", ExecName: execName, UpdateUrl: server.URL}
+
+			got := []string{}
+			for range versions {
+				update, err := h.getLatestUpdate()
+				if err != nil {
+					t.Fatalf("update check error: %v", err)
+				}
+				got = append(got, update.getVersion())
+			}
+
+			_, err := os.Stat(execName + ".cache")
+			if diff := cmp.Diff(want, &H{"conditions": conditions, "versions": got, "cached": err == nil}); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	since := modified.Format(http.TimeFormat)
+	none := []time.Time{{}, {}}
+
+	t.Run("with same ETag", compare("etag", []string{`"v1"`, `"v1"`}, none, &H{
+		"conditions": [][]string{{"", ""}, {`"v1"`, ""}}, "versions": []string{"1.0.1", "1.0.1"},
+		"cached": true}))
+	t.Run("with changed ETag", compare("etag-changed", []string{`"v1"`, `"v2"`}, none, &H{
+		"conditions": [][]string{{"", ""}, {`"v1"`, ""}}, "versions": []string{"1.0.1", "1.0.2"},
+		"cached": true}))
+	t.Run("with same Last-Modified", compare("modified", []string{"", ""},
+		[]time.Time{modified, modified}, &H{"conditions": [][]string{{"", ""}, {"", since}},
+			"versions": []string{"1.0.1", "1.0.1"}, "cached": true}))
+	t.Run("with changed Last-Modified", compare("modified-changed", []string{"", ""},
+		[]time.Time{modified, modified.Add(time.Hour)}, &H{"conditions": [][]string{{"", ""}, {"", since}},
+			"versions": []string{"1.0.1", "1.0.2"}, "cached": true}))
+	t.Run("with validators removed", compare("removed", []string{`"v1"`, ""}, none, &H{
+		"conditions": [][]string{{"", ""}, {`"v1"`, ""}}, "versions": []string{"1.0.1", "1.0.2"},
+		"cached": false}))
+	t.Run("with no validators", compare("none", []string{"", ""}, none, &H{
+		"conditions": [][]string{{"", ""}, {"", ""}}, "versions": []string{"1.0.1", "1.0.2"},
+		"cached": false}))
+}
+
+func TestCacheReadUpdateCache(t *testing.T) {
+	t.Parallel()
+
+	compare := func(content, url string, want *updateCache) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			execName := fmt.Sprintf("testdata/cache-read-%d", len(content))
+			if content != "" {
+				if err := ioutil.WriteFile(execName+".cache", []byte(content), 0644); err != nil {
+					t.Fatalf("write cache error: %v", err)
+				}
+				defer func() { os.Remove(execName + ".cache") }()
+			}
+
+			h := &Host{ExecName: execName, UpdateUrl: url}
+			got := h.readUpdateCache()
+			if diff := cmp.Diff(want, got, cmp.AllowUnexported(updateCache{})); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	content := "Etag: \"v1\"\r\nUrl: https://sub.domain.tld/updates.xml\r\n\r\n<gupdate />"
+
+	t.Run("with no cache", compare("", "https://sub.domain.tld/updates.xml", nil))
+	t.Run("with same URL", compare(content, "https://sub.domain.tld/updates.xml", &updateCache{
+		body: []byte("<gupdate />"), header: http.Header{"Etag": {`"v1"`},
+			"Url": {"https://sub.domain.tld/updates.xml"}}}))
+	t.Run("with other URL", compare(content+" ", "https://other.domain.tld/updates.xml", nil))
+}
@@ -0,0 +1,107 @@
+// caller.go - Invoking extension related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnauthorizedCaller is returned when invoking extension is not in
+// AllowedExts.
+var ErrUnauthorizedCaller = errors.New("caller is not allowed")
+
+// DetectBrowser infers invoking browser from given command-line arguments,
+// including program name. Chrome based browsers pass the extension origin,
+// where configured Browser is kept when it is one of them, otherwise Chrome is
+// assumed. Firefox passes manifest path followed by extension ID. Configured
+// Browser is returned when it is unable to infer.
+//
+//   messaging := (&host.Host{}).Init()
+//   messaging.Browser = messaging.DetectBrowser(os.Args)
+func (h *Host) DetectBrowser(args []string) Browser {
+	switch {
+	case len(args) > 1 && strings.HasPrefix(args[1], "chrome-extension://"):
+		if h.Browser == Firefox {
+			return Chrome
+		}
+		return h.Browser
+	case len(args) > 2 && strings.HasSuffix(strings.ToLower(args[1]), ".json"):
+		return Firefox
+	}
+	return h.Browser
+}
+
+// getCaller returns invoking extension from given command-line arguments of
+// configured Browser. Firefox passes manifest path followed by extension ID,
+// otherwise the extension origin is passed first. It will return empty string
+// when it is absent.
+func (h *Host) getCaller(args []string) string {
+	index := 1
+	if h.Browser == Firefox {
+		index = 2
+	}
+
+	if len(args) > index {
+		return args[index]
+	}
+	return ""
+}
+
+// IsAllowedOrigin returns true if given origin, or Firefox extension ID, is in
+// AllowedExts, otherwise false. The optional trailing slash of Chrome origin is
+// tolerated on both sides.
+//
+//   messaging := (&host.Host{AllowedExts: []string{"chrome-extension://XXX/"}}).Init()
+//
+//   if !messaging.IsAllowedOrigin("chrome-extension://XXX") {
+//     log.Fatal("unauthorized origin")
+//   }
+func (h *Host) IsAllowedOrigin(origin string) bool {
+	origin = normalizeOrigin(origin)
+	if origin == "" {
+		return false
+	}
+
+	for _, ext := range h.AllowedExts {
+		if normalizeOrigin(ext) == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeOrigin returns given origin without surrounding spaces and trailing
+// slash.
+func normalizeOrigin(origin string) string {
+	return strings.TrimSuffix(strings.TrimSpace(origin), "/")
+}
+
+// VerifyCaller checks invoking extension from given command-line arguments,
+// including program name, against AllowedExts, see IsAllowedOrigin. It will
+// return ErrUnauthorizedCaller when the extension is absent or not allowed.
+//
+//   messaging := (&host.Host{}).Init()
+//
+//   if err := messaging.VerifyCaller(os.Args); err != nil {
+//     log.Fatalf("messaging.VerifyCaller error: %v", err)
+//   }
+func (h *Host) VerifyCaller(args []string) error {
+	caller := h.getCaller(args)
+	if caller == "" {
+		return fmt.Errorf("missing caller: %w", ErrUnauthorizedCaller)
+	}
+
+	if h.IsAllowedOrigin(caller) {
+		return nil
+	}
+
+	return fmt.Errorf("%s: %w", caller, ErrUnauthorizedCaller)
+}
@@ -0,0 +1,107 @@
+// caller_test.go - Test for invoking extension related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCallerVerifyCaller(t *testing.T) {
+	t.Parallel()
+
+	compare := func(browser Browser, args []string, wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			h := &Host{
+				AllowedExts: []string{"chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik/", "app@domain.tld"},
+				Browser:     browser,
+			}
+
+			err := h.VerifyCaller(args)
+			if !wantErr && err != nil {
+				t.Errorf("verify error: %v", err)
+			} else if wantErr && !errors.Is(err, ErrUnauthorizedCaller) {
+				t.Errorf("want ErrUnauthorizedCaller: %v", err)
+			}
+		}
+	}
+
+	t.Run("with allowed Chrome origin", compare(Chrome, []string{"app",
+		"chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik/"}, false))
+	t.Run("with allowed Chrome origin on Windows", compare(Chrome, []string{"app",
+		"chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik/", "--parent-window=0"}, false))
+	t.Run("with unknown Chrome origin", compare(Chrome, []string{"app",
+		"chrome-extension://abcdefghijklmnopabcdefghijklmnop/"}, true))
+	t.Run("with allowed Firefox extension", compare(Firefox, []string{"app",
+		"/path/to/app.json", "app@domain.tld"}, false))
+	t.Run("with unknown Firefox extension", compare(Firefox, []string{"app",
+		"/path/to/app.json", "other@domain.tld"}, true))
+	t.Run("with Firefox manifest path only", compare(Firefox, []string{"app",
+		"/path/to/app.json"}, true))
+	t.Run("with missing caller", compare(Chrome, []string{"app"}, true))
+	t.Run("with no arguments", compare(Chrome, nil, true))
+}
+
+func TestCallerDetectBrowser(t *testing.T) {
+	t.Parallel()
+
+	compare := func(browser Browser, args []string, want Browser) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			if got := (&Host{Browser: browser}).DetectBrowser(args); got != want {
+				t.Errorf("mismatch (want: %s, got: %s)", want, got)
+			}
+		}
+	}
+
+	t.Run("with Chrome origin", compare(Chrome, []string{"app",
+		"chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik/"}, Chrome))
+	t.Run("with Chrome origin on Windows", compare(Chrome, []string{"app",
+		"chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik/", "--parent-window=0"}, Chrome))
+	t.Run("with Edge origin", compare(Edge, []string{"app",
+		"chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik/"}, Edge))
+	t.Run("with Chrome origin on Firefox", compare(Firefox, []string{"app",
+		"chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik/"}, Chrome))
+	t.Run("with Firefox extension", compare(Chrome, []string{"app",
+		"/path/to/app.json", "app@domain.tld"}, Firefox))
+	t.Run("with Firefox extension on Windows", compare(Chrome, []string{`C:\App\app.exe`,
+		`C:\App\APP.JSON`, "{a1b2c3d4-0000-0000-0000-000000000000}"}, Firefox))
+	t.Run("with unknown arguments", compare(Brave, []string{"app", "--verbose"}, Brave))
+	t.Run("with no arguments", compare(Chromium, nil, Chromium))
+}
+
+func TestCallerIsAllowedOrigin(t *testing.T) {
+	t.Parallel()
+
+	compare := func(allowedExts []string, origin string, want bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			if got := (&Host{AllowedExts: allowedExts}).IsAllowedOrigin(origin); got != want {
+				t.Errorf("mismatch for %q (want: %t, got: %t)", origin, want, got)
+			}
+		}
+	}
+
+	chrome := []string{"chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik/"}
+	bare := []string{"chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik"}
+
+	t.Run("with exact match", compare(chrome, "chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik/", true))
+	t.Run("with missing trailing slash", compare(chrome, "chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik", true))
+	t.Run("with extra trailing slash", compare(bare, "chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik/", true))
+	t.Run("with surrounding spaces", compare(chrome, " chrome-extension://knldjmfmopnpolahpmmgbagdohdnhkik/\n", true))
+	t.Run("with Firefox extension", compare([]string{"app@domain.tld"}, "app@domain.tld", true))
+	t.Run("with non-member", compare(chrome, "chrome-extension://abcdefghijklmnopabcdefghijklmnop/", false))
+	t.Run("with prefix only", compare(chrome, "chrome-extension://knldjmfmopnpolahpmmgbagdohdnhki/", false))
+	t.Run("with empty origin", compare([]string{""}, "", false))
+	t.Run("with slash only", compare([]string{"/"}, "/", false))
+	t.Run("with no allowed extensions", compare(nil, "app@domain.tld", false))
+}
@@ -15,6 +15,17 @@
 //   resp := client.MustGetWithContext(ctx, "https://domain.tld")
 //   defer resp.Body.Close()
 //
+// * GET call with context and error
+//
+//   ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//   defer cancel()
+//
+//   resp, err := client.GetWithContext(ctx, "https://domain.tld")
+//   if err != nil {
+//     return err
+//   }
+//   defer resp.Body.Close()
+//
 // * GET call with tar.gz content
 //
 //   ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -36,15 +47,50 @@
 //
 //   resp := client.MustPostWithContext(ctx, "https://domain.tld", "application/json", strings.NewReader("{}"))
 //   defer resp.Body.Close()
+//
+// * POST call with context and error
+//
+//   ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//   defer cancel()
+//
+//   resp, err := client.PostWithContext(ctx, "https://domain.tld", "application/json", strings.NewReader("{}"))
+//   if err != nil {
+//     return err
+//   }
+//   defer resp.Body.Close()
+//
+// * POST call with gzip-compressed body
+//
+//   ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//   defer cancel()
+//
+//   resp := client.MustPostGzipWithContext(ctx, "https://domain.tld", "application/json", strings.NewReader("{}"))
+//   defer resp.Body.Close()
+//
+// * Custom diagnostic output
+//
+//   client.SetLogger(log.New(ioutil.Discard, "", 0))
+//
+// * GET call with custom timeout
+//
+//   c := client.NewClient(client.ClientConfig{OverallTimeout: 5 * time.Minute})
+//   resp, err := client.GetWithClient(ctx, c, "https://domain.tld")
+//
+// * Custom retry policy
+//
+//   client.SetRetry(client.Retry{Backoff: 2 * time.Second, MaxAttempts: 5})
 package client
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
-	"crypto/tls"
+	"fmt"
 	"github.com/rickypc/native-messaging-host/packer"
+	"io"
 	"log"
-	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 )
@@ -56,31 +102,82 @@ var httpClientDo = GetHttpClient().Do
 // It helps write testable code.
 var httpNewRequestWithContext = http.NewRequestWithContext
 
-// logFatalf is a shortcut to log.Fatalf. It helps write testable code.
-var logFatalf = log.Fatalf
+// logFatalf is a shortcut to fatalf. It helps write testable code.
+var logFatalf = fatalf
 
-// GetHttpClient provides http client with configured connection and timeout.
-func GetHttpClient() *http.Client {
-	httpTransport := &http.Transport{
-		DialContext: (&net.Dialer{
-			KeepAlive: HttpKeepAlive * time.Second,
-			Timeout:   HttpDialTimeout * time.Second,
-		}).DialContext,
-		ExpectContinueTimeout: HttpContinueTimeout * time.Second,
-		IdleConnTimeout:       IdleTimeout * time.Second,
-		MaxIdleConns:          MaxConnections,
-		MaxIdleConnsPerHost:   MaxConnections,
-		ResponseHeaderTimeout: ResponseHeaderTimeout * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
-		TLSHandshakeTimeout: TLSDialTimeout * time.Second,
+// logger is the diagnostic output, it is defaulted to the standard logger.
+var logger Logger = stdLogger{}
+
+// osExit is a shortcut to os.Exit. It helps write testable code.
+var osExit = os.Exit
+
+// retry is the retry policy of idempotent calls, it is defaulted to
+// RetryMaxAttempts and RetryBackoff.
+var retry = Retry{}
+
+// Retry represents a retry policy on network errors and 5xx responses.
+//
+// Backoff is a delay before the second attempt and doubled after every failed
+// attempt, it is defaulted to RetryBackoff seconds when it is zero or negative.
+//
+// MaxAttempts is a maximum number of attempts including the first one, it is
+// defaulted to RetryMaxAttempts when it is zero or negative.
+type Retry struct {
+	Backoff     time.Duration
+	MaxAttempts int
+}
+
+// getBackoff returns configured backoff, otherwise the default one.
+func (r Retry) getBackoff() time.Duration {
+	if r.Backoff > 0 {
+		return r.Backoff
 	}
+	return RetryBackoff * time.Second
+}
 
-	return &http.Client{
-		Timeout:   HttpOverallTimeout * time.Second,
-		Transport: httpTransport,
+// getMaxAttempts returns configured maximum attempts, otherwise the default one.
+func (r Retry) getMaxAttempts() int {
+	if r.MaxAttempts > 0 {
+		return r.MaxAttempts
 	}
+	return RetryMaxAttempts
+}
+
+// Logger is an interface for diagnostic output. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdLogger is an implementation of Logger and wraps the standard logger.
+type stdLogger struct{}
+
+// Printf is an implementation of Logger.Printf and wraps log.Printf.
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// fatalf writes given message to the diagnostic output and exits with status 1.
+func fatalf(format string, v ...interface{}) {
+	logger.Printf(format, v...)
+	osExit(1)
+}
+
+// SetLogger replaces the diagnostic output, nil restores the standard logger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = stdLogger{}
+	}
+	logger = l
+}
+
+// SetRetry replaces the retry policy, zero values restore the defaults.
+func SetRetry(r Retry) {
+	retry = r
+}
+
+// GetHttpClient provides http client with default connection and timeout.
+func GetHttpClient() *http.Client {
+	return NewClient(DefaultClientConfig())
 }
 
 // MustGetAndUntarWithContext will make a http GET call to given URL and extract
@@ -101,17 +198,69 @@ func MustGetAndUnzipWithContext(ctx context.Context, url, target string) {
 	}
 }
 
-// MustGetWithContext is a helper that wraps a http GET call to given URL and
-// log any error.
-func MustGetWithContext(ctx context.Context, url string) *http.Response {
-	log.Printf("GET %s", url)
+// GetWithContext is a helper that wraps a http GET call to given URL. It will
+// retry on network errors and 5xx responses with exponential backoff according
+// to the retry policy until given context is done. The last 5xx response will
+// be returned as is. It will return error when it come across one.
+func GetWithContext(ctx context.Context, url string) (*http.Response, error) {
+	return get(ctx, httpClientDo, url, nil)
+}
+
+// GetWithClient is the same as GetWithContext, except it uses given http
+// client, i.e.: one from NewClient.
+func GetWithClient(ctx context.Context, c *http.Client, url string) (*http.Response, error) {
+	return get(ctx, c.Do, url, nil)
+}
+
+// GetWithHeader is the same as GetWithClient, except it sends given request
+// headers as well, i.e.: conditional request headers.
+func GetWithHeader(ctx context.Context, c *http.Client, url string, header http.Header) (*http.Response, error) {
+	return get(ctx, c.Do, url, header)
+}
+
+// get makes a http GET call to given URL with given do function, request
+// headers, and retry policy. It will return error when it come across one.
+func get(ctx context.Context, do func(*http.Request) (*http.Response, error), url string,
+	header http.Header) (*http.Response, error) {
+	logger.Printf("GET %s", url)
 
 	req, err := httpNewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		logFatalf("GET %s failed: %s", url, err)
+		return nil, err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	backoff := retry.getBackoff()
+	maxAttempts := retry.getMaxAttempts()
+
+	for attempt := 1; ; attempt++ {
+		resp, err := do(req)
+		if attempt >= maxAttempts || (err == nil && resp.StatusCode < http.StatusInternalServerError) {
+			return resp, err
+		}
+
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		logger.Printf("GET %s attempt %d failed: %s", url, attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w %v", ctx.Err(), err)
+		case <-time.After(backoff):
+			backoff *= 2
+		}
 	}
+}
 
-	resp, err := httpClientDo(req)
+// MustGetWithContext is a helper that wraps a http GET call to given URL and
+// log any error.
+func MustGetWithContext(ctx context.Context, url string) *http.Response {
+	resp, err := GetWithContext(ctx, url)
 	if err != nil {
 		logFatalf("GET %s failed: %s", url, err)
 	}
@@ -119,19 +268,66 @@ func MustGetWithContext(ctx context.Context, url string) *http.Response {
 	return resp
 }
 
+// PostWithContext is a helper that wraps a http POST call to given URL, content
+// type, and body. It won't be retried. It will return error when it come across
+// one.
+func PostWithContext(ctx context.Context, url, contentType string, body *strings.Reader) (*http.Response, error) {
+	logger.Printf("POST %s %+v", url, body)
+
+	req, err := httpNewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+
+	return httpClientDo(req)
+}
+
 // MustPostWithContext is a helper that wraps a http POST call to given URL,
 // content type, and body, as well as log any error.
 func MustPostWithContext(ctx context.Context, url, contentType string, body *strings.Reader) *http.Response {
-	log.Printf("POST %s %+v", url, body)
-
-	req, err := httpNewRequestWithContext(ctx, "POST", url, body)
+	resp, err := PostWithContext(ctx, url, contentType, body)
 	if err != nil {
 		logFatalf("POST %s failed: %s", url, err)
 	}
 
+	return resp
+}
+
+// PostGzipWithContext is a helper that wraps a http POST call to given URL,
+// content type, and gzip-compressed body with Content-Encoding header. It won't
+// be retried. It will return error when it come across one.
+func PostGzipWithContext(ctx context.Context, url, contentType string, body io.Reader) (*http.Response, error) {
+	logger.Printf("POST %s gzip", url)
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+
+	if _, err := io.Copy(zw, body); err != nil {
+		return nil, fmt.Errorf("gzip %w", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("gzip %w", err)
+	}
+
+	req, err := httpNewRequestWithContext(ctx, "POST", url, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Encoding", "gzip")
 	req.Header.Set("Content-Type", contentType)
 
-	resp, err := httpClientDo(req)
+	return httpClientDo(req)
+}
+
+// MustPostGzipWithContext is a helper that wraps a http POST call to given URL,
+// content type, and gzip-compressed body with Content-Encoding header, as well
+// as log any error.
+func MustPostGzipWithContext(ctx context.Context, url, contentType string, body io.Reader) *http.Response {
+	resp, err := PostGzipWithContext(ctx, url, contentType, body)
 	if err != nil {
 		logFatalf("POST %s failed: %s", url, err)
 	}
@@ -8,6 +8,7 @@
 package client
 
 import (
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
@@ -83,6 +84,57 @@ func TestClientMustGetAndUnzipWithContext(t *testing.T) {
 	t.Run("with valid response", compare())
 }
 
+type recorder struct {
+	messages []string
+}
+
+func (r *recorder) Printf(format string, v ...interface{}) {
+	r.messages = append(r.messages, fmt.Sprintf(format, v...))
+}
+
+func TestClientSetLogger(t *testing.T) {
+	compare := func(l Logger, want Logger) func(t *testing.T) {
+		return func(t *testing.T) {
+			oldLogger := logger
+			defer func() { logger = oldLogger }()
+
+			SetLogger(l)
+
+			if logger != want {
+				t.Errorf("mismatch (want: %#v, got: %#v)", want, logger)
+			}
+		}
+	}
+
+	r := &recorder{}
+
+	t.Run("with custom logger", compare(r, r))
+	t.Run("with nil logger", compare(nil, stdLogger{}))
+}
+
+func TestClientFatalf(t *testing.T) {
+	exited := 0
+	oldLogger := logger
+	oldOsExit := osExit
+	r := &recorder{}
+	defer func() {
+		logger = oldLogger
+		osExit = oldOsExit
+	}()
+	logger = r
+	osExit = func(code int) { exited = code }
+
+	fatalf("GET %s failed: %s", "url", "error")
+
+	if exited != 1 {
+		t.Errorf("exit code mismatch: %d", exited)
+	}
+
+	if len(r.messages) != 1 || r.messages[0] != "GET url failed: error" {
+		t.Errorf("message mismatch: %v", r.messages)
+	}
+}
+
 func TestClientMustGetWithContext(t *testing.T) {
 	compare := func(wantErr int) func(t *testing.T) {
 		return func(t *testing.T) {
@@ -112,15 +164,17 @@ func TestClientMustGetWithContext(t *testing.T) {
 				}
 				logFatalf = func(msg string, v ...interface{}) {
 					fatal = true
-					panic(fmt.Sprintf(msg, v))
+					panic(fmt.Sprintf(msg, v...))
 				}
 			case 2:
 				oldHttpClientDo := httpClientDo
 				oldLogFatalf := logFatalf
+				oldRetry := retry
 				defer func() {
 					_ = recover()
 					httpClientDo = oldHttpClientDo
 					logFatalf = oldLogFatalf
+					retry = oldRetry
 				}()
 				httpClientDo = func(*http.Request) (*http.Response, error) {
 					did = true
@@ -128,8 +182,9 @@ func TestClientMustGetWithContext(t *testing.T) {
 				}
 				logFatalf = func(msg string, v ...interface{}) {
 					fatal = true
-					panic(fmt.Sprintf(msg, v))
+					panic(fmt.Sprintf(msg, v...))
 				}
+				retry = Retry{Backoff: time.Millisecond}
 			}
 
 			resp := MustGetWithContext(ctx, server.URL)
@@ -158,6 +213,122 @@ func TestClientMustGetWithContext(t *testing.T) {
 	t.Run("with client error", compare(2))
 }
 
+func TestClientGetWithContext(t *testing.T) {
+	compare := func(wantStatus, wantAttempts int, failures int, failStatus int, timeout time.Duration,
+		wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				attempts++
+				if attempts <= failures {
+					rw.WriteHeader(failStatus)
+					return
+				}
+				_, _ = rw.Write([]byte("OK"))
+			}))
+			defer server.Close()
+
+			oldRetry := retry
+			defer func() { retry = oldRetry }()
+			SetRetry(Retry{Backoff: 10 * time.Millisecond, MaxAttempts: 3})
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			resp, err := GetWithContext(ctx, server.URL)
+			if wantErr != (err != nil) {
+				t.Fatalf("error mismatch (want: %t, got: %v)", wantErr, err)
+			}
+
+			if resp != nil {
+				defer resp.Body.Close()
+				if resp.StatusCode != wantStatus {
+					t.Errorf("status mismatch (want: %d, got: %d)", wantStatus, resp.StatusCode)
+				}
+			}
+
+			if attempts != wantAttempts {
+				t.Errorf("attempts mismatch (want: %d, got: %d)", wantAttempts, attempts)
+			}
+		}
+	}
+
+	t.Run("with success", compare(http.StatusOK, 1, 0, 0, 10*time.Second, false))
+	t.Run("with two failures then success", compare(http.StatusOK, 3, 2, http.StatusBadGateway,
+		10*time.Second, false))
+	t.Run("with persistent failures", compare(http.StatusServiceUnavailable, 3, 5,
+		http.StatusServiceUnavailable, 10*time.Second, false))
+	t.Run("with client error status", compare(http.StatusNotFound, 1, 5, http.StatusNotFound,
+		10*time.Second, false))
+	t.Run("with context deadline", compare(0, 1, 5, http.StatusInternalServerError,
+		5*time.Millisecond, true))
+}
+
+func TestClientGetWithHeader(t *testing.T) {
+	t.Parallel()
+
+	compare := func(header http.Header, wantStatus int, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("ETag", `"v1"`)
+				http.ServeContent(rw, req, "", time.Time{}, strings.NewReader("0123456789"))
+			}))
+			defer server.Close()
+
+			resp, err := GetWithHeader(context.Background(), server.Client(), server.URL, header)
+			if err != nil {
+				t.Fatalf("get error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != wantStatus || string(body) != want {
+				t.Errorf("mismatch (want: %d %q, got: %d %q)", wantStatus, want, resp.StatusCode, body)
+			}
+		}
+	}
+
+	t.Run("with no header", compare(nil, http.StatusOK, "0123456789"))
+	t.Run("with matching ETag", compare(http.Header{"If-None-Match": {`"v1"`}},
+		http.StatusNotModified, ""))
+	t.Run("with changed ETag", compare(http.Header{"If-None-Match": {`"v0"`}},
+		http.StatusOK, "0123456789"))
+}
+
+func TestClientGetWithContextNetworkError(t *testing.T) {
+	attempts := 0
+	oldHttpClientDo := httpClientDo
+	oldRetry := retry
+	defer func() {
+		httpClientDo = oldHttpClientDo
+		retry = oldRetry
+	}()
+	httpClientDo = func(*http.Request) (*http.Response, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("client error")
+		}
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader("OK")),
+			StatusCode: http.StatusOK}, nil
+	}
+	retry = Retry{Backoff: time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := GetWithContext(ctx, "https://domain.tld")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if attempts != 3 {
+		t.Errorf("attempts mismatch: %d", attempts)
+	}
+}
+
 func TestClientMustPostWithContext(t *testing.T) {
 	compare := func(wantErr int) func(t *testing.T) {
 		return func(t *testing.T) {
@@ -187,7 +358,7 @@ func TestClientMustPostWithContext(t *testing.T) {
 				}
 				logFatalf = func(msg string, v ...interface{}) {
 					fatal = true
-					panic(fmt.Sprintf(msg, v))
+					panic(fmt.Sprintf(msg, v...))
 				}
 			case 2:
 				oldHttpClientDo := httpClientDo
@@ -203,7 +374,7 @@ func TestClientMustPostWithContext(t *testing.T) {
 				}
 				logFatalf = func(msg string, v ...interface{}) {
 					fatal = true
-					panic(fmt.Sprintf(msg, v))
+					panic(fmt.Sprintf(msg, v...))
 				}
 			}
 
@@ -232,3 +403,73 @@ func TestClientMustPostWithContext(t *testing.T) {
 	t.Run("with request error", compare(1))
 	t.Run("with client error", compare(2))
 }
+
+func TestClientMustPostGzipWithContext(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "gzip" {
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = rw.Write([]byte("missing Content-Encoding"))
+			return
+		}
+
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = rw.Write([]byte(err.Error()))
+			return
+		}
+		defer zr.Close()
+
+		_, _ = io.Copy(rw, zr)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp := MustPostGzipWithContext(ctx, server.URL, "application/json", strings.NewReader(`{"key":"value"}`))
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != `{"key":"value"}` {
+		t.Errorf("content mismatch %d: %s", resp.StatusCode, body)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("read error")
+}
+
+func TestClientPostWithContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("OK"))
+	}))
+	url := server.URL
+	server.Close()
+
+	oldOsExit := osExit
+	defer func() { osExit = oldOsExit }()
+	osExit = func(code int) { t.Fatalf("unexpected exit: %d", code) }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if resp, err := PostWithContext(ctx, url, "application/json", strings.NewReader("{}")); err == nil {
+		resp.Body.Close()
+		t.Error("missing unreachable error")
+	}
+
+	if resp, err := PostGzipWithContext(ctx, url, "application/json", strings.NewReader("{}")); err == nil {
+		resp.Body.Close()
+		t.Error("missing unreachable error")
+	}
+
+	if _, err := PostGzipWithContext(ctx, url, "application/json", errReader{}); err == nil ||
+		!strings.Contains(err.Error(), "read error") {
+		t.Errorf("error mismatch: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+// config.go - HTTP client configuration related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ClientConfig represents http client connection and timeout configurations.
+// Any zero or negative value will be defaulted to its respective constant.
+//
+// Header is added to every request, it overrides the request's own values.
+// HeaderHost limits it to the requests of given host, i.e.: sub.domain.tld:443,
+// so a redirected request to other host doesn't receive it.
+//
+// Proxy is an explicit proxy URL for every request, the HTTP_PROXY,
+// HTTPS_PROXY, and NO_PROXY environment variables are used when it is nil.
+type ClientConfig struct {
+	ContinueTimeout       time.Duration
+	DialTimeout           time.Duration
+	Header                http.Header
+	HeaderHost            string
+	IdleTimeout           time.Duration
+	KeepAlive             time.Duration
+	MaxConnections        int
+	OverallTimeout        time.Duration
+	Proxy                 *url.URL
+	ResponseHeaderTimeout time.Duration
+	TLSTimeout            time.Duration
+}
+
+// headerTransport is an implementation of http.RoundTripper and adds given
+// header to every request of given host, or any host when it is empty.
+type headerTransport struct {
+	base   http.RoundTripper
+	header http.Header
+	host   string
+}
+
+// RoundTrip is an implementation of http.RoundTripper.RoundTrip and adds
+// configured header to a copy of given request when its host matches.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.host != "" && req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	for key, values := range t.header {
+		req.Header[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle connections of the base transport, so
+// http.Client.CloseIdleConnections reaches it.
+func (t *headerTransport) CloseIdleConnections() {
+	if tr, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// DefaultClientConfig returns http client configurations from the constants.
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		ContinueTimeout:       HttpContinueTimeout * time.Second,
+		DialTimeout:           HttpDialTimeout * time.Second,
+		IdleTimeout:           IdleTimeout * time.Second,
+		KeepAlive:             HttpKeepAlive * time.Second,
+		MaxConnections:        MaxConnections,
+		OverallTimeout:        HttpOverallTimeout * time.Second,
+		ResponseHeaderTimeout: ResponseHeaderTimeout * time.Second,
+		TLSTimeout:            TLSDialTimeout * time.Second,
+	}
+}
+
+// withDefaults returns a copy of the configurations with zero or negative
+// values replaced by the defaults.
+func (c ClientConfig) withDefaults() ClientConfig {
+	d := DefaultClientConfig()
+
+	if c.ContinueTimeout <= 0 {
+		c.ContinueTimeout = d.ContinueTimeout
+	}
+
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = d.DialTimeout
+	}
+
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = d.IdleTimeout
+	}
+
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = d.KeepAlive
+	}
+
+	if c.MaxConnections <= 0 {
+		c.MaxConnections = d.MaxConnections
+	}
+
+	if c.OverallTimeout <= 0 {
+		c.OverallTimeout = d.OverallTimeout
+	}
+
+	if c.ResponseHeaderTimeout <= 0 {
+		c.ResponseHeaderTimeout = d.ResponseHeaderTimeout
+	}
+
+	if c.TLSTimeout <= 0 {
+		c.TLSTimeout = d.TLSTimeout
+	}
+
+	return c
+}
+
+// NewClient provides http client with given connection and timeout
+// configurations.
+func NewClient(cfg ClientConfig) *http.Client {
+	cfg = cfg.withDefaults()
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != nil {
+		proxy = http.ProxyURL(cfg.Proxy)
+	}
+
+	httpTransport := &http.Transport{
+		DialContext: (&net.Dialer{
+			KeepAlive: cfg.KeepAlive,
+			Timeout:   cfg.DialTimeout,
+		}).DialContext,
+		ExpectContinueTimeout: cfg.ContinueTimeout,
+		IdleConnTimeout:       cfg.IdleTimeout,
+		MaxIdleConns:          cfg.MaxConnections,
+		MaxIdleConnsPerHost:   cfg.MaxConnections,
+		Proxy:                 proxy,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		TLSHandshakeTimeout: cfg.TLSTimeout,
+	}
+
+	var transport http.RoundTripper = httpTransport
+	if len(cfg.Header) > 0 {
+		transport = &headerTransport{base: httpTransport, header: cfg.Header.Clone(),
+			host: cfg.HeaderHost}
+	}
+
+	return &http.Client{
+		Timeout:   cfg.OverallTimeout,
+		Transport: transport,
+	}
+}
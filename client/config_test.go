@@ -0,0 +1,190 @@
+// config_test.go - Test for HTTP client configuration related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package client
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConfigNewClient(t *testing.T) {
+	t.Parallel()
+
+	compare := func(cfg ClientConfig, want map[string]interface{}) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			c := NewClient(cfg)
+			tr := c.Transport.(*http.Transport)
+			got := map[string]interface{}{
+				"continue":       tr.ExpectContinueTimeout,
+				"idle":           tr.IdleConnTimeout,
+				"maxIdle":        tr.MaxIdleConns,
+				"maxIdlePerHost": tr.MaxIdleConnsPerHost,
+				"overall":        c.Timeout,
+				"responseHeader": tr.ResponseHeaderTimeout,
+				"tls":            tr.TLSHandshakeTimeout,
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with defaults", compare(ClientConfig{}, map[string]interface{}{
+		"continue":       HttpContinueTimeout * time.Second,
+		"idle":           IdleTimeout * time.Second,
+		"maxIdle":        MaxConnections,
+		"maxIdlePerHost": MaxConnections,
+		"overall":        HttpOverallTimeout * time.Second,
+		"responseHeader": ResponseHeaderTimeout * time.Second,
+		"tls":            TLSDialTimeout * time.Second,
+	}))
+	t.Run("with custom config", compare(ClientConfig{
+		ContinueTimeout:       time.Second,
+		DialTimeout:           2 * time.Second,
+		IdleTimeout:           3 * time.Second,
+		KeepAlive:             4 * time.Second,
+		MaxConnections:        5,
+		OverallTimeout:        10 * time.Minute,
+		ResponseHeaderTimeout: 6 * time.Second,
+		TLSTimeout:            7 * time.Second,
+	}, map[string]interface{}{
+		"continue":       time.Second,
+		"idle":           3 * time.Second,
+		"maxIdle":        5,
+		"maxIdlePerHost": 5,
+		"overall":        10 * time.Minute,
+		"responseHeader": 6 * time.Second,
+		"tls":            7 * time.Second,
+	}))
+	t.Run("with partial config", compare(ClientConfig{OverallTimeout: time.Minute}, map[string]interface{}{
+		"continue":       HttpContinueTimeout * time.Second,
+		"idle":           IdleTimeout * time.Second,
+		"maxIdle":        MaxConnections,
+		"maxIdlePerHost": MaxConnections,
+		"overall":        time.Minute,
+		"responseHeader": ResponseHeaderTimeout * time.Second,
+		"tls":            TLSDialTimeout * time.Second,
+	}))
+}
+
+func TestConfigDefaultClientConfig(t *testing.T) {
+	t.Parallel()
+
+	if diff := cmp.Diff(DefaultClientConfig(), ClientConfig{}.withDefaults()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestConfigNewClientProxy(t *testing.T) {
+	t.Parallel()
+
+	proxied := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		proxied = req.URL.String()
+		_, _ = rw.Write([]byte("PROXIED"))
+	}))
+	defer proxy.Close()
+
+	proxyUrl, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("parse proxy URL error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := NewClient(ClientConfig{Proxy: proxyUrl})
+	resp, err := GetWithClient(ctx, c, "http://sub.domain.tld/updates.xml")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "PROXIED" || proxied != "http://sub.domain.tld/updates.xml" {
+		t.Errorf("mismatch (body: %s, proxied: %s)", body, proxied)
+	}
+}
+
+func TestConfigNewClientProxyFromEnvironment(t *testing.T) {
+	t.Parallel()
+
+	tr := NewClient(ClientConfig{}).Transport.(*http.Transport)
+	if tr.Proxy == nil {
+		t.Error("missing proxy from environment")
+	}
+}
+
+func TestConfigNewClientHeader(t *testing.T) {
+	t.Parallel()
+
+	got := http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+		_, _ = rw.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := NewClient(ClientConfig{Header: http.Header{"User-Agent": {"app/1.0.0"}, "x-api-key": {"secret"}}})
+	resp, err := GetWithClient(ctx, c, server.URL)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+
+	if got.Get("User-Agent") != "app/1.0.0" || got.Get("X-Api-Key") != "secret" {
+		t.Errorf("header mismatch: %v", got)
+	}
+}
+
+func TestConfigNewClientHeaderHost(t *testing.T) {
+	t.Parallel()
+
+	got := http.Header{}
+	other := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+		_, _ = rw.Write([]byte("OK"))
+	}))
+	defer other.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Api-Key") != "secret" {
+			t.Errorf("header mismatch: %v", req.Header)
+		}
+		http.Redirect(rw, req, other.URL, http.StatusFound)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	u, _ := url.Parse(server.URL)
+	c := NewClient(ClientConfig{Header: http.Header{"x-api-key": {"secret"}}, HeaderHost: u.Host})
+	resp, err := GetWithClient(ctx, c, server.URL)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+
+	// The redirected request to other host doesn't receive the header.
+	if got.Get("X-Api-Key") != "" {
+		t.Errorf("header mismatch: %v", got)
+	}
+}
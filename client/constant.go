@@ -18,3 +18,10 @@ const (
 	ResponseHeaderTimeout = 10
 	TLSDialTimeout        = 15
 )
+
+// The retry configurations, the backoff is in seconds and doubled after every
+// failed attempt.
+const (
+	RetryBackoff     = 1
+	RetryMaxAttempts = 3
+)
@@ -0,0 +1,31 @@
+// codec.go - Message body encoding related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import "encoding/json"
+
+// Codec is an interface for message body encoding, i.e.: MessagePack or CBOR.
+// The message header framing stays the same regardless.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is an implementation of Codec and wraps encoding/json. It is the
+// same encoding used when Host.Codec is nil.
+type JSONCodec struct{}
+
+// Marshal is an implementation of Codec.Marshal and wraps json.Marshal.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal is an implementation of Codec.Unmarshal and wraps json.Unmarshal.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,160 @@
+// conn.go - Framed message connections.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"bufio"
+	"io"
+)
+
+// MessageConn represents one side of a native messaging connection, where
+// framed messages can be sent and received with configured Host framing. Each
+// Receive reads from the connection directly, so it suits a request/response
+// exchange, i.e.: on one end of NewPipe. Use Conn for a long-lived session.
+type MessageConn struct {
+	host   *Host
+	reader io.Reader
+	writer io.Writer
+}
+
+// pipeEnd is an implementation of io.ReadWriteCloser that reads from one pipe
+// and writes to the other.
+type pipeEnd struct {
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+// Close is an implementation of io.Closer and closes both pipes, so the other
+// side will get io.EOF on read and io.ErrClosedPipe on write.
+func (p *pipeEnd) Close() error {
+	return appendError(p.writer.Close(), p.reader.Close())
+}
+
+// Read is an implementation of io.Reader and reads from the inbound pipe.
+func (p *pipeEnd) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+// Write is an implementation of io.Writer and writes to the outbound pipe.
+func (p *pipeEnd) Write(b []byte) (int, error) {
+	return p.writer.Write(b)
+}
+
+// NewPipe returns a synchronous in-memory connection as a pair of connected
+// ends, where whatever written on one end can be read from the other end. Each
+// write blocks until it is read, so both ends should be used concurrently.
+// Closing either end causes io.EOF on the other end.
+//
+//   clientSide, hostSide := host.NewPipe()
+func NewPipe() (clientSide, hostSide io.ReadWriteCloser) {
+	clientReader, hostWriter := io.Pipe()
+	hostReader, clientWriter := io.Pipe()
+
+	return &pipeEnd{clientReader, clientWriter}, &pipeEnd{hostReader, hostWriter}
+}
+
+// NewMessageConn returns a connection to send and receive framed messages on
+// given reader and writer, i.e.: one end of NewPipe, with configured ByteOrder
+// and Codec.
+//
+//   messaging := (&host.Host{}).Init()
+//   clientSide, hostSide := host.NewPipe()
+//
+//   // Simulate the browser side.
+//   go func() {
+//     client := messaging.NewMessageConn(clientSide)
+//     client.Send(&host.H{"key": "value"})
+//   }()
+//
+//   request := &host.H{}
+//   if err := messaging.NewMessageConn(hostSide).Receive(request); err != nil {
+//     log.Fatalf("conn.Receive error: %v", err)
+//   }
+func (h *Host) NewMessageConn(rw io.ReadWriter) *MessageConn {
+	return &MessageConn{host: h, reader: rw, writer: rw}
+}
+
+// Receive reads a framed message and unmarshals it into given struct. Unlike
+// OnMessage, it returns io.EOF when the other side is closed instead of
+// exiting. It will return ErrEmptyMessage on zero length message, or error when
+// it come across one.
+func (c *MessageConn) Receive(v interface{}) error {
+	return c.host.readMessage(c.reader, v)
+}
+
+// Send marshals given struct and writes it as a framed message, which is the
+// same framing as PostMessage. It will return error when it come across one.
+func (c *MessageConn) Send(v interface{}) error {
+	return c.host.PostMessage(c.writer, v)
+}
+
+// Conn represents a long-lived native messaging session, i.e.: on os.Stdin and
+// os.Stdout, which is a MessageConn whose framed messages are read through a
+// buffered reader that is owned by the Conn, so the bytes buffered past a
+// message are kept for the next Read.
+type Conn struct {
+	conn MessageConn
+	size int
+}
+
+// A ConnOption configures a Conn that is created by NewConn.
+type ConnOption func(*Conn)
+
+// WithReadBufferSize sets given size as the read buffer size of Conn, which is
+// bufio default size when it is zero or negative.
+func WithReadBufferSize(size int) ConnOption {
+	return func(c *Conn) { c.size = size }
+}
+
+// NewConn returns a session to read and write framed messages on given reader
+// and writer with configured ByteOrder and Codec. Given reader should only be
+// read through the returned Conn afterward.
+//
+//   messaging := (&host.Host{}).Init()
+//   conn := messaging.NewConn(os.Stdin, os.Stdout)
+//
+//   for {
+//     request := &host.H{}
+//     if err := conn.Read(request); errors.Is(err, host.ErrEmptyMessage) {
+//       continue
+//     } else if err != nil {
+//       log.Fatalf("conn.Read error: %v", err)
+//     }
+//
+//     if err := conn.Write(&host.H{"key": "value"}); err != nil {
+//       log.Fatalf("conn.Write error: %v", err)
+//     }
+//   }
+func (h *Host) NewConn(r io.Reader, w io.Writer, opts ...ConnOption) *Conn {
+	c := &Conn{conn: MessageConn{host: h, writer: w}}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.size > 0 {
+		c.conn.reader = bufio.NewReaderSize(r, c.size)
+	} else {
+		c.conn.reader = bufio.NewReader(r)
+	}
+
+	return c
+}
+
+// Read reads a framed message and unmarshals it into given struct. Unlike
+// OnMessage, it returns io.EOF when the reader has no more message instead of
+// exiting. It will return ErrEmptyMessage on zero length message, or error when
+// it come across one.
+func (c *Conn) Read(v interface{}) error {
+	return c.conn.Receive(v)
+}
+
+// Write marshals given struct and writes it as a framed message, which is the
+// same framing as PostMessage. It will return error when it come across one.
+func (c *Conn) Write(v interface{}) error {
+	return c.conn.Send(v)
+}
@@ -0,0 +1,275 @@
+// conn_test.go - Test for framed message connections.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/google/go-cmp/cmp"
+	"io"
+	"os"
+	"testing"
+)
+
+// countingReader is a reader that counts the reads from its underlying reader.
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(buf []byte) (int, error) {
+	c.reads++
+	return c.Reader.Read(buf)
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	compare := func(h *Host, messages []H) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			clientSide, hostSide := NewPipe()
+			client := h.NewMessageConn(clientSide)
+			server := h.NewMessageConn(hostSide)
+
+			// Echo every request back to the client.
+			go func() {
+				defer hostSide.Close()
+				for {
+					request := H{}
+					if err := server.Receive(&request); err != nil {
+						return
+					}
+					if err := server.Send(request); err != nil {
+						return
+					}
+				}
+			}()
+
+			got := []H{}
+			for _, message := range messages {
+				if err := client.Send(message); err != nil {
+					t.Fatalf("send error %v: %v", message, err)
+				}
+
+				response := H{}
+				if err := client.Receive(&response); err != nil {
+					t.Fatalf("receive error %v: %v", message, err)
+				}
+				got = append(got, response)
+			}
+
+			clientSide.Close()
+
+			if diff := cmp.Diff(messages, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	messages := []H{{"key": "value"}, {"items": []interface{}{"a", "b"}}, {}}
+
+	t.Run("with little endian", compare(&Host{ByteOrder: binary.LittleEndian}, messages))
+	t.Run("with big endian", compare(&Host{ByteOrder: binary.BigEndian}, messages))
+	t.Run("with codec", compare(&Host{ByteOrder: binary.LittleEndian, Codec: reverseCodec{}}, messages))
+}
+
+func TestConnFraming(t *testing.T) {
+	t.Parallel()
+
+	h := &Host{ByteOrder: binary.LittleEndian}
+	buf := &bytes.Buffer{}
+
+	if err := h.NewMessageConn(buf).Send(&H{"key": "value"}); err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+
+	want := &bytes.Buffer{}
+	if err := h.PostMessage(want, &H{"key": "value"}); err != nil {
+		t.Fatalf("post message error: %v", err)
+	}
+
+	if diff := cmp.Diff(want.Bytes(), buf.Bytes()); diff != "" {
+		t.Errorf("framing mismatch (-want +got):\n%s", diff)
+	}
+
+	got := H{}
+	if err := h.NewMessageConn(buf).Receive(&got); err != nil {
+		t.Fatalf("receive error: %v", err)
+	}
+
+	if diff := cmp.Diff(H{"key": "value"}, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := h.NewMessageConn(buf).Receive(&got); err != io.EOF {
+		t.Errorf("want io.EOF: %v", err)
+	}
+}
+
+func TestConnEmptyMessage(t *testing.T) {
+	t.Parallel()
+
+	h := &Host{ByteOrder: binary.LittleEndian}
+	buf := bytes.NewBuffer([]byte{0, 0, 0, 0})
+	if err := h.PostMessage(buf, &H{"key": "value"}); err != nil {
+		t.Fatalf("post message error: %v", err)
+	}
+
+	conn := h.NewConn(buf, nil)
+	if err := conn.Read(&H{}); err != ErrEmptyMessage {
+		t.Errorf("error mismatch (want: %v, got: %v)", ErrEmptyMessage, err)
+	}
+
+	got := H{}
+	if err := conn.Read(&got); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+
+	if diff := cmp.Diff(H{"key": "value"}, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestConnClosedPipe(t *testing.T) {
+	t.Parallel()
+
+	h := &Host{ByteOrder: binary.LittleEndian}
+	clientSide, hostSide := NewPipe()
+	hostSide.Close()
+
+	if err := h.NewMessageConn(clientSide).Receive(&H{}); err != io.EOF {
+		t.Errorf("want io.EOF: %v", err)
+	}
+
+	if err := h.NewMessageConn(clientSide).Send(&H{}); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestConnNewConn(t *testing.T) {
+	t.Parallel()
+
+	compare := func(h *Host, opts ...ConnOption) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			messages := []H{{"id": "1"}, {"key": "value"}, {}, {"id": "3"}}
+
+			in := &bytes.Buffer{}
+			sender := h.NewConn(nil, in)
+			for _, message := range messages {
+				if err := sender.Write(message); err != nil {
+					t.Fatalf("write error %v: %v", message, err)
+				}
+			}
+
+			reader := &countingReader{Reader: in}
+			out := &bytes.Buffer{}
+			conn := h.NewConn(reader, out, opts...)
+
+			got := []H{}
+			for {
+				request := H{}
+				if err := conn.Read(&request); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("read error: %v", err)
+				}
+
+				got = append(got, request)
+
+				if err := conn.Write(request); err != nil {
+					t.Fatalf("write error %v: %v", request, err)
+				}
+			}
+
+			if diff := cmp.Diff(messages, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			// All frames fit into one buffered read, followed by io.EOF.
+			if reader.reads != 2 {
+				t.Errorf("reads mismatch (want: 2, got: %d)", reader.reads)
+			}
+
+			echoed := []H{}
+			echo := h.NewConn(out, nil)
+			for range messages {
+				response := H{}
+				if err := echo.Read(&response); err != nil {
+					t.Fatalf("echo read error: %v", err)
+				}
+				echoed = append(echoed, response)
+			}
+
+			if diff := cmp.Diff(messages, echoed); diff != "" {
+				t.Errorf("echo mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with little endian", compare(&Host{ByteOrder: binary.LittleEndian}))
+	t.Run("with big endian", compare(&Host{ByteOrder: binary.BigEndian}))
+	t.Run("with codec", compare(&Host{ByteOrder: binary.LittleEndian, Codec: reverseCodec{}}))
+	t.Run("with read buffer size", compare(&Host{ByteOrder: binary.LittleEndian}, WithReadBufferSize(64<<10)))
+}
+
+func BenchmarkConnReadSmall(b *testing.B) {
+	compare := func(buffered bool) func(b *testing.B) {
+		return func(b *testing.B) {
+			h := &Host{ByteOrder: binary.LittleEndian}
+
+			message := &bytes.Buffer{}
+			if err := h.PostMessage(message, &H{"type": "ping", "id": 1}); err != nil {
+				b.Fatalf("post message error: %v", err)
+			}
+
+			// Every read from the pipe is a read syscall, like it is on os.Stdin.
+			pr, pw, err := os.Pipe()
+			if err != nil {
+				b.Fatalf("pipe error: %v", err)
+			}
+			defer pr.Close()
+
+			go func() {
+				defer pw.Close()
+				for i := 0; i < b.N; i++ {
+					if _, err := pw.Write(message.Bytes()); err != nil {
+						return
+					}
+				}
+			}()
+
+			reader := &countingReader{Reader: pr}
+			read := h.NewMessageConn(&struct {
+				io.Reader
+				io.Writer
+			}{reader, nil}).Receive
+			if buffered {
+				read = h.NewConn(reader, nil).Read
+			}
+			request := &H{}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := read(request); err != nil {
+					b.Fatalf("read error: %v", err)
+				}
+			}
+
+			b.ReportMetric(float64(reader.reads)/float64(b.N), "syscalls/op")
+		}
+	}
+
+	b.Run("unbuffered", compare(false))
+	b.Run("buffered", compare(true))
+}
@@ -7,14 +7,37 @@
 
 package host
 
+import "time"
+
+// DefaultUpdateInterval is the default duration between update checks.
+const DefaultUpdateInterval = 24 * time.Hour
+
+// MaxPooledBufferSize is the largest message buffer kept for reuse, which is
+// the native messaging limit of a message sent from the host.
+const MaxPooledBufferSize = 1024 * 1024
+
+// MaxWebSocketMessageSize is the largest message accepted by ServeWebSocket.
+const MaxWebSocketMessageSize = 4 * 1024 * 1024
+
+// PingTimeout is the maximum seconds given to Ping round trip.
+const PingTimeout = 5
+
+// UserAgent is the product token of the default User-Agent header on update
+// related requests.
+const UserAgent = "native-messaging-host"
+
+// VerifyTimeout is the maximum seconds given to the update validation run.
+const VerifyTimeout = 10
+
 // The Http connection and timeout configurations.
 const (
-	HttpContinueTimeout   = 5
-	HttpKeepAlive         = 600
-	HttpDialTimeout       = 10
-	HttpOverallTimeout    = 15
-	IdleTimeout           = 90
-	MaxConnections        = 100
-	ResponseHeaderTimeout = 10
-	TLSDialTimeout        = 15
+	DownloadOverallTimeout = 600
+	HttpContinueTimeout    = 5
+	HttpKeepAlive          = 600
+	HttpDialTimeout        = 10
+	HttpOverallTimeout     = 15
+	IdleTimeout            = 90
+	MaxConnections         = 100
+	ResponseHeaderTimeout  = 10
+	TLSDialTimeout         = 15
 )
@@ -8,25 +8,51 @@
 package host
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"github.com/rickypc/native-messaging-host/client"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// ErrChecksumMismatch is returned when downloaded update doesn't match its
+// SHA-256 checksum in updates.xml.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
 // fs is a shortcut to *FileSystem. It helps write testable code.
 var fs FileSystemInterface = &FileSystem{}
 
 // ioCopy is a shortcut to io.Copy. It helps write testable code.
 var ioCopy = io.Copy
 
+// osChmod is a shortcut to os.Chmod. It helps write testable code.
+var osChmod = os.Chmod
+
 // osRename is a shortcut to os.Rename. It helps write testable code.
 var osRename = os.Rename
 
+// runExecutable runs given executable with given arguments and returns its
+// combined output. It helps write testable code.
+var runExecutable = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// runtimeGOOS is a shortcut to runtime.GOOS. It helps write testable code.
+var runtimeGOOS = runtime.GOOS
+
 // FileInterface is an interface for OpenFile first-value return. It helps write
 // testable code.
 type FileInterface interface {
@@ -50,62 +76,512 @@ func (f *FileSystem) OpenFile(name string, flag int, perm os.FileMode) (FileInte
 	return os.OpenFile(name, flag, perm)
 }
 
+// copyFile copies given source file content and permission to given
+// destination file. It will return error when it come across one.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); closeErr != nil {
+		if err == nil {
+			err = closeErr
+		} else {
+			err = fmt.Errorf("%w %v", err, closeErr)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return osChmod(dst, fileMode(info))
+}
+
+// fileMode returns given file permission including setuid, setgid, and sticky
+// bits.
+func fileMode(info os.FileInfo) os.FileMode {
+	return info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// moveFile renames given source file to given destination file. It will fall
+// back to copy and remove when both files are not on the same device. It will
+// return error when it come across one.
+func moveFile(src, dst string) error {
+	err := osRename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+
+	return os.Remove(src)
+}
+
 // downloadLatest will download latest file content from given download URL and
-// replace current executable with it. It will return error when it come across
-// one.
-func (h *Host) downloadLatest(url string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), HttpOverallTimeout*time.Second)
-	defer cancel()
+// replace current executable with it. An interrupted download will be resumed
+// on next call, see downloadPart. It will return DownloadError or SwapError
+// when it come across one.
+func (h *Host) downloadLatest(url, hash, version string) error {
+	partName, err := h.downloadPart(url, hash)
+	if err != nil {
+		return &DownloadError{Url: url, Err: err}
+	}
+	defer h.removePart()
 
-	resp := client.MustGetWithContext(ctx, url)
-	defer resp.Body.Close()
+	if err := h.replaceExecutable(partName, hash, version); err != nil {
+		return &SwapError{Err: err}
+	}
+
+	return nil
+}
+
+// replaceExecutable will replace current executable with given downloaded file.
+// The downloaded content will be verified against given SHA-256 checksum, if
+// any. The original mode will be preserved and on OS X, the quarantine
+// attribute will be cleared. The replaced executable will be validated against
+// given version on VerifyArgs, and rolled back on failure. On Windows, see
+// replaceDeferred. On DeferUpdate, see writePending. It will return error when
+// it come across one.
+func (h *Host) replaceExecutable(partName, hash, version string) error {
+	part, err := os.Open(partName)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+
+	// Reuse original mode, otherwise fall back to 0755.
+	mode := os.FileMode(0755)
+	if info, err := os.Stat(h.ExecName); err == nil {
+		mode = fileMode(info)
+	}
+
+	// It will be applied by ApplyPendingUpdate on next start.
+	if h.DeferUpdate {
+		return h.writePending(part, hash, version, mode)
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Unable to find the update: %d", resp.StatusCode)
+	// Running executable can't be overwritten on Windows.
+	if runtimeGOOS == "windows" {
+		return h.replaceDeferred(part, hash, version, mode)
 	}
 
-	backupName := h.ExecName + ".bak"
-	if err := osRename(h.ExecName, backupName); err != nil {
+	backupName := h.getStateName(h.getBackupSuffix())
+	if err := moveFile(h.ExecName, backupName); err != nil {
 		return err
 	}
 
-	file, err := fs.OpenFile(h.ExecName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	file, err := fs.OpenFile(h.ExecName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
 	if err != nil {
-		if mvErr := osRename(backupName, h.ExecName); mvErr != nil {
+		if mvErr := moveFile(backupName, h.ExecName); mvErr != nil {
 			err = fmt.Errorf("%w %v", err, mvErr)
 		}
 		return err
 	}
 	defer file.Close()
 
-	if _, err := ioCopy(file, resp.Body); err != nil {
-		if mvErr := osRename(backupName, h.ExecName); mvErr != nil {
+	hasher := sha256.New()
+	if _, err := ioCopy(io.MultiWriter(file, hasher), part); err != nil {
+		if mvErr := moveFile(backupName, h.ExecName); mvErr != nil {
+			err = fmt.Errorf("%w %v", err, mvErr)
+		}
+		return err
+	}
+
+	if err := verifyChecksum(hasher.Sum(nil), hash); err != nil {
+		if mvErr := moveFile(backupName, h.ExecName); mvErr != nil {
+			err = fmt.Errorf("%w %v", err, mvErr)
+		}
+		return err
+	}
+
+	if err := h.finalizeExecutable(h.ExecName, mode); err != nil {
+		if mvErr := moveFile(backupName, h.ExecName); mvErr != nil {
+			err = fmt.Errorf("%w %v", err, mvErr)
+		}
+		return err
+	}
+
+	if err := h.verifyExecutable(h.ExecName, version); err != nil {
+		if mvErr := moveFile(backupName, h.ExecName); mvErr != nil {
+			err = fmt.Errorf("%w %v", err, mvErr)
+		}
+		return err
+	}
+
+	os.Remove(backupName)
+	return nil
+}
+
+// downloadPart will download given URL content into a partial file in StateDir,
+// and returns its name once it is complete and verified against given SHA-256
+// checksum, if any. The partial file of the same URL is resumed with Range and
+// If-Range headers, so it is downloaded over when the content has changed or
+// the server ignores them. An interrupted download, including one shorter than
+// its Content-Length, is kept for the next call. It will return error when it
+// come across one.
+func (h *Host) downloadPart(url, hash string) (string, error) {
+	partName := h.getStateName(".part")
+	urlName := h.getStateName(".part.url")
+
+	// Resume only the same download URL with known validator.
+	offset := int64(0)
+	header := http.Header{}
+	if marker, err := ioutil.ReadFile(urlName); err == nil {
+		lines := strings.SplitN(string(marker), "\n", 2)
+		if len(lines) == 2 && lines[0] == url && lines[1] != "" {
+			if info, err := os.Stat(partName); err == nil && info.Size() > 0 {
+				offset = info.Size()
+				header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+				header.Set("If-Range", lines[1])
+			}
+		}
+	}
+
+	timeout := h.getDownloadTimeout()
+	ctx, cancel := context.WithTimeout(h.getUpdateContext(), timeout)
+	defer cancel()
+
+	c := h.newClient(timeout)
+	defer h.closeClient(c)
+
+	resp, err := client.GetWithHeader(ctx, c, url, header)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	flag := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Fresh download, changed content, or the server ignores Range header.
+		if h.StateDir != "" {
+			if err := osMkdirAll(h.StateDir, 0755); err != nil {
+				return "", err
+			}
+		}
+
+		marker := url + "\n" + getValidator(resp.Header)
+		if err := ioutilWriteFile(urlName, []byte(marker), 0644); err != nil {
+			return "", err
+		}
+		flag |= os.O_TRUNC
+	case http.StatusPartialContent:
+		if start := getRangeStart(resp.Header.Get("Content-Range")); start != offset {
+			h.removePart()
+			return "", fmt.Errorf("Unexpected content range: %d != %d", start, offset)
+		}
+		flag |= os.O_APPEND
+	default:
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			h.removePart()
+		}
+		return "", fmt.Errorf("Unable to find the update: %d", resp.StatusCode)
+	}
+
+	file, err := fs.OpenFile(partName, flag, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	// A dropped connection might end the body early without error.
+	written, err := io.Copy(file, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && written != resp.ContentLength {
+		err = fmt.Errorf("Incomplete download: %d of %d bytes", written, resp.ContentLength)
+	}
+
+	if err = appendError(err, file.Close()); err != nil {
+		return "", err
+	}
+
+	if hash != "" {
+		sum, err := fileChecksum(partName)
+		if err == nil {
+			err = verifyChecksum(sum, hash)
+		}
+
+		if err != nil {
+			h.removePart()
+			return "", err
+		}
+	}
+
+	return partName, nil
+}
+
+// getRangeStart returns the first byte position of given Content-Range header
+// value, otherwise -1.
+func getRangeStart(contentRange string) int64 {
+	var start, end int64
+	var size string
+
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &size); err != nil {
+		return -1
+	}
+	return start
+}
+
+// getValidator returns given response headers' strong ETag, or Last-Modified
+// as a fallback, to be sent as If-Range header, otherwise empty string.
+func getValidator(header http.Header) string {
+	// A weak ETag is not allowed in If-Range header.
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// removePart removes partial download file and its URL marker.
+func (h *Host) removePart() {
+	os.Remove(h.getStateName(".part"))
+	os.Remove(h.getStateName(".part.url"))
+}
+
+// getDownloadTimeout returns configured download timeout, otherwise
+// DownloadOverallTimeout seconds, which is longer than updates.xml request's
+// HttpOverallTimeout seconds to fit large executable.
+func (h *Host) getDownloadTimeout() time.Duration {
+	if h.DownloadTimeout > 0 {
+		return h.DownloadTimeout
+	}
+	return DownloadOverallTimeout * time.Second
+}
+
+// getHeaders returns a copy of configured headers with default User-Agent, if
+// it is absent.
+func (h *Host) getHeaders() http.Header {
+	header := http.Header{}
+	for key, values := range h.Headers {
+		header[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+
+	if header.Get("User-Agent") == "" {
+		header.Set("User-Agent", fmt.Sprintf("%s/%s %s", h.AppName, h.Version, UserAgent))
+	}
+
+	return header
+}
+
+// closeClient closes idle connections of given http client, unless it is the
+// configured HttpClient, so the transport of a one-off client doesn't keep them
+// open.
+func (h *Host) closeClient(c *http.Client) {
+	if c != h.HttpClient {
+		c.CloseIdleConnections()
+	}
+}
+
+// newClient returns configured http client, otherwise http client with given
+// overall timeout and configured headers, which are only sent to UpdateUrl
+// host.
+func (h *Host) newClient(timeout time.Duration) *http.Client {
+	if h.HttpClient != nil {
+		return h.HttpClient
+	}
+
+	cfg := client.ClientConfig{Header: h.getHeaders(), OverallTimeout: timeout}
+	if u, err := url.Parse(h.UpdateUrl); err == nil {
+		cfg.HeaderHost = u.Host
+	}
+
+	return client.NewClient(cfg)
+}
+
+// replaceDeferred will write given content to a new file next to current
+// executable, validate it against given version on VerifyArgs, and swap them.
+// When current executable is locked, the swap will be scheduled on next reboot
+// instead. It will return error when it come across one.
+func (h *Host) replaceDeferred(body io.Reader, hash, version string, mode os.FileMode) error {
+	newName := h.getStateName(".new")
+
+	file, err := fs.OpenFile(newName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	_, err = ioCopy(io.MultiWriter(file, hasher), body)
+	err = appendError(err, file.Close())
+
+	if err == nil {
+		err = verifyChecksum(hasher.Sum(nil), hash)
+	}
+
+	if err == nil {
+		err = h.verifyExecutable(newName, version)
+	}
+
+	if err != nil {
+		os.Remove(newName)
+		return err
+	}
+
+	backupName := h.getStateName(h.getBackupSuffix())
+	if err := moveFile(h.ExecName, backupName); err != nil {
+		// Current executable is locked, swap it on next reboot.
+		if schedErr := scheduleReplace(newName, h.ExecName); schedErr != nil {
+			return fmt.Errorf("%w %v", err, schedErr)
+		}
+		h.logger().Printf("Update is scheduled on next reboot")
+		return nil
+	}
+
+	if err := moveFile(newName, h.ExecName); err != nil {
+		if mvErr := moveFile(backupName, h.ExecName); mvErr != nil {
 			err = fmt.Errorf("%w %v", err, mvErr)
 		}
 		return err
 	}
 
+	// It might be locked by current process, best effort only.
 	os.Remove(backupName)
 	return nil
 }
 
-// getDownloadUrlAndVersion returns download URL and latest version on
-// configured application name. It will return error when it come across one.
-func (h *Host) getDownloadUrlAndVersion() (string, string, error) {
-	url := ""
-	version := ""
+// finalizeExecutable applies given mode on given downloaded executable, since
+// the mode given on creation is subject to umask, then prepares it for the
+// platform. It will return error when it come across one.
+func (h *Host) finalizeExecutable(name string, mode os.FileMode) error {
+	if err := osChmod(name, mode); err != nil {
+		return err
+	}
+
+	return prepareExecutable(name)
+}
+
+// verifyExecutable runs given executable with configured VerifyArgs, if any,
+// and checks its output contains configured VerifyMarker, otherwise given
+// version, if any. It will return error when it come across one.
+func (h *Host) verifyExecutable(name, version string) error {
+	if len(h.VerifyArgs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(h.getUpdateContext(), VerifyTimeout*time.Second)
+	defer cancel()
+
+	output, err := runExecutable(ctx, name, h.VerifyArgs...)
+	if err != nil {
+		return fmt.Errorf("Unable to run the update: %w", err)
+	}
+
+	marker := h.VerifyMarker
+	if marker == "" {
+		marker = version
+	}
+
+	if !strings.Contains(string(output), marker) {
+		return fmt.Errorf("Unexpected update output: %q lacks %q", output, marker)
+	}
+
+	return nil
+}
+
+// verifyChecksum compares given SHA-256 sum with given checksum in hexadecimal,
+// if any. It will return error when they mismatch.
+func verifyChecksum(sum []byte, hash string) error {
+	if hexSum := hex.EncodeToString(sum); hash != "" && !strings.EqualFold(hexSum, hash) {
+		return fmt.Errorf("%s != %s: %w", hexSum, hash, ErrChecksumMismatch)
+	}
+	return nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), HttpOverallTimeout*time.Second)
+// FetchUpdateManifest returns decoded updates.xml from configured UpdateUrl,
+// without comparing versions or downloading anything, i.e.: for diagnostics.
+// The updates.xml is requested conditionally with cached ETag and Last-Modified
+// validators, and the cached one is reused on 304 Not Modified. The gzip
+// encoding is requested and decompressed even with custom HttpClient. It will
+// return error when it come across one.
+//
+//   messaging := (&host.Host{UpdateUrl: "https://sub.domain.tld/updates.xml"}).Init()
+//
+//   manifest, err := messaging.FetchUpdateManifest()
+//   if err != nil {
+//     log.Fatalf("messaging.FetchUpdateManifest error: %v", err)
+//   }
+//
+//   log.Printf("update: %+v", manifest.GetChannelUpdate(messaging.AppName, "beta"))
+func (h *Host) FetchUpdateManifest() (*UpdateCheckResponse, error) {
+	ctx, cancel := context.WithTimeout(h.getUpdateContext(), HttpOverallTimeout*time.Second)
 	defer cancel()
 
-	resp := client.MustGetWithContext(ctx, h.UpdateUrl)
+	cache := h.readUpdateCache()
+	header := cache.getConditionalHeader()
+	if header == nil {
+		header = http.Header{}
+	}
+
+	// The explicit header disables transparent decompression of http.Transport,
+	// so it is handled the same way with any transport.
+	header.Set("Accept-Encoding", "gzip")
+
+	c := h.newClient(HttpOverallTimeout * time.Second)
+	defer h.closeClient(c)
+
+	resp, err := client.GetWithHeader(ctx, c, h.UpdateUrl, header)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
+	var body []byte
+	if resp.StatusCode == http.StatusNotModified && cache != nil {
+		body = cache.body
+	} else if body, err = readResponseBody(resp); err != nil {
+		return nil, err
+	} else if resp.StatusCode == http.StatusOK {
+		if err := h.writeUpdateCache(resp.Header, body); err != nil {
+			h.logger().Printf("Update cache error: %v", err)
+		}
+	}
+
 	response := &UpdateCheckResponse{}
-	if err := xml.NewDecoder(resp.Body).Decode(response); err != nil {
-		return url, version, err
+	if err := xml.Unmarshal(body, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// readResponseBody returns body of given response, which is decompressed when it
+// is gzip encoded. It will return error when it come across one.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("gunzip error: %w", err)
+	}
+	defer zr.Close()
+
+	return ioutil.ReadAll(zr)
+}
+
+// getLatestUpdate returns latest update on configured application name and
+// release channel from updates.xml. It will return error when it come across
+// one.
+func (h *Host) getLatestUpdate() (*Update, error) {
+	response, err := h.FetchUpdateManifest()
+	if err != nil {
+		return &Update{}, err
 	}
 
-	url, version = response.GetUrlAndVersion(h.AppName)
-	return url, version, nil
+	return response.GetChannelUpdate(h.AppName, h.Channel), nil
 }
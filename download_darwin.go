@@ -0,0 +1,29 @@
+// download_darwin.go - Prepare downloaded executable for OS X.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+)
+
+// unixRemovexattr is a shortcut to unix.Removexattr. It helps write testable
+// code.
+var unixRemovexattr = unix.Removexattr
+
+// prepareExecutable clears com.apple.quarantine extended attribute of given
+// downloaded executable, so it can be executed without Gatekeeper prompt. It
+// will return error when it come across one.
+func prepareExecutable(name string) error {
+	if err := unixRemovexattr(name, "com.apple.quarantine"); err != nil &&
+		!errors.Is(err, unix.ENOATTR) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+// download_darwin_test.go - Test for downloaded executable on OS X.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDownloadPrepareExecutable(t *testing.T) {
+	compare := func(wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			targetName := "testdata/quarantined"
+
+			if err := ioutil.WriteFile(targetName, []byte(""), 0644); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+			defer func() { os.Remove(targetName) }()
+
+			if err := unix.Setxattr(targetName, "com.apple.quarantine", []byte("0081;"), 0); err != nil {
+				t.Fatalf("setxattr error: %v", err)
+			}
+
+			if wantErr {
+				oldUnixRemovexattr := unixRemovexattr
+				defer func() { unixRemovexattr = oldUnixRemovexattr }()
+				unixRemovexattr = func(string, string) error { return errors.New("removexattr error") }
+			}
+
+			if err := prepareExecutable(targetName); !wantErr && err != nil {
+				t.Fatalf("prepare error: %v", err)
+			} else if wantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+
+			if _, err := unix.Getxattr(targetName, "com.apple.quarantine", nil); !errors.Is(err, unix.ENOATTR) {
+				t.Errorf("quarantine should be cleared: %v", err)
+			}
+		}
+	}
+
+	t.Run("with quarantined file", compare(false))
+	t.Run("with removexattr error", compare(true))
+}
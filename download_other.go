@@ -0,0 +1,15 @@
+// download_other.go - Prepare downloaded executable for non OS X.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build !darwin
+
+package host
+
+// prepareExecutable is a no-op outside OS X.
+func prepareExecutable(name string) error {
+	return nil
+}
@@ -9,17 +9,27 @@ package host
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/google/go-cmp/cmp"
+	"github.com/rickypc/native-messaging-host/client"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var opened bool
@@ -33,6 +43,10 @@ func (s *StubFileSystem) Close() error {
 }
 
 func (s *StubFileSystem) OpenFile(name string, flag int, perm os.FileMode) (FileInterface, error) {
+	// The partial download is kept on disk for the executable replacement.
+	if strings.HasSuffix(name, ".part") {
+		return (&FileSystem{}).OpenFile(name, flag, perm)
+	}
 	opened = true
 	return s, nil
 }
@@ -46,13 +60,39 @@ func (s *StubErrorFileSystem) Close() error {
 }
 
 func (s *StubErrorFileSystem) OpenFile(name string, flag int, perm os.FileMode) (FileInterface, error) {
+	// The partial download is kept on disk for the executable replacement.
+	if strings.HasSuffix(name, ".part") {
+		return (&FileSystem{}).OpenFile(name, flag, perm)
+	}
 	opened = true
 	return nil, errors.New("open file error")
 }
 
+// errorClass returns the class of given update error, which is checksum,
+// download, swap, or empty.
+func errorClass(err error) string {
+	var downloadErr *DownloadError
+	var swapErr *SwapError
+
+	switch {
+	case errors.Is(err, ErrChecksumMismatch):
+		return "checksum"
+	case errors.As(err, &downloadErr):
+		return "download"
+	case errors.As(err, &swapErr):
+		return "swap"
+	}
+	return ""
+}
+
 func TestDownloadLatest(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 
+	// In-place replacement is covered here, see TestDownloadReplaceDeferred.
+	oldRuntimeGOOS := runtimeGOOS
+	defer func() { runtimeGOOS = oldRuntimeGOOS }()
+	runtimeGOOS = "linux"
+
 	compare := func(wantErr int, want *H) func(t *testing.T) {
 		return func(t *testing.T) {
 			copied := false
@@ -67,20 +107,56 @@ func TestDownloadLatest(t *testing.T) {
 				}
 			}))
 			defer server.Close()
+			hash := ""
+			perm := os.FileMode(0755)
 			targetName := "testdata/down"
 			url := server.URL
 
 			switch wantErr {
-			case 0:
+			case 0, -4:
+				if wantErr == -4 {
+					perm = 0700
+				}
 				if err := ioutil.WriteFile(targetName, []byte(""), 0644); err != nil {
 					t.Fatalf("touch file error: %v", err)
 				}
+				if err := os.Chmod(targetName, perm); err != nil {
+					t.Fatalf("chmod file error: %v", err)
+				}
+				defer func() { os.Remove(targetName) }()
+			case -1:
+				if err := ioutil.WriteFile(targetName, []byte(""), 0755); err != nil {
+					t.Fatalf("touch file error: %v", err)
+				}
+				oldOsRename := osRename
+				defer func() {
+					os.Remove(targetName)
+					osRename = oldOsRename
+				}()
+				osRename = func(oldpath, newpath string) error {
+					renamed++
+					return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+				}
+			case -2, -3:
+				if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+					t.Fatalf("touch file error: %v", err)
+				}
 				defer func() { os.Remove(targetName) }()
+				sum := sha256.Sum256([]byte("OK"))
+				hash = hex.EncodeToString(sum[:])
+				if wantErr == -3 {
+					hash = hex.EncodeToString(make([]byte, sha256.Size))
+				}
 			case 1:
+				// It is needed by platform specific executable preparation.
+				if err := ioutil.WriteFile(targetName, []byte(""), 0644); err != nil {
+					t.Fatalf("touch file error: %v", err)
+				}
 				oldFs := fs
 				oldIoCopy := ioCopy
 				oldOsRename := osRename
 				defer func() {
+					os.Remove(targetName)
 					fs = oldFs
 					ioCopy = oldIoCopy
 					osRename = oldOsRename
@@ -167,17 +243,24 @@ func TestDownloadLatest(t *testing.T) {
 				}
 			}
 
-			if err := (&Host{ExecName: targetName}).downloadLatest(url); wantErr < 2 && err != nil {
+			err := (&Host{ExecName: targetName}).downloadLatest(url, hash, "")
+			if (wantErr < 2 && wantErr != -3) && err != nil {
 				t.Errorf("download error: %v", err)
-			} else if wantErr > 1 && err == nil {
+			} else if (wantErr > 1 || wantErr == -3) && err == nil {
 				t.Fatal("want error")
 			}
 
-			if wantErr == 0 {
+			if wantErr == -3 {
+				if buf, err := ioutil.ReadFile(targetName); err != nil {
+					t.Fatalf("file read error: %v", err)
+				} else if string(buf) != "OLD" {
+					t.Fatal("backup is not restored")
+				}
+			} else if wantErr < 1 {
 				if info, err := os.Stat(targetName); err != nil {
 					t.Fatalf("missing file: %v", err)
-				} else if fmt.Sprintf("%#o", info.Mode().Perm()) != "0755" {
-					t.Fatalf("wrong file permission: %v", err)
+				} else if info.Mode().Perm() != perm {
+					t.Fatalf("wrong file permission: %#o", info.Mode().Perm())
 				}
 
 				if buf, err := ioutil.ReadFile(targetName); err != nil {
@@ -185,32 +268,192 @@ func TestDownloadLatest(t *testing.T) {
 				} else if string(buf) != "OK" {
 					t.Fatal("wrong content")
 				}
+
+				if _, err := os.Stat(targetName + ".bak"); err == nil {
+					t.Fatal("backup file should be removed")
+				}
 			}
 
-			got := &H{"copied": copied, "opened": opened, "renamed": renamed}
+			got := &H{"copied": copied, "err": errorClass(err), "opened": opened, "renamed": renamed}
 			if diff := cmp.Diff(want, got); diff != "" {
-				t.Errorf("mismatch for %d (-want +got):\n%s", wantErr, diff)
+				t.Errorf("mismatch for %d (-want +got):\n%s (%v)", wantErr, diff, err)
 			}
 		}
 	}
 
-	t.Run("with download latest on fs", compare(0, &H{"copied": false, "opened": false, "renamed": 0}))
-	t.Run("with download latest", compare(1, &H{"copied": true, "opened": true, "renamed": 1}))
-	t.Run("with non-OK status code error", compare(2, &H{"copied": false, "opened": false,
+	t.Run("with download latest on fs", compare(0, &H{"copied": false, "err": "", "opened": false,
+		"renamed": 0}))
+	t.Run("with download latest preserving mode", compare(-4, &H{"copied": false, "err": "",
+		"opened": false, "renamed": 0}))
+	t.Run("with download latest across devices", compare(-1, &H{"copied": false, "err": "",
+		"opened": false, "renamed": 1}))
+	t.Run("with matching checksum", compare(-2, &H{"copied": false, "err": "", "opened": false,
 		"renamed": 0}))
-	t.Run("with create backup error", compare(3, &H{"copied": false, "opened": false,
+	t.Run("with mismatching checksum", compare(-3, &H{"copied": false, "err": "checksum",
+		"opened": false, "renamed": 0}))
+	t.Run("with download latest", compare(1, &H{"copied": true, "err": "", "opened": true,
 		"renamed": 1}))
-	t.Run("with create file error", compare(4, &H{"copied": false, "opened": true,
-		"renamed": 2}))
-	t.Run("with create file revert error", compare(5, &H{"copied": false, "opened": true,
+	t.Run("with non-OK status code error", compare(2, &H{"copied": false, "err": "download",
+		"opened": false, "renamed": 0}))
+	t.Run("with create backup error", compare(3, &H{"copied": false, "err": "swap", "opened": false,
+		"renamed": 1}))
+	t.Run("with create file error", compare(4, &H{"copied": false, "err": "swap", "opened": true,
 		"renamed": 2}))
-	t.Run("with download file error", compare(6, &H{"copied": true, "opened": true,
+	t.Run("with create file revert error", compare(5, &H{"copied": false, "err": "swap",
+		"opened": true, "renamed": 2}))
+	t.Run("with download file error", compare(6, &H{"copied": true, "err": "swap", "opened": true,
 		"renamed": 2}))
-	t.Run("with download revert error", compare(7, &H{"copied": true, "opened": true,
+	t.Run("with download revert error", compare(7, &H{"copied": true, "err": "swap", "opened": true,
 		"renamed": 2}))
 }
 
-func TestDownloadUrlAndVersion(t *testing.T) {
+func TestDownloadReplaceDeferred(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	oldRuntimeGOOS := runtimeGOOS
+	defer func() { runtimeGOOS = oldRuntimeGOOS }()
+	runtimeGOOS = "windows"
+
+	compare := func(wantErr int, want *H) func(t *testing.T) {
+		return func(t *testing.T) {
+			hash := ""
+			oldOsRename := osRename
+			oldScheduleReplace := scheduleReplace
+			renamed := 0
+			scheduled := false
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_, _ = rw.Write([]byte("OK"))
+			}))
+			targetName := fmt.Sprintf("testdata/deferred-%d", wantErr)
+
+			defer func() {
+				os.Remove(targetName)
+				os.Remove(targetName + ".bak")
+				os.Remove(targetName + ".new")
+				osRename = oldOsRename
+				scheduleReplace = oldScheduleReplace
+				server.Close()
+			}()
+
+			if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+
+			scheduleReplace = func(src, dst string) error {
+				scheduled = src == targetName+".new" && dst == targetName
+				return nil
+			}
+
+			switch wantErr {
+			case 1:
+				// Running executable is locked.
+				osRename = func(string, string) error {
+					renamed++
+					return errors.New("file in use")
+				}
+			case 2:
+				hash = hex.EncodeToString(make([]byte, sha256.Size))
+			}
+
+			err := (&Host{ExecName: targetName}).downloadLatest(server.URL, hash, "")
+			if wantErr < 2 && err != nil {
+				t.Fatalf("download error: %v", err)
+			} else if wantErr == 2 && err == nil {
+				t.Fatal("want error")
+			}
+
+			current, _ := ioutil.ReadFile(targetName)
+			pending, _ := ioutil.ReadFile(targetName + ".new")
+			got := &H{"current": string(current), "err": errorClass(err), "pending": string(pending),
+				"renamed": renamed, "scheduled": scheduled}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch for %d (-want +got):\n%s (%v)", wantErr, diff, err)
+			}
+		}
+	}
+
+	t.Run("with unlocked executable", compare(0, &H{"current": "OK", "err": "", "pending": "",
+		"renamed": 0, "scheduled": false}))
+	t.Run("with locked executable", compare(1, &H{"current": "OLD", "err": "", "pending": "OK",
+		"renamed": 1, "scheduled": true}))
+	t.Run("with mismatching checksum", compare(2, &H{"current": "OLD", "err": "checksum", "pending": "",
+		"renamed": 0, "scheduled": false}))
+}
+
+func TestDownloadMoveFile(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(wantErr int) func(t *testing.T) {
+		return func(t *testing.T) {
+			oldOsRename := osRename
+			renamed := 0
+			src := fmt.Sprintf("testdata/move-src-%d", wantErr)
+			dst := fmt.Sprintf("testdata/move-dst-%d", wantErr)
+
+			defer func() {
+				os.Remove(src)
+				os.Remove(dst)
+				osRename = oldOsRename
+			}()
+
+			if err := ioutil.WriteFile(src, []byte("OK"), 0755); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+
+			switch wantErr {
+			case 1:
+				osRename = func(oldpath, newpath string) error {
+					renamed++
+					return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+				}
+			case 2:
+				osRename = func(string, string) error {
+					renamed++
+					return errors.New("rename error")
+				}
+			}
+
+			err := moveFile(src, dst)
+			if wantErr < 2 && err != nil {
+				t.Fatalf("move error: %v", err)
+			} else if wantErr == 2 {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				if _, err := os.Stat(dst); err == nil {
+					t.Error("destination should not exist")
+				}
+				return
+			}
+
+			if _, err := os.Stat(src); err == nil {
+				t.Error("source should be removed")
+			}
+
+			if info, err := os.Stat(dst); err != nil {
+				t.Fatalf("missing file: %v", err)
+			} else if fmt.Sprintf("%#o", info.Mode().Perm()) != "0755" {
+				t.Errorf("wrong file permission: %#o", info.Mode().Perm())
+			}
+
+			if buf, err := ioutil.ReadFile(dst); err != nil {
+				t.Fatalf("file read error: %v", err)
+			} else if string(buf) != "OK" {
+				t.Error("wrong content")
+			}
+
+			if wantErr == 1 && renamed != 1 {
+				t.Errorf("rename should be attempted once: %d", renamed)
+			}
+		}
+	}
+
+	t.Run("with same device", compare(0))
+	t.Run("with cross device", compare(1))
+	t.Run("with rename error", compare(2))
+}
+
+func TestDownloadLatestUpdate(t *testing.T) {
 	t.Parallel()
 
 	log.SetOutput(ioutil.Discard)
@@ -220,15 +463,12 @@ func TestDownloadUrlAndVersion(t *testing.T) {
 			t.Parallel()
 
 			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-				xml := `<?xml version='1.0' encoding='UTF-8'?>
-<gupdate xmlns='http://www.google.com/update2/response' protocol='2.0'>
-  <app appid='tld.domain.sub.app.name'>
-    <updatecheck codebase='https://sub.domain.tld/app.download.all' version='1.0.0' />
-  </app>
-</gupdate`
+				xml := updatesXml(`
+    <updatecheck codebase='https://sub.domain.tld/app.download.all' hash_sha256='abc' version='1.0.0' />
+  `)
 
-				if wantErr != 1 {
-					xml += ">"
+				if wantErr == 1 {
+					xml = strings.TrimSuffix(xml, ">")
 				}
 
 				_, _ = rw.Write([]byte(xml))
@@ -240,8 +480,9 @@ func TestDownloadUrlAndVersion(t *testing.T) {
 				h.AppName = "tld.domain.sub.app.name"
 			}
 
-			url, version, err := h.getDownloadUrlAndVersion()
-			got := &H{"err": err, "url": url, "version": version}
+			update, err := h.getLatestUpdate()
+			got := &H{"err": err, "hash": update.getHash(), "url": update.getUrl(),
+				"version": update.getVersion()}
 
 			if diff := cmp.Diff(want, got); diff != "" {
 				t.Errorf("mismatch (-want +got):\n%s", diff)
@@ -249,9 +490,707 @@ func TestDownloadUrlAndVersion(t *testing.T) {
 		}
 	}
 
-	t.Run("with valid response", compare(0, &H{"err": nil,
+	t.Run("with valid response", compare(0, &H{"err": nil, "hash": "abc",
 		"url": "https://sub.domain.tld/app.download.all", "version": "1.0.0"}))
-	t.Run("with xml decoder error", compare(1, &H{
-		"err": &xml.SyntaxError{Line: 6, Msg: "unexpected EOF"}, "url": "", "version": ""}))
-	t.Run("with AppName mismatch", compare(2, &H{"err": nil, "url": "", "version": ""}))
+	t.Run("with xml decoder error", compare(1, &H{"err": &xml.SyntaxError{Line: 6,
+		Msg: "unexpected EOF"}, "hash": "", "url": "", "version": ""}))
+	t.Run("with AppName mismatch", compare(2, &H{"err": nil, "hash": "", "url": "",
+		"version": ""}))
+}
+
+func TestDownloadFetchUpdateManifest(t *testing.T) {
+	t.Parallel()
+
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(wantErr bool, body string, want *H) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_, _ = rw.Write([]byte(body))
+			}))
+			defer server.Close()
+
+			// The installed version must not matter.
+			h := &Host{UpdateUrl: server.URL, Version: "9.9.9"}
+
+			manifest, err := h.FetchUpdateManifest()
+			if !wantErr && err != nil {
+				t.Fatalf("fetch error: %v", err)
+			} else if wantErr {
+				if err == nil || manifest != nil {
+					t.Fatalf("want error only (got: %+v)", manifest)
+				}
+				return
+			}
+
+			got := &H{}
+			for _, app := range manifest.Apps {
+				versions := []string{}
+				for _, update := range app.Updates {
+					versions = append(versions, update.getChannel()+":"+update.getVersion())
+				}
+				(*got)[app.getAppId()] = versions
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with known manifest", compare(false, `<?xml version='1.0' encoding='UTF-8'?>
+<gupdate xmlns='http://www.google.com/update2/response' protocol='2.0'>
+  <app appid='tld.domain.sub.app.name'>
+    <updatecheck codebase='https://sub.domain.tld/app' version='1.0.0' />
+    <updatecheck channel='beta' codebase='https://sub.domain.tld/app.beta' version='1.1.0' />
+  </app>
+  <app appid='tld.domain.sub.other'>
+    <updatecheck codebase='https://sub.domain.tld/other' version='2.0.0' />
+  </app>
+</gupdate>`, &H{"tld.domain.sub.app.name": []string{":1.0.0", "beta:1.1.0"},
+		"tld.domain.sub.other": []string{":2.0.0"}}))
+	t.Run("with xml decoder error", compare(true, `<gupdate>`, nil))
+}
+
+func TestDownloadFetchUpdateManifestGzip(t *testing.T) {
+	t.Parallel()
+
+	log.SetOutput(ioutil.Discard)
+
+	manifest := updatesXml(`
+    <updatecheck codebase='https://sub.domain.tld/app' version='1.0.0' />
+  `)
+
+	compressed := &bytes.Buffer{}
+	zw := gzip.NewWriter(compressed)
+	_, _ = zw.Write([]byte(manifest))
+	_ = zw.Close()
+
+	compare := func(name string, body []byte, httpClient *http.Client, wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("If-None-Match") == `"v1"` {
+					rw.WriteHeader(http.StatusNotModified)
+					return
+				}
+
+				if req.Header.Get("Accept-Encoding") != "gzip" {
+					t.Errorf("Accept-Encoding mismatch (want: gzip, got: %q)", req.Header.Get("Accept-Encoding"))
+				}
+
+				rw.Header().Set("Content-Encoding", "gzip")
+				rw.Header().Set("ETag", `"v1"`)
+				_, _ = rw.Write(body)
+			}))
+			defer server.Close()
+
+			h := &Host{AppName: "tld.domain.sub.app.name", ExecName: "testdata/gzip-" + name,
+				HttpClient: httpClient, UpdateUrl: server.URL}
+			defer func() { os.Remove(h.getStateName(".cache")) }()
+
+			// The second fetch reuses the decompressed cache on 304 Not Modified.
+			for _, fetch := range []string{"fetch", "cached fetch"} {
+				got, err := h.FetchUpdateManifest()
+				if !wantErr && err != nil {
+					t.Fatalf("%s error: %v", fetch, err)
+				} else if wantErr {
+					if err == nil {
+						t.Fatalf("want %s error", fetch)
+					}
+					return
+				}
+
+				if version := got.GetChannelUpdate(h.AppName, "").getVersion(); version != "1.0.0" {
+					t.Errorf("%s version mismatch (want: 1.0.0, got: %s)", fetch, version)
+				}
+			}
+		}
+	}
+
+	t.Run("with gzip encoding", compare("default", compressed.Bytes(), nil, false))
+	t.Run("with custom HttpClient", compare("client", compressed.Bytes(),
+		&http.Client{Transport: &http.Transport{DisableCompression: true}}, false))
+	t.Run("with corrupted gzip", compare("corrupted", []byte(manifest), nil, true))
+}
+
+func TestDownloadUnreachable(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	defer client.SetRetry(client.Retry{})
+	client.SetRetry(client.Retry{MaxAttempts: 1})
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	url := server.URL
+	server.Close()
+
+	targetName := "testdata/unreachable"
+	if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+		t.Fatalf("touch file error: %v", err)
+	}
+	defer func() { os.Remove(targetName) }()
+
+	h := &Host{ExecName: targetName, UpdateUrl: url}
+
+	if err := h.downloadLatest(url, "", ""); err == nil {
+		t.Error("missing download error")
+	}
+
+	if buf, err := ioutil.ReadFile(targetName); err != nil || string(buf) != "OLD" {
+		t.Errorf("executable is changed: %s %v", buf, err)
+	}
+
+	if update, err := h.getLatestUpdate(); err == nil || update.getUrl() != "" {
+		t.Errorf("missing update check error: %v", err)
+	}
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	t.Parallel()
+
+	compare := func(want, timeout time.Duration) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			h := &Host{DownloadTimeout: timeout}
+			if got := h.getDownloadTimeout(); got != want {
+				t.Errorf("mismatch (want: %s, got: %s)", want, got)
+			}
+		}
+	}
+
+	t.Run("with default timeout", compare(DownloadOverallTimeout*time.Second, 0))
+	t.Run("with negative timeout", compare(DownloadOverallTimeout*time.Second, -time.Second))
+	t.Run("with custom timeout", compare(30*time.Minute, 30*time.Minute))
+}
+
+type deadlineTransport struct {
+	stubTransport
+	deadlines []time.Duration
+}
+
+func (d *deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if deadline, ok := req.Context().Deadline(); ok {
+		d.deadlines = append(d.deadlines, time.Until(deadline))
+	}
+	return d.stubTransport.RoundTrip(req)
+}
+
+func TestDownloadSeparateDeadlines(t *testing.T) {
+	t.Parallel()
+
+	compare := func(name string, timeout, want time.Duration) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			execName := "testdata/deadline-" + name
+			defer func() {
+				os.Remove(execName + ".cache")
+				os.Remove(execName + ".part")
+				os.Remove(execName + ".part.url")
+			}()
+
+			transport := &deadlineTransport{stubTransport: stubTransport{body: "content"}}
+			h := &Host{DownloadTimeout: timeout, ExecName: execName,
+				HttpClient: &http.Client{Transport: transport}, UpdateUrl: "https://sub.domain.tld/updates.xml"}
+
+			// The stub body isn't a valid updates.xml, only its deadline matters.
+			_, _ = h.getLatestUpdate()
+			if _, err := h.downloadPart("https://sub.domain.tld/app", ""); err != nil {
+				t.Fatalf("download error: %v", err)
+			}
+
+			if len(transport.deadlines) != 2 {
+				t.Fatalf("deadline count mismatch (want: 2, got: %d)", len(transport.deadlines))
+			}
+
+			// Allow some slack for the time spent between request and record.
+			for i, limit := range []time.Duration{HttpOverallTimeout * time.Second, want} {
+				if got := transport.deadlines[i]; got > limit || got < limit-5*time.Second {
+					t.Errorf("deadline %d mismatch (want: %s, got: %s)", i, limit, got)
+				}
+			}
+		}
+	}
+
+	t.Run("with default download timeout", compare("default", 0, DownloadOverallTimeout*time.Second))
+	t.Run("with custom download timeout", compare("custom", 30*time.Minute, 30*time.Minute))
+}
+
+func TestDownloadLatestTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	defer client.SetRetry(client.Retry{})
+	client.SetRetry(client.Retry{MaxAttempts: 1})
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = rw.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	targetName := "testdata/timeout"
+	if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+		t.Fatalf("touch file error: %v", err)
+	}
+	defer func() { os.Remove(targetName) }()
+
+	h := &Host{DownloadTimeout: 10 * time.Millisecond, ExecName: targetName}
+	if err := h.downloadLatest(server.URL, "", ""); err == nil {
+		t.Error("missing timeout error")
+	}
+
+	if buf, err := ioutil.ReadFile(targetName); err != nil || string(buf) != "OLD" {
+		t.Errorf("executable is changed: %s %v", buf, err)
+	}
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	// In-place replacement is enough to verify the headers.
+	oldRuntimeGOOS := runtimeGOOS
+	defer func() { runtimeGOOS = oldRuntimeGOOS }()
+	runtimeGOOS = "linux"
+
+	compare := func(want, wantDownload, headers http.Header, otherHost bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			got := []http.Header{}
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = append(got, req.Header)
+				_, _ = rw.Write([]byte(`<?xml version='1.0' encoding='UTF-8'?>
+<gupdate xmlns='http://www.google.com/update2/response' protocol='2.0'></gupdate>`))
+			}))
+			defer server.Close()
+
+			downloadUrl := server.URL
+			if otherHost {
+				download := httptest.NewServer(server.Config.Handler)
+				defer download.Close()
+				downloadUrl = download.URL
+			}
+
+			targetName := "testdata/headers"
+			if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+			defer func() { os.Remove(targetName) }()
+
+			h := &Host{
+				AppName:   "tld.domain.sub.app.name",
+				ExecName:  targetName,
+				Headers:   headers,
+				UpdateUrl: server.URL,
+				Version:   "1.0.0",
+			}
+
+			if _, err := h.getLatestUpdate(); err != nil {
+				t.Fatalf("update check error: %v", err)
+			}
+
+			if err := h.downloadLatest(downloadUrl, "", ""); err != nil {
+				t.Fatalf("download error: %v", err)
+			}
+
+			if len(got) != 2 {
+				t.Fatalf("request count mismatch: %d", len(got))
+			}
+
+			for i, want := range []http.Header{want, wantDownload} {
+				for key := range want {
+					if got[i].Get(key) != want.Get(key) {
+						t.Errorf("%s mismatch (want: %q, got: %q)", key, want.Get(key), got[i].Get(key))
+					}
+				}
+			}
+		}
+	}
+
+	agent := http.Header{"User-Agent": {"tld.domain.sub.app.name/1.0.0 " + UserAgent}}
+	custom := http.Header{"Authorization": {"Bearer token"}, "User-Agent": {"custom/2.0"}}
+
+	t.Run("with default User-Agent", compare(agent, agent, nil, false))
+	t.Run("with custom headers", compare(custom, custom, http.Header{"authorization": {"Bearer token"},
+		"User-Agent": {"custom/2.0"}}, false))
+	t.Run("with download on other host", compare(custom, http.Header{"Authorization": {""}},
+		http.Header{"authorization": {"Bearer token"}, "User-Agent": {"custom/2.0"}}, true))
+}
+
+func TestDownloadCloseIdleConnections(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var mu sync.Mutex
+	open := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("NEW"))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch state {
+		case http.StateNew:
+			open++
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	execName := "testdata/idle"
+	defer func() {
+		os.Remove(execName + ".part")
+		os.Remove(execName + ".part.url")
+	}()
+
+	h := &Host{ExecName: execName, Headers: http.Header{"X-Api-Key": {"secret"}}, UpdateUrl: server.URL}
+	if _, err := h.downloadPart(server.URL, ""); err != nil {
+		t.Fatalf("download error: %v", err)
+	}
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return open
+	}
+
+	// The one-off client doesn't keep its connection open.
+	for deadline := time.Now().Add(5 * time.Second); count() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection is left open: %d", count())
+		}
+	}
+}
+
+// stubTransport is a http.RoundTripper that serves given body without network.
+type stubTransport struct {
+	body     string
+	length   int64
+	requests []string
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.requests = append(s.requests, req.URL.String())
+
+	// Unknown length by default.
+	length := int64(-1)
+	if s.length != 0 {
+		length = s.length
+	}
+
+	return &http.Response{
+		Body:          ioutil.NopCloser(bytes.NewBufferString(s.body)),
+		ContentLength: length,
+		Header:        http.Header{},
+		Request:       req,
+		StatusCode:    http.StatusOK,
+	}, nil
+}
+
+func TestDownloadHttpClient(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	oldRuntimeGOOS := runtimeGOOS
+	defer func() { runtimeGOOS = oldRuntimeGOOS }()
+	runtimeGOOS = "linux"
+
+	targetName := "testdata/http-client"
+	if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+		t.Fatalf("touch file error: %v", err)
+	}
+	defer func() { os.Remove(targetName) }()
+
+	transport := &stubTransport{body: "NEW"}
+	h := &Host{ExecName: targetName, HttpClient: &http.Client{Transport: transport}}
+
+	if got := h.newClient(time.Second); got != h.HttpClient {
+		t.Errorf("client mismatch (want: %p, got: %p)", h.HttpClient, got)
+	}
+
+	// The host is unreachable without the stub client.
+	url := "http://update.invalid/app"
+	if err := h.downloadLatest(url, "", ""); err != nil {
+		t.Fatalf("download error: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{url}, transport.requests); diff != "" {
+		t.Errorf("requests mismatch (-want +got):\n%s", diff)
+	}
+
+	if got, _ := ioutil.ReadFile(targetName); string(got) != "NEW" {
+		t.Errorf("content mismatch (want: NEW, got: %s)", got)
+	}
+}
+
+func TestDownloadBackupSuffix(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	oldRunExecutable := runExecutable
+	oldRuntimeGOOS := runtimeGOOS
+	defer func() {
+		runExecutable = oldRunExecutable
+		runtimeGOOS = oldRuntimeGOOS
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("NEW"))
+	}))
+	targetName := "testdata/backup-suffix"
+
+	defer func() {
+		os.Remove(targetName)
+		os.Remove(targetName + ".bak")
+		os.Remove(targetName + ".old")
+		server.Close()
+	}()
+
+	// Capture the backup while the new executable is being verified.
+	backup := map[string]string{}
+	runtimeGOOS = "linux"
+	runExecutable = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		for _, ext := range []string{".bak", ".old"} {
+			if content, err := ioutil.ReadFile(targetName + ext); err == nil {
+				backup[ext] = string(content)
+			}
+		}
+		return []byte("app 1.0.1\n"), nil
+	}
+
+	if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+		t.Fatalf("touch file error: %v", err)
+	}
+
+	h := &Host{BackupSuffix: ".old", ExecName: targetName, VerifyArgs: []string{"--version"}}
+	if err := h.downloadLatest(server.URL, "", "1.0.1"); err != nil {
+		t.Fatalf("download error: %v", err)
+	}
+
+	if diff := cmp.Diff(map[string]string{".old": "OLD"}, backup); diff != "" {
+		t.Errorf("backup mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := os.Stat(targetName + ".old"); !os.IsNotExist(err) {
+		t.Errorf("backup is left behind: %v", err)
+	}
+}
+
+func TestDownloadVerifyExecutable(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	oldRunExecutable := runExecutable
+	oldRuntimeGOOS := runtimeGOOS
+	defer func() {
+		runExecutable = oldRunExecutable
+		runtimeGOOS = oldRuntimeGOOS
+	}()
+
+	compare := func(goos, output string, runErr error, marker string, wantErr bool, want *H) func(t *testing.T) {
+		return func(t *testing.T) {
+			runtimeGOOS = goos
+			var ran []string
+			runExecutable = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+				content, _ := ioutil.ReadFile(name)
+				ran = append([]string{string(content)}, args...)
+				return []byte(output), runErr
+			}
+
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_, _ = rw.Write([]byte("NEW"))
+			}))
+			targetName := fmt.Sprintf("testdata/verify-%s-%t", goos, wantErr)
+
+			defer func() {
+				os.Remove(targetName)
+				os.Remove(targetName + ".bak")
+				os.Remove(targetName + ".new")
+				server.Close()
+			}()
+
+			if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+
+			h := &Host{ExecName: targetName, VerifyArgs: []string{"--version"}, VerifyMarker: marker}
+			if err := h.downloadLatest(server.URL, "", "1.0.1"); !wantErr && err != nil {
+				t.Fatalf("download error: %v", err)
+			} else if wantErr && err == nil {
+				t.Fatal("want error")
+			}
+
+			current, _ := ioutil.ReadFile(targetName)
+			_, bakErr := os.Stat(targetName + ".bak")
+			_, newErr := os.Stat(targetName + ".new")
+			got := &H{"current": string(current), "ran": ran, "leftover": bakErr == nil || newErr == nil}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	ran := []string{"NEW", "--version"}
+
+	t.Run("with matching version", compare("linux", "app 1.0.1\n", nil, "", false,
+		&H{"current": "NEW", "ran": ran, "leftover": false}))
+	t.Run("with matching marker", compare("linux", "app OK\n", nil, "OK", false,
+		&H{"current": "NEW", "ran": ran, "leftover": false}))
+	t.Run("with mismatching version", compare("linux", "app 1.0.0\n", nil, "", true,
+		&H{"current": "OLD", "ran": ran, "leftover": false}))
+	t.Run("with run error", compare("linux", "", errors.New("exec format error"), "", true,
+		&H{"current": "OLD", "ran": ran, "leftover": false}))
+	t.Run("with matching version on Windows", compare("windows", "app 1.0.1\n", nil, "", false,
+		&H{"current": "NEW", "ran": ran, "leftover": false}))
+	t.Run("with run error on Windows", compare("windows", "", errors.New("bad image"), "", true,
+		&H{"current": "OLD", "ran": ran, "leftover": false}))
+}
+
+func TestDownloadResume(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	// In-place replacement is enough to verify the resumption.
+	oldRuntimeGOOS := runtimeGOOS
+	defer func() { runtimeGOOS = oldRuntimeGOOS }()
+	runtimeGOOS = "linux"
+
+	compare := func(name string, status int, contentRange string, validators []string, wantErr bool,
+		want *H) func(t *testing.T) {
+		return func(t *testing.T) {
+			ranges := []string{}
+			ifRanges := []string{}
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				ranges = append(ranges, req.Header.Get("Range"))
+				ifRanges = append(ifRanges, req.Header.Get("If-Range"))
+				if validator := validators[len(ranges)-1]; validator != "" {
+					rw.Header().Set("ETag", validator)
+				}
+				if len(ranges) == 1 {
+					// Interrupt the transfer halfway.
+					rw.Header().Set("Content-Length", "6")
+					_, _ = rw.Write([]byte("NEW"))
+					rw.(http.Flusher).Flush()
+					return
+				}
+				if status == http.StatusPartialContent && req.Header.Get("Range") != "" {
+					rw.Header().Set("Content-Range", contentRange)
+					rw.WriteHeader(status)
+					_, _ = rw.Write([]byte("ABC"))
+					return
+				}
+				_, _ = rw.Write([]byte("NEWABC"))
+			}))
+			targetName := "testdata/resume-" + name
+
+			defer func() {
+				os.Remove(targetName)
+				os.Remove(targetName + ".bak")
+				os.Remove(targetName + ".part")
+				os.Remove(targetName + ".part.url")
+				server.Close()
+			}()
+
+			if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+
+			h := &Host{ExecName: targetName}
+			if err := h.downloadLatest(server.URL, "", ""); err == nil {
+				t.Fatal("missing interrupted download error")
+			}
+
+			if buf, err := ioutil.ReadFile(targetName + ".part"); err != nil || string(buf) != "NEW" {
+				t.Fatalf("partial download mismatch: %s %v", buf, err)
+			}
+
+			if err := h.downloadLatest(server.URL, "", ""); !wantErr && err != nil {
+				t.Fatalf("download error: %v", err)
+			} else if wantErr && err == nil {
+				t.Fatal("want error")
+			}
+
+			current, _ := ioutil.ReadFile(targetName)
+			_, partErr := os.Stat(targetName + ".part")
+			_, urlErr := os.Stat(targetName + ".part.url")
+			got := &H{"current": string(current), "ranges": ranges, "ifRanges": ifRanges,
+				"leftover": partErr == nil || urlErr == nil}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	ranges := []string{"", "bytes=3-"}
+	ifRanges := []string{"", `"v1"`}
+	same := []string{`"v1"`, `"v1"`}
+
+	t.Run("with partial content", compare("partial", http.StatusPartialContent, "bytes 3-5/6", same, false,
+		&H{"current": "NEWABC", "ranges": ranges, "ifRanges": ifRanges, "leftover": false}))
+	t.Run("with ignored range", compare("ignored", http.StatusOK, "", same, false,
+		&H{"current": "NEWABC", "ranges": ranges, "ifRanges": ifRanges, "leftover": false}))
+	// The server replies the whole new content when If-Range doesn't match.
+	t.Run("with changed content", compare("changed", http.StatusOK, "", []string{`"v1"`, `"v2"`}, false,
+		&H{"current": "NEWABC", "ranges": ranges, "ifRanges": ifRanges, "leftover": false}))
+	t.Run("with weak validator", compare("weak", http.StatusPartialContent, "bytes 3-5/6",
+		[]string{`W/"v1"`, `W/"v1"`}, false,
+		&H{"current": "NEWABC", "ranges": []string{"", ""}, "ifRanges": []string{"", ""}, "leftover": false}))
+	t.Run("with no validator", compare("none", http.StatusPartialContent, "bytes 3-5/6", []string{"", ""}, false,
+		&H{"current": "NEWABC", "ranges": []string{"", ""}, "ifRanges": []string{"", ""}, "leftover": false}))
+	t.Run("with mismatching content range", compare("mismatch", http.StatusPartialContent, "bytes 0-5/6", same,
+		true, &H{"current": "OLD", "ranges": ranges, "ifRanges": ifRanges, "leftover": false}))
+}
+
+func TestDownloadContentLength(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	// In-place replacement is enough to verify the length.
+	oldRuntimeGOOS := runtimeGOOS
+	defer func() { runtimeGOOS = oldRuntimeGOOS }()
+	runtimeGOOS = "linux"
+
+	compare := func(name string, c *http.Client, wantErr bool, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				// Advertise a larger length than it sends.
+				rw.Header().Set("Content-Length", "6")
+				_, _ = rw.Write([]byte("NEW"))
+			}))
+			targetName := "testdata/length-" + name
+
+			defer func() {
+				os.Remove(targetName)
+				os.Remove(targetName + ".bak")
+				os.Remove(targetName + ".part")
+				os.Remove(targetName + ".part.url")
+				server.Close()
+			}()
+
+			if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+
+			h := &Host{ExecName: targetName, HttpClient: c}
+			if err := h.downloadLatest(server.URL, "", ""); !wantErr && err != nil {
+				t.Fatalf("download error: %v", err)
+			} else if wantErr && err == nil {
+				t.Fatal("want error")
+			}
+
+			if got, _ := ioutil.ReadFile(targetName); string(got) != want {
+				t.Errorf("content mismatch (want: %s, got: %s)", want, got)
+			}
+
+			if _, err := os.Stat(targetName + ".bak"); !os.IsNotExist(err) {
+				t.Errorf("backup is left behind: %v", err)
+			}
+		}
+	}
+
+	t.Run("with truncated response", compare("truncated", nil, true, "OLD"))
+	t.Run("with truncated body", compare("short",
+		&http.Client{Transport: &stubTransport{body: "NEW", length: 6}}, true, "OLD"))
+	t.Run("with complete body", compare("complete",
+		&http.Client{Transport: &stubTransport{body: "NEW", length: 3}}, false, "NEW"))
+	t.Run("with unknown length", compare("unknown",
+		&http.Client{Transport: &stubTransport{body: "NEW"}}, false, "NEW"))
 }
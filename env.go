@@ -0,0 +1,83 @@
+// env.go - Native messaging host config from environment variables.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// The environment variable names that FromEnv reads from.
+const (
+	EnvAllowedExts    = "NMH_ALLOWED_EXTS"
+	EnvAppDesc        = "NMH_APP_DESC"
+	EnvAppName        = "NMH_APP_NAME"
+	EnvAppType        = "NMH_APP_TYPE"
+	EnvUpdateInterval = "NMH_UPDATE_INTERVAL"
+	EnvUpdateUrl      = "NMH_UPDATE_URL"
+	EnvVersion        = "NMH_VERSION"
+)
+
+// FromEnv populates unset fields from environment variables and return the
+// Host pointer back. Explicit struct values always take precedence over
+// environment variables. It should be called before Init.
+//
+// * AllowedExts is read from NMH_ALLOWED_EXTS as comma-separated list.
+//
+// * AppDesc is read from NMH_APP_DESC.
+//
+// * AppName is read from NMH_APP_NAME.
+//
+// * AppType is read from NMH_APP_TYPE.
+//
+// * UpdateInterval is read from NMH_UPDATE_INTERVAL in time.ParseDuration
+// format, e.g. "1h30m".
+//
+// * UpdateUrl is read from NMH_UPDATE_URL.
+//
+// * Version is read from NMH_VERSION.
+//
+//   messaging := (&host.Host{}).FromEnv().Init()
+func (h *Host) FromEnv() *Host {
+	if h.AllowedExts == nil {
+		if value := os.Getenv(EnvAllowedExts); value != "" {
+			for _, ext := range strings.Split(value, ",") {
+				if ext = strings.TrimSpace(ext); ext != "" {
+					h.AllowedExts = append(h.AllowedExts, ext)
+				}
+			}
+		}
+	}
+
+	if h.AppDesc == "" {
+		h.AppDesc = os.Getenv(EnvAppDesc)
+	}
+
+	if h.AppName == "" {
+		h.AppName = os.Getenv(EnvAppName)
+	}
+
+	if h.AppType == "" {
+		h.AppType = os.Getenv(EnvAppType)
+	}
+
+	if h.UpdateInterval == 0 {
+		h.UpdateInterval, _ = time.ParseDuration(os.Getenv(EnvUpdateInterval))
+	}
+
+	if h.UpdateUrl == "" {
+		h.UpdateUrl = os.Getenv(EnvUpdateUrl)
+	}
+
+	if h.Version == "" {
+		h.Version = os.Getenv(EnvVersion)
+	}
+
+	return h
+}
@@ -0,0 +1,69 @@
+// env_test.go - Test for native messaging host config from environment.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEnvFromEnv(t *testing.T) {
+	env := map[string]string{
+		EnvAllowedExts:    "chrome-extension://XXX/, chrome-extension://YYY/,",
+		EnvAppDesc:        "Description of my app",
+		EnvAppName:        "my.app.name",
+		EnvAppType:        "stdio",
+		EnvUpdateInterval: "1h",
+		EnvUpdateUrl:      "https://sub.domain.tld/updates.xml",
+		EnvVersion:        "1.0.0",
+	}
+
+	compare := func(got *Host, want *Host) func(t *testing.T) {
+		return func(t *testing.T) {
+			for key, value := range env {
+				os.Setenv(key, value)
+			}
+			defer func() {
+				for key := range env {
+					os.Unsetenv(key)
+				}
+			}()
+
+			if diff := cmp.Diff(want, got.FromEnv()); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with nothing set", compare(&Host{}, &Host{
+		AllowedExts:    []string{"chrome-extension://XXX/", "chrome-extension://YYY/"},
+		AppDesc:        "Description of my app",
+		AppName:        "my.app.name",
+		AppType:        "stdio",
+		UpdateInterval: time.Hour,
+		UpdateUrl:      "https://sub.domain.tld/updates.xml",
+		Version:        "1.0.0",
+	}))
+
+	t.Run("with explicit values", compare(&Host{
+		AllowedExts:    []string{"chrome-extension://ZZZ/"},
+		AppName:        "other.app.name",
+		UpdateInterval: time.Minute,
+		Version:        "2.0.0",
+	}, &Host{
+		AllowedExts:    []string{"chrome-extension://ZZZ/"},
+		AppDesc:        "Description of my app",
+		AppName:        "other.app.name",
+		AppType:        "stdio",
+		UpdateInterval: time.Minute,
+		UpdateUrl:      "https://sub.domain.tld/updates.xml",
+		Version:        "2.0.0",
+	}))
+}
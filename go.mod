@@ -5,5 +5,7 @@ go 1.15
 require (
 	github.com/google/go-cmp v0.5.9
 	github.com/hashicorp/go-version v1.6.0
+	github.com/klauspost/compress v1.15.15
+	github.com/ulikunitz/xz v0.5.11
 	golang.org/x/sys v0.5.0
 )
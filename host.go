@@ -61,8 +61,10 @@
 //
 //   ...
 //
-//   // When you need to uninstall.
-//   host.Uninstall()
+//   // When you need to uninstall. It will exit gracefully on success.
+//   if err := messaging.Uninstall(); err != nil {
+//     log.Printf("uninstall error: %v", err)
+//   }
 //
 // * Auto Update Configuration
 //
@@ -84,7 +86,7 @@
 //     </app>
 //   </gupdate>
 //
-//   // It will do daily update check.
+//   // It will do daily update check, unless UpdateInterval is set.
 //   messaging := (&host.Host{
 //     AppName:   "tld.domain.sub.app.name",
 //     UpdateUrl: "https://sub.domain.tld/updates.xml", // It follows [update manifest][2]
@@ -93,48 +95,248 @@
 package host
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
+	"unsafe"
 )
 
+// ErrEmptyMessage is returned by the message reads when the message header
+// declares zero length, i.e.: a keep-alive probe that has nothing to process.
+var ErrEmptyMessage = errors.New("message is empty")
+
+// ErrMessageTooLarge is returned by PostMessage and PostRaw when the message
+// length doesn't fit into the 32-bit message header.
+var ErrMessageTooLarge = errors.New("message exceeds 32-bit length header")
+
+// bufferPool is a pool of reusable message buffers.
+var bufferPool = sync.Pool{New: func() interface{} { return newMessageBuffer() }}
+
+// headerPool is a pool of reusable message headers.
+var headerPool = sync.Pool{New: func() interface{} { return new([4]byte) }}
+
+// debugReadBuildInfo is a shortcut to debug.ReadBuildInfo. It helps write
+// testable code.
+var debugReadBuildInfo = debug.ReadBuildInfo
+
+// ioutilTempFile is a shortcut to ioutil.TempFile. It helps write testable code.
+var ioutilTempFile = ioutil.TempFile
+
 // ioutilWriteFile is a shortcut to ioutil.WriteFile. It helps write testable code.
 var ioutilWriteFile = ioutil.WriteFile
 
+// nativeByteOrder is the byte order of current platform.
+var nativeByteOrder = getNativeByteOrder()
+
 // osMkdirAll is a shortcut to os.MkdirAll. It helps write testable code.
 var osMkdirAll = os.MkdirAll
 
+// osRemove is a shortcut to os.Remove. It helps write testable code.
+var osRemove = os.Remove
+
 // runtimeGoexit is a shortcut to runtime.Goexit. It helps write testable code.
 var runtimeGoexit = runtime.Goexit
 
+// messageBuffer is a reusable message buffer along with its JSON encoder.
+type messageBuffer struct {
+	bytes.Buffer
+	encoder *json.Encoder
+}
+
 // H is a map[string]interface{} type shortcut and represents a dynamic
 // key-value-pair data.
 type H map[string]interface{}
 
 // Host represents a single native messaging host, where all native messaging
 // host operations can be done.
+//
+// Codec is a message body encoding, JSON is used when it is nil.
+//
+// Logger is a diagnostic output, the standard logger is used when it is nil.
+//
+// HttpClient is used on every update related request, a client with configured
+// Headers and timeout is used when it is nil.
+//
+// In and Out are the message streams of Receive and Send, os.Stdin and
+// os.Stdout are used when they are nil.
+//
+// Browser selects the manifest target browser, Chrome is used by default.
+//
+// Scope selects the manifest install location, AutoScope is used by default.
+//
+// RelativeExec writes the manifest path relative to the manifest folder on
+// Install instead of ExecName as-is, i.e.: for a relocatable install. Chrome
+// resolves a relative path on Windows only, where ExecName must be on the same
+// volume as the manifest, so Install returns ErrRelativeExec on other
+// platforms.
+//
+// KeepState keeps the update check timestamp and the backup on Uninstall, i.e.:
+// for an upgrade-style reinstall that remembers the last update check.
+//
+// StrictDecode rejects incoming JSON message with unknown fields of the decoded
+// struct, it doesn't apply to a custom Codec.
+//
+// ValidateMessage is an optional hook that is called with every decoded
+// incoming message, its error is returned as the read error.
+//
+// Extra holds additional manifest keys, i.e.: browser-specific keys, they can't
+// override the canonical keys.
+//
+// OnInstall and OnUninstall are optional hooks that receive affected paths and
+// are called only after the respective operation succeeds.
+//
+// OnUpdate and OnUpdateError are optional hooks that are called by
+// AutoUpdateCheck, the former receives previous and new version after the
+// update is downloaded, the latter receives the error it come across.
 type Host struct {
-	AppName     string           `json:"name"`
-	AppDesc     string           `json:"description"`
-	ExecName    string           `json:"path"`
-	AppType     string           `json:"type"`
-	AllowedExts []string         `json:"allowed_origins"`
-	AutoUpdate  bool             `json:"-"`
-	ByteOrder   binary.ByteOrder `json:"-"`
-	UpdateUrl   string           `json:"-"`
-	Version     string           `json:"-"`
+	AppName          string                  `json:"name"`
+	AppDesc          string                  `json:"description"`
+	ExecName         string                  `json:"path"`
+	AppType          string                  `json:"type"`
+	AllowedExts      []string                `json:"allowed_origins"`
+	AutoUpdate       bool                    `json:"-"`
+	BackupSuffix     string                  `json:"-"`
+	Browser          Browser                 `json:"-"`
+	ByteOrder        binary.ByteOrder        `json:"-"`
+	Channel          string                  `json:"-"`
+	CheckSuffix      string                  `json:"-"`
+	Codec            Codec                   `json:"-"`
+	DeferUpdate      bool                    `json:"-"`
+	DownloadTimeout  time.Duration           `json:"-"`
+	Extra            H                       `json:"-"`
+	Headers          http.Header             `json:"-"`
+	HttpClient       *http.Client            `json:"-"`
+	In               io.Reader               `json:"-"`
+	KeepState        bool                    `json:"-"`
+	Logger           Logger                  `json:"-"`
+	ManifestDirMode  os.FileMode             `json:"-"`
+	ManifestFileMode os.FileMode             `json:"-"`
+	OnInstall        func([]string)          `json:"-"`
+	OnUninstall      func([]string)          `json:"-"`
+	OnUpdate         func(string, string)    `json:"-"`
+	OnUpdateError    func(error)             `json:"-"`
+	Out              io.Writer               `json:"-"`
+	RelativeExec     bool                    `json:"-"`
+	Scope            Scope                   `json:"-"`
+	StateDir         string                  `json:"-"`
+	StrictDecode     bool                    `json:"-"`
+	UpdateInterval   time.Duration           `json:"-"`
+	UpdateUrl        string                  `json:"-"`
+	ValidateMessage  func(interface{}) error `json:"-"`
+	VerifyArgs       []string                `json:"-"`
+	VerifyMarker     string                  `json:"-"`
+	Version          string                  `json:"-"`
+}
+
+// DefaultAppName returns current executable file name without extension, if
+// any. It is the same name Init assigns when AppName is empty. It will return
+// error when it come across one.
+func DefaultAppName() (string, error) {
+	execName, err := getExecName()
+	if err != nil {
+		return "", err
+	}
+
+	return getAppName(execName), nil
+}
+
+// appendError returns given error appended with another error, if any.
+func appendError(err, other error) error {
+	if other == nil {
+		return err
+	}
+
+	if err == nil {
+		return other
+	}
+
+	return fmt.Errorf("%w %v", err, other)
+}
+
+// normalizeUpdateUrl returns given update URL without surrounding whitespace.
+// It will return error when it is not an absolute http or https URL.
+func normalizeUpdateUrl(rawUrl string) (string, error) {
+	rawUrl = strings.TrimSpace(rawUrl)
+
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl, fmt.Errorf("Invalid update URL %q: %w", rawUrl, err)
+	}
+
+	if !parsed.IsAbs() || parsed.Host == "" {
+		return rawUrl, fmt.Errorf("Invalid update URL %q: must be absolute", rawUrl)
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return rawUrl, fmt.Errorf("Invalid update URL %q: unsupported scheme %s", rawUrl, parsed.Scheme)
+	}
+
+	return rawUrl, nil
+}
+
+// getAppName returns given executable file name without extension, if any.
+func getAppName(execName string) string {
+	return strings.TrimSuffix(filepath.Base(execName), path.Ext(execName))
+}
+
+// getBuildVersion returns main module version from embedded build information,
+// if any. A development build has no version.
+func getBuildVersion() string {
+	info, ok := debugReadBuildInfo()
+	if !ok || info.Main.Version == "(devel)" {
+		return ""
+	}
+	return info.Main.Version
+}
+
+// getNativeByteOrder returns the byte order of current platform by looking at
+// the memory layout of a known unsigned integer.
+func getNativeByteOrder() binary.ByteOrder {
+	known := uint16(0x0102)
+	if (*[2]byte)(unsafe.Pointer(&known))[0] == 0x01 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// getExecName returns current executable's absolute path after the evaluation
+// of any symbolic links. It will return error when it come across one.
+func getExecName() (string, error) {
+	exec, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	evaled, err := filepath.EvalSymlinks(exec)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Abs(evaled)
 }
 
 // Init sets default value to its fields and return the Host pointer back.
 //
 // * AppName is an application name in manifest file and will be defaulted to
-// current executable file name without extension, if any.
+// current executable file name without extension, if any, normalized with
+// NormalizeAppName when possible.
 //
 // * AppDesc is an application description in manifest file and will be defaulted
 // to current AppName.
@@ -143,24 +345,69 @@ type Host struct {
 // defaulted to "stdio".
 //
 // * AutoUpdate indicates whether update check will be perform for this
-// application and will be defaulted to true only if UpdateUrl and application
-// Version are present, otherwise it will be false.
+// application and will be defaulted to true only if a valid UpdateUrl and
+// application Version are present, otherwise it will be false.
+//
+// * BackupSuffix and CheckSuffix are the state file suffixes of the previous
+// executable during an update and the update check timestamp, which are treated
+// as ".bak" and ".chk" when they are empty.
 //
 // * ByteOrder specifies how to convert byte sequences into unsigned integers and
-// will be defaulted to binary.LittleEndian.
+// will be defaulted to the native byte order of current platform.
+//
+// * Channel is an optional release channel to select from updates.xml, i.e.:
+// "beta". All updates are considered when it is empty or no update is on the
+// channel. The update that matches both OS and architecture is selected first,
+// then the one for the OS only, then the one for the architecture only, then the
+// untargeted one, and no update is selected otherwise.
 //
-// * ExecName is an executable path used across the module and will get assigned
+// * DeferUpdate indicates whether the update will be downloaded next to current
+// executable and applied by ApplyPendingUpdate on next start, instead of
+// replacing current executable right away.
+//
+// * DownloadTimeout is an overall timeout of the update download and will be
+// treated as DownloadOverallTimeout seconds when it is zero or negative. The
+// updates.xml request keeps HttpOverallTimeout seconds.
+//
+// * ExecName is an executable path used across the module and will be defaulted
 // to current executable's absolute path after the evaluation of any symbolic
 // links.
 //
+// * Headers are added to every update related request of UpdateUrl host, but
+// not to a download or redirect on other host. The User-Agent header will be
+// defaulted to AppName/Version followed by UserAgent when it is absent.
+//
+// * ManifestDirMode and ManifestFileMode are the modes of created manifest
+// folders and manifest file, which will be defaulted to 0755 and 0644. They are
+// ignored on Windows.
+//
+// * StateDir is a writable folder for update state files, i.e.: update check
+// timestamp, backup, and pending update. They will be located next to ExecName
+// when it is empty.
+//
+// * UpdateInterval is a minimum duration between update checks and will be
+// defaulted to DefaultUpdateInterval when it is zero or negative.
+//
+// * VerifyArgs are the arguments, i.e.: --version, to run the downloaded update
+// with before it is kept, the previous executable is restored when the run
+// fails or its output lacks VerifyMarker, which will be defaulted to the update
+// version. No run is performed when it is empty.
+//
+// * Version is current running version and will be defaulted to main module
+// version from build information, i.e.: go install module@v1.0.0, when it is
+// available.
+//
 //   messaging := (&host.Host{}).Init()
 func (h *Host) Init() *Host {
-	exec, _ := os.Executable()
-	evaled, _ := filepath.EvalSymlinks(exec)
-	h.ExecName, _ = filepath.Abs(evaled)
+	if h.ExecName == "" {
+		h.ExecName, _ = getExecName()
+	}
 
 	if h.AppName == "" {
-		h.AppName = strings.TrimSuffix(filepath.Base(h.ExecName), path.Ext(h.ExecName))
+		h.AppName = getAppName(h.ExecName)
+		if name, err := NormalizeAppName(h.AppName); err == nil {
+			h.AppName = name
+		}
 	}
 
 	if h.AppDesc == "" {
@@ -172,18 +419,100 @@ func (h *Host) Init() *Host {
 	}
 
 	if h.ByteOrder == nil {
-		h.ByteOrder = binary.LittleEndian
+		h.ByteOrder = nativeByteOrder
+	}
+
+	if h.UpdateInterval <= 0 {
+		h.UpdateInterval = DefaultUpdateInterval
+	}
+
+	if h.Version == "" {
+		h.Version = getBuildVersion()
 	}
 
 	if h.UpdateUrl != "" && h.Version != "" {
-		h.AutoUpdate = true
+		if err := h.validateUpdateUrl(); err != nil {
+			h.logger().Printf("Auto update is disabled: %v", err)
+		} else {
+			h.AutoUpdate = true
+		}
 	}
 
 	return h
 }
 
+// Validate verifies AppName follows the native messaging host name rule, then
+// trims surrounding whitespace from UpdateUrl and verifies it is an absolute
+// http or https URL when present. It will return error when it come across one.
+//
+// See https://developer.chrome.com/extensions/nativeMessaging#native-messaging-host
+func (h *Host) Validate() error {
+	return appendError(validateAppName(h.AppName), h.validateUpdateUrl())
+}
+
+// NormalizeAppName returns given name without surrounding whitespace and in
+// lowercase, which is the native messaging host name that the extension passes
+// to runtime.connectNative. It will return error explaining the violation when
+// it still doesn't follow the native messaging host name rule.
+//
+//   name, err := host.NormalizeAppName(" Tld.Domain.Sub.App_Name ")
+//   if err != nil {
+//     log.Fatalf("host.NormalizeAppName error: %v", err)
+//   }
+//
+//   // tld.domain.sub.app_name
+//   log.Printf("name: %s", name)
+//
+// See https://developer.chrome.com/extensions/nativeMessaging#native-messaging-host
+func NormalizeAppName(s string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	return name, validateAppName(name)
+}
+
+// validateAppName returns error explaining the violation when given name
+// doesn't follow the native messaging host name rule, which is lowercase
+// alphanumeric characters, underscores, and dots. It can't start or end with a
+// dot, and a dot can't be followed by another dot.
+func validateAppName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("Invalid AppName: empty, set it or call Init to default it")
+	case strings.HasPrefix(name, "."), strings.HasSuffix(name, "."):
+		return fmt.Errorf("Invalid AppName %q: can't start or end with a dot", name)
+	case strings.Contains(name, ".."):
+		return fmt.Errorf("Invalid AppName %q: can't have consecutive dots", name)
+	}
+
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' && r != '.' {
+			return fmt.Errorf("Invalid AppName %q: character %q isn't allowed, only "+
+				"lowercase alphanumeric characters, underscores, and dots are", name, r)
+		}
+	}
+
+	return nil
+}
+
+// validateUpdateUrl trims surrounding whitespace from UpdateUrl and verifies it
+// is an absolute http or https URL when present. It will return error when it
+// come across one.
+func (h *Host) validateUpdateUrl() error {
+	if h.UpdateUrl == "" {
+		return nil
+	}
+
+	normalized, err := normalizeUpdateUrl(h.UpdateUrl)
+	h.UpdateUrl = normalized
+	return err
+}
+
 // OnMessage reads message header and message body from given reader and
-// unmarshal to given struct. It will return error when it come across one.
+// unmarshal to given struct with configured Codec. It will return
+// ErrEmptyMessage on zero length message, which can be skipped, or error when
+// it come across one.
+//
+// The reads are unbuffered, so nothing is read past the message. Use NewConn
+// for buffered reads of a long-lived session.
 //
 //   // Ensure func main returned after calling runtime.Goexit
 //   // See https://golang.org/pkg/runtime/#Goexit.
@@ -195,30 +524,179 @@ func (h *Host) Init() *Host {
 //   request := &host.H{}
 //
 //   // Read message from os.Stdin to request.
-//   if err := messaging.OnMessage(os.Stdin, request); err != nil {
+//   if err := messaging.OnMessage(os.Stdin, request); errors.Is(err, host.ErrEmptyMessage) {
+//     // Nothing to process.
+//   } else if err != nil {
 //     log.Fatalf("messaging.OnMessage error: %v", err)
 //   }
 //
 //   // Log request.
 //   log.Printf("request: %+v", request)
 func (h *Host) OnMessage(reader io.Reader, v interface{}) error {
+	n, err := h.OnMessageN(reader, v)
+	if err == nil && n == 0 {
+		return ErrEmptyMessage
+	}
+	return err
+}
+
+// OnMessageN is the same as OnMessage, except it also returns the message body
+// length declared in the message header, where zero is an empty message. It
+// will return error when it come across one.
+//
+//   messaging := (&host.Host{}).Init()
+//   request := &host.H{}
+//
+//   n, err := messaging.OnMessageN(os.Stdin, request)
+//   if err != nil {
+//     log.Fatalf("messaging.OnMessageN error: %v", err)
+//   }
+//
+//   log.Printf("request of %d bytes: %+v", n, request)
+func (h *Host) OnMessageN(reader io.Reader, v interface{}) (int, error) {
 	length, err := h.readHeader(reader)
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	// An empty message is reported by its zero length instead.
+	if length == 0 {
+		return 0, nil
+	}
+
+	return int(length), h.readBody(reader, length, v)
+}
+
+// OnMessages reads up to given max messages, where less than one is treated as
+// one, and returns their raw message bodies to be unmarshaled individually. It
+// blocks for the first message only, the following messages are read as long as
+// they are entirely buffered by given *bufio.Reader, which should be reused
+// across calls. A partial trailing message is left in the buffer. It will
+// return the messages read so far with ErrEmptyMessage on zero length message,
+// or error when it come across one.
+//
+//   messaging := (&host.Host{}).Init()
+//   reader := bufio.NewReader(os.Stdin)
+//
+//   for {
+//     messages, err := messaging.OnMessages(reader, 10)
+//     if err != nil && !errors.Is(err, host.ErrEmptyMessage) {
+//       log.Fatalf("messaging.OnMessages error: %v", err)
+//     }
+//
+//     for _, message := range messages {
+//       request := &host.H{}
+//       if err := json.Unmarshal(message, request); err != nil {
+//         log.Printf("json.Unmarshal error: %v", err)
+//       }
+//     }
+//   }
+func (h *Host) OnMessages(reader io.Reader, max int) ([]json.RawMessage, error) {
+	messages := []json.RawMessage{}
+
+	for len(messages) == 0 || (len(messages) < max && h.isMessageBuffered(reader)) {
+		length, err := h.readHeader(reader)
+		if err != nil {
+			return messages, err
+		}
+
+		if length == 0 {
+			return messages, ErrEmptyMessage
+		}
+
+		body, err := readPayload(reader, length)
+		if err != nil {
+			return messages, err
+		}
+
+		messages = append(messages, body)
+	}
+
+	return messages, nil
+}
+
+// isMessageBuffered returns true if a whole message is buffered by given reader,
+// otherwise false. Only *bufio.Reader can tell without blocking.
+func (h *Host) isMessageBuffered(reader io.Reader) bool {
+	buffered, ok := reader.(*bufio.Reader)
+	if !ok || buffered.Buffered() < 4 {
+		return false
+	}
+
+	header, err := buffered.Peek(4)
+	if err != nil {
+		return false
+	}
+
+	return uint64(buffered.Buffered()) >= 4+uint64(h.ByteOrder.Uint32(header))
+}
+
+// readBody reads message body of given length and unmarshals it with configured
+// Codec into given struct. It will return ErrEmptyMessage on zero length, or
+// error when it come across one.
+func (h *Host) readBody(reader io.Reader, length uint32, v interface{}) error {
 	// Nothing to read.
 	if length == 0 {
-		return nil
+		return ErrEmptyMessage
+	}
+
+	if h.Codec != nil {
+		body, err := readPayload(reader, length)
+		if err != nil {
+			return err
+		}
+		if err := h.Codec.Unmarshal(body, v); err != nil {
+			return err
+		}
+		return h.validateMessage(v)
+	}
+
+	// Read message body, i.e.: into *json.RawMessage to defer the decoding.
+	body := io.LimitReader(reader, int64(length))
+	decoder := json.NewDecoder(body)
+	if h.StrictDecode {
+		decoder.DisallowUnknownFields()
 	}
+	err := decoder.Decode(v)
 
-	// Read message body.
-	if err := json.NewDecoder(io.LimitReader(reader, int64(length))).Decode(v); err != nil {
+	// Consume any trailing bytes, so the stream is positioned at next message.
+	if _, discardErr := io.Copy(ioutil.Discard, body); err == nil {
+		err = discardErr
+	}
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return h.validateMessage(v)
+}
+
+// readPayload reads message body of given length from given reader. The buffer
+// grows as the body arrives, so a malformed length header can't allocate up to
+// 4 GiB upfront. It will return io.ErrUnexpectedEOF on a short body, or error
+// when it come across one.
+func readPayload(reader io.Reader, length uint32) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+
+	n, err := io.Copy(buf, io.LimitReader(reader, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+
+	if n < int64(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return buf.Bytes(), nil
+}
+
+// validateMessage calls configured ValidateMessage hook on given decoded
+// message, if any. It will return error when it come across one.
+func (h *Host) validateMessage(v interface{}) error {
+	if h.ValidateMessage == nil {
+		return nil
+	}
+	return h.ValidateMessage(v)
 }
 
 // readHeader reads message header and will return the message length. It will
@@ -241,8 +719,9 @@ func (h *Host) readHeader(reader io.Reader) (uint32, error) {
 	return length, nil
 }
 
-// PostMessage marshals given struct and writes message header and message body
-// to given writer. It will return error when it come across one.
+// PostMessage marshals given struct with configured Codec and writes message
+// header and message body to given writer. It will return error when it come
+// across one.
 //
 //   messaging := (&host.Host{}).Init()
 //
@@ -257,32 +736,158 @@ func (h *Host) readHeader(reader io.Reader) (uint32, error) {
 //   // Log response.
 //   log.Printf("response: %+v", response)
 func (h *Host) PostMessage(writer io.Writer, v interface{}) error {
-	message, err := json.Marshal(v)
-	if err != nil {
+	if h.Codec != nil {
+		payload, err := h.Codec.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return h.PostRaw(writer, payload)
+	}
+
+	buf := bufferPool.Get().(*messageBuffer)
+	buf.Reset()
+	defer putBuffer(buf)
+
+	// Encode directly into pooled buffer to avoid json.Marshal extra copy.
+	if err := buf.encoder.Encode(v); err != nil {
 		return err
 	}
 
-	length := len(message)
+	// Drop trailing newline added by json.Encoder.
+	buf.Truncate(buf.Len() - 1)
+
+	return h.PostRaw(writer, buf.Bytes())
+}
+
+// PostMessageContext is like PostMessage, but it aborts the write when given
+// context is done and returns the context error. The write is interrupted with
+// a write deadline when given writer supports it, i.e.: *os.File or net.Conn,
+// and it is waited for, otherwise the write carries on in background. Either
+// way, a partial message might be written, so given writer shouldn't be reused
+// after the abort. It will return error when it come across one.
+//
+//   messaging := (&host.Host{}).Init()
+//
+//   ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//   defer cancel()
+//
+//   // Write message from response to os.Stdout, unless the browser is stuck.
+//   if err := messaging.PostMessageContext(ctx, os.Stdout, response); err != nil {
+//     log.Fatalf("messaging.PostMessageContext error: %v", err)
+//   }
+func (h *Host) PostMessageContext(ctx context.Context, writer io.Writer, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var setDeadline func(time.Time) error
+	if deadliner, ok := writer.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		setDeadline = deadliner.SetWriteDeadline
+	}
+
+	setDeadline = applyDeadline(ctx, setDeadline)
+	if setDeadline != nil {
+		defer setDeadline(time.Time{})
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- h.PostMessage(writer, v) }()
+
+	return awaitContext(ctx, done, setDeadline)
+}
+
+// applyDeadline applies given context deadline, if any, with given setDeadline
+// function, and returns it back when it is supported, otherwise nil.
+func applyDeadline(ctx context.Context, setDeadline func(time.Time) error) func(time.Time) error {
+	if setDeadline == nil {
+		return nil
+	}
+
+	// The zero deadline means no deadline.
+	deadline, _ := ctx.Deadline()
+	if setDeadline(deadline) != nil {
+		return nil
+	}
+
+	return setDeadline
+}
+
+// awaitContext waits for the pending operation result from given done channel
+// until given context is done. The pending operation is interrupted with given
+// setDeadline function and waited for, so it doesn't outlive the call, or it is
+// left running when setDeadline is nil. It will return the context error when
+// given context is done first.
+func awaitContext(ctx context.Context, done <-chan error, setDeadline func(time.Time) error) error {
+	select {
+	case err := <-done:
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return context.DeadlineExceeded
+		}
+		return err
+	case <-ctx.Done():
+		if setDeadline != nil {
+			// Any past time interrupts the pending operation right away.
+			setDeadline(time.Unix(1, 0))
+			<-done
+		}
+		return ctx.Err()
+	}
+}
+
+// PostRaw writes message header and given already serialized message body to
+// given writer without any re-marshal. It will return error when it come across
+// one.
+//
+//   messaging := (&host.Host{}).Init()
+//
+//   // Write cached JSON to os.Stdout.
+//   if err := messaging.PostRaw(os.Stdout, []byte(`{"key":"value"}`)); err != nil {
+//     log.Fatalf("messaging.PostRaw error: %v", err)
+//   }
+func (h *Host) PostRaw(writer io.Writer, payload []byte) error {
+	length := len(payload)
 
 	if err := h.writeHeader(writer, length); err != nil {
 		return err
 	}
 
 	// Write message body.
-	if n, err := writer.Write(message); err != nil || n != length {
+	if n, err := writer.Write(payload); err != nil || n != length {
 		return err
 	}
 
 	return nil
 }
 
-// writeHeader writes message length into message header. It will return error
-// when it come across one.
+// putBuffer returns given buffer to the pool, unless it grew beyond
+// MaxPooledBufferSize to avoid pinning large memory.
+func putBuffer(buf *messageBuffer) {
+	if buf.Cap() <= MaxPooledBufferSize {
+		bufferPool.Put(buf)
+	}
+}
+
+// newMessageBuffer returns a new message buffer with its JSON encoder.
+func newMessageBuffer() *messageBuffer {
+	buf := &messageBuffer{}
+	buf.encoder = json.NewEncoder(&buf.Buffer)
+	return buf
+}
+
+// writeHeader writes message length into pooled message header. It will return
+// error when it come across one.
 func (h *Host) writeHeader(writer io.Writer, length int) error {
-	header := make([]byte, 4)
-	h.ByteOrder.PutUint32(header, (uint32)(length))
+	// Truncated length would corrupt every following message.
+	if uint64(length) > math.MaxUint32 {
+		return ErrMessageTooLarge
+	}
+
+	header := headerPool.Get().(*[4]byte)
+	defer headerPool.Put(header)
+
+	h.ByteOrder.PutUint32(header[:], (uint32)(length))
 
-	if n, err := writer.Write(header); err != nil || n != len(header) {
+	if n, err := writer.Write(header[:]); err != nil || n != len(header) {
 		return err
 	}
 
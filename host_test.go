@@ -8,16 +8,26 @@
 package host
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"github.com/google/go-cmp/cmp"
 	"io"
 	"io/ioutil"
+	"log"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 type writer struct {
@@ -44,6 +54,40 @@ func (w *writer) Write(buf []byte) (int, error) {
 	return len(buf), nil
 }
 
+func TestHostDefaultAppName(t *testing.T) {
+	t.Parallel()
+
+	got, err := DefaultAppName()
+	if err != nil {
+		t.Fatalf("default app name error: %v", err)
+	}
+
+	if want := (&Host{}).Init().AppName; got != want {
+		t.Errorf("mismatch (want: %s, got: %s)", want, got)
+	}
+}
+
+func TestHostGetNativeByteOrder(t *testing.T) {
+	t.Parallel()
+
+	want := binary.ByteOrder(binary.LittleEndian)
+	switch runtime.GOARCH {
+	case "armbe", "arm64be", "m68k", "mips", "mips64", "mips64p32", "ppc", "ppc64", "s390",
+		"s390x", "shbe", "sparc", "sparc64":
+		want = binary.BigEndian
+	}
+
+	if got := getNativeByteOrder(); got != want {
+		t.Errorf("mismatch on %s (want: %v, got: %v)", runtime.GOARCH, want, got)
+	}
+
+	buf := make([]byte, 4)
+	nativeByteOrder.PutUint32(buf, 1)
+	if value := *(*uint32)(unsafe.Pointer(&buf[0])); value != 1 {
+		t.Errorf("memory layout mismatch: %d", value)
+	}
+}
+
 func TestHostInit(t *testing.T) {
 	t.Parallel()
 
@@ -60,35 +104,38 @@ func TestHostInit(t *testing.T) {
 	}
 
 	t.Run("with default", compare((&Host{}).Init(), &Host{
-		AppName:    "native-messaging-host",
-		AppDesc:    "native-messaging-host",
-		AppType:    "stdio",
-		AutoUpdate: false,
-		ExecName:   absExec,
-		ByteOrder:  binary.LittleEndian,
+		AppName:        "native-messaging-host",
+		AppDesc:        "native-messaging-host",
+		AppType:        "stdio",
+		AutoUpdate:     false,
+		ExecName:       absExec,
+		ByteOrder:      nativeByteOrder,
+		UpdateInterval: DefaultUpdateInterval,
 	}))
 
 	t.Run("with AppName", compare((&Host{
 		AppName: "my.app.name",
 	}).Init(), &Host{
-		AppName:    "my.app.name",
-		AppDesc:    "my.app.name",
-		AppType:    "stdio",
-		AutoUpdate: false,
-		ExecName:   absExec,
-		ByteOrder:  binary.LittleEndian,
+		AppName:        "my.app.name",
+		AppDesc:        "my.app.name",
+		AppType:        "stdio",
+		AutoUpdate:     false,
+		ExecName:       absExec,
+		ByteOrder:      nativeByteOrder,
+		UpdateInterval: DefaultUpdateInterval,
 	}))
 
 	t.Run("with AppName, AppDesc", compare((&Host{
 		AppName: "my.app.name",
 		AppDesc: "Description of my app",
 	}).Init(), &Host{
-		AppName:    "my.app.name",
-		AppDesc:    "Description of my app",
-		AppType:    "stdio",
-		AutoUpdate: false,
-		ExecName:   absExec,
-		ByteOrder:  binary.LittleEndian,
+		AppName:        "my.app.name",
+		AppDesc:        "Description of my app",
+		AppType:        "stdio",
+		AutoUpdate:     false,
+		ExecName:       absExec,
+		ByteOrder:      nativeByteOrder,
+		UpdateInterval: DefaultUpdateInterval,
 	}))
 
 	t.Run("with AppName, AppDesc, AppType", compare((&Host{
@@ -96,12 +143,13 @@ func TestHostInit(t *testing.T) {
 		AppDesc: "Description of my app",
 		AppType: "any",
 	}).Init(), &Host{
-		AppName:    "my.app.name",
-		AppDesc:    "Description of my app",
-		AppType:    "any",
-		AutoUpdate: false,
-		ExecName:   absExec,
-		ByteOrder:  binary.LittleEndian,
+		AppName:        "my.app.name",
+		AppDesc:        "Description of my app",
+		AppType:        "any",
+		AutoUpdate:     false,
+		ExecName:       absExec,
+		ByteOrder:      nativeByteOrder,
+		UpdateInterval: DefaultUpdateInterval,
 	}))
 
 	t.Run("with AppName, AppDesc, AppType, ByteOrder", compare((&Host{
@@ -110,12 +158,13 @@ func TestHostInit(t *testing.T) {
 		AppType:   "any",
 		ByteOrder: binary.BigEndian,
 	}).Init(), &Host{
-		AppName:    "my.app.name",
-		AppDesc:    "Description of my app",
-		AppType:    "any",
-		AutoUpdate: false,
-		ExecName:   absExec,
-		ByteOrder:  binary.BigEndian,
+		AppName:        "my.app.name",
+		AppDesc:        "Description of my app",
+		AppType:        "any",
+		AutoUpdate:     false,
+		ExecName:       absExec,
+		ByteOrder:      binary.BigEndian,
+		UpdateInterval: DefaultUpdateInterval,
 	}))
 
 	t.Run("with AppName, AppDesc, AppType, ByteOrder, UpdateUrl", compare((&Host{
@@ -125,13 +174,14 @@ func TestHostInit(t *testing.T) {
 		ByteOrder: binary.BigEndian,
 		UpdateUrl: "https://www.google.com",
 	}).Init(), &Host{
-		AppName:    "my.app.name",
-		AppDesc:    "Description of my app",
-		AppType:    "any",
-		AutoUpdate: false,
-		ExecName:   absExec,
-		ByteOrder:  binary.BigEndian,
-		UpdateUrl:  "https://www.google.com",
+		AppName:        "my.app.name",
+		AppDesc:        "Description of my app",
+		AppType:        "any",
+		AutoUpdate:     false,
+		ExecName:       absExec,
+		ByteOrder:      binary.BigEndian,
+		UpdateInterval: DefaultUpdateInterval,
+		UpdateUrl:      "https://www.google.com",
 	}))
 
 	t.Run("with AppName, AppDesc, AppType, ByteOrder, UpdateUrl, Version", compare((&Host{
@@ -142,17 +192,182 @@ func TestHostInit(t *testing.T) {
 		UpdateUrl: "https://www.google.com",
 		Version:   "0.0.0",
 	}).Init(), &Host{
-		AppName:    "my.app.name",
-		AppDesc:    "Description of my app",
-		AppType:    "any",
-		AutoUpdate: true,
-		ExecName:   absExec,
-		ByteOrder:  binary.BigEndian,
-		UpdateUrl:  "https://www.google.com",
-		Version:    "0.0.0",
+		AppName:        "my.app.name",
+		AppDesc:        "Description of my app",
+		AppType:        "any",
+		AutoUpdate:     true,
+		ExecName:       absExec,
+		ByteOrder:      binary.BigEndian,
+		UpdateInterval: DefaultUpdateInterval,
+		UpdateUrl:      "https://www.google.com",
+		Version:        "0.0.0",
+	}))
+
+	t.Run("with ExecName", compare((&Host{
+		ExecName: "/opt/app/my.app.name.exe",
+	}).Init(), &Host{
+		AppName:        "my.app.name",
+		AppDesc:        "my.app.name",
+		AppType:        "stdio",
+		AutoUpdate:     false,
+		ExecName:       "/opt/app/my.app.name.exe",
+		ByteOrder:      nativeByteOrder,
+		UpdateInterval: DefaultUpdateInterval,
+	}))
+
+	t.Run("with mixed case ExecName", compare((&Host{
+		ExecName: "/opt/app/My.App.Name.exe",
+	}).Init(), &Host{
+		AppName:        "my.app.name",
+		AppDesc:        "my.app.name",
+		AppType:        "stdio",
+		AutoUpdate:     false,
+		ExecName:       "/opt/app/My.App.Name.exe",
+		ByteOrder:      nativeByteOrder,
+		UpdateInterval: DefaultUpdateInterval,
+	}))
+
+	t.Run("with UpdateInterval", compare((&Host{
+		AppName:        "my.app.name",
+		UpdateInterval: time.Hour,
+	}).Init(), &Host{
+		AppName:        "my.app.name",
+		AppDesc:        "my.app.name",
+		AppType:        "stdio",
+		AutoUpdate:     false,
+		ExecName:       absExec,
+		ByteOrder:      nativeByteOrder,
+		UpdateInterval: time.Hour,
+	}))
+
+	t.Run("with invalid UpdateUrl, Version", compare((&Host{
+		AppName:   "my.app.name",
+		UpdateUrl: "ftp://www.google.com",
+		Version:   "0.0.0",
+	}).Init(), &Host{
+		AppName:        "my.app.name",
+		AppDesc:        "my.app.name",
+		AppType:        "stdio",
+		AutoUpdate:     false,
+		ExecName:       absExec,
+		ByteOrder:      nativeByteOrder,
+		UpdateInterval: DefaultUpdateInterval,
+		UpdateUrl:      "ftp://www.google.com",
+		Version:        "0.0.0",
+	}))
+
+	t.Run("with negative UpdateInterval", compare((&Host{
+		AppName:        "my.app.name",
+		UpdateInterval: -time.Hour,
+	}).Init(), &Host{
+		AppName:        "my.app.name",
+		AppDesc:        "my.app.name",
+		AppType:        "stdio",
+		AutoUpdate:     false,
+		ExecName:       absExec,
+		ByteOrder:      nativeByteOrder,
+		UpdateInterval: DefaultUpdateInterval,
 	}))
 }
 
+func TestHostValidate(t *testing.T) {
+	t.Parallel()
+
+	compare := func(wantErr bool, updateUrl, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			h := &Host{AppName: "my.app.name", UpdateUrl: updateUrl}
+			if err := h.Validate(); !wantErr && err != nil {
+				t.Fatalf("validate error %s: %v", updateUrl, err)
+			} else if wantErr && err == nil {
+				t.Fatalf("want error: %s", updateUrl)
+			}
+
+			if h.UpdateUrl != want {
+				t.Errorf("mismatch (want: %q, got: %q)", want, h.UpdateUrl)
+			}
+		}
+	}
+
+	t.Run("with nothing", compare(false, "", ""))
+	t.Run("with valid https URL", compare(false, "https://sub.domain.tld/updates.xml",
+		"https://sub.domain.tld/updates.xml"))
+	t.Run("with surrounding whitespace", compare(false, " https://sub.domain.tld/updates.xml\n",
+		"https://sub.domain.tld/updates.xml"))
+	t.Run("with ftp URL", compare(true, "ftp://sub.domain.tld/updates.xml",
+		"ftp://sub.domain.tld/updates.xml"))
+	t.Run("with relative URL", compare(true, "sub.domain.tld/updates.xml",
+		"sub.domain.tld/updates.xml"))
+	t.Run("with malformed URL", compare(true, "https://%zz", "https://%zz"))
+}
+
+func TestHostValidateAppName(t *testing.T) {
+	t.Parallel()
+
+	compare := func(wantErr bool, appName string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			if err := (&Host{AppName: appName}).Validate(); !wantErr && err != nil {
+				t.Errorf("validate error %q: %v", appName, err)
+			} else if wantErr && err == nil {
+				t.Errorf("want error: %q", appName)
+			}
+		}
+	}
+
+	t.Run("with single word", compare(false, "app"))
+	t.Run("with dots", compare(false, "tld.domain.sub.app.name"))
+	t.Run("with digits and underscores", compare(false, "com.app_2.host_1"))
+	t.Run("with empty name", compare(true, ""))
+	t.Run("with uppercase letters", compare(true, "com.App.name"))
+	t.Run("with hyphen", compare(true, "native-messaging-host"))
+	t.Run("with whitespace", compare(true, "com.app name"))
+	t.Run("with leading dot", compare(true, ".com.app"))
+	t.Run("with trailing dot", compare(true, "com.app."))
+	t.Run("with consecutive dots", compare(true, "com..app"))
+	t.Run("with path separator", compare(true, "../com.app"))
+}
+
+func TestHostNormalizeAppName(t *testing.T) {
+	t.Parallel()
+
+	compare := func(name, want, wantErr string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			got, err := NormalizeAppName(name)
+			if wantErr == "" && err != nil {
+				t.Fatalf("normalize error %q: %v", name, err)
+			} else if wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)) {
+				t.Fatalf("error mismatch %q (want: %s, got: %v)", name, wantErr, err)
+			}
+
+			if got != want {
+				t.Errorf("mismatch (want: %q, got: %q)", want, got)
+			}
+
+			if err == nil {
+				if err := validateAppName(got); err != nil {
+					t.Errorf("normalized name is invalid %q: %v", got, err)
+				}
+			}
+		}
+	}
+
+	t.Run("with valid name", compare("tld.domain.sub.app_name", "tld.domain.sub.app_name", ""))
+	t.Run("with uppercase letters", compare("Tld.Domain.App_2", "tld.domain.app_2", ""))
+	t.Run("with surrounding whitespace", compare(" tld.app\n", "tld.app", ""))
+	t.Run("with empty name", compare("  ", "", "empty"))
+	t.Run("with leading dot", compare(".tld.app", ".tld.app", "start or end with a dot"))
+	t.Run("with trailing dot", compare("tld.app.", "tld.app.", "start or end with a dot"))
+	t.Run("with consecutive dots", compare("tld..app", "tld..app", "consecutive dots"))
+	t.Run("with hyphen", compare("Native-Host", "native-host", `character '-'`))
+	t.Run("with inner whitespace", compare("tld.app name", "tld.app name", `character ' '`))
+	t.Run("with non-ASCII letter", compare("tld.äpp", "tld.äpp", `character 'ä'`))
+}
+
 func TestHostOnMessage(t *testing.T) {
 	t.Parallel()
 
@@ -200,12 +415,129 @@ func TestHostOnMessage(t *testing.T) {
 	}
 
 	t.Run("with nothing", compare(true, true, nil, &H{}))
-	t.Run("with empty message", compare(false, false, "", &H{}))
+	t.Run("with empty message", compare(true, false, "", &H{}))
 	t.Run("with empty object", compare(false, false, "{}", &H{}))
 	t.Run("with invalid object", compare(true, false, `{"key":"value}`, &H{}))
 	t.Run("with valid object", compare(false, false, `{"key":"value"}`, &H{"key": "value"}))
 }
 
+func TestHostOnMessageEmpty(t *testing.T) {
+	t.Parallel()
+
+	h := &Host{ByteOrder: binary.LittleEndian}
+	reader := bytes.NewReader([]byte{0, 0, 0, 0, 2, 0, 0, 0, '{', '}'})
+
+	if err := h.OnMessage(reader, &H{}); !errors.Is(err, ErrEmptyMessage) {
+		t.Fatalf("error mismatch (want: %v, got: %v)", ErrEmptyMessage, err)
+	}
+
+	// The stream is positioned at next message.
+	if err := h.OnMessage(reader, &H{}); err != nil {
+		t.Errorf("next message error: %v", err)
+	}
+}
+
+func TestHostOnMessageStrictDecode(t *testing.T) {
+	t.Parallel()
+
+	type request struct {
+		Key string `json:"key"`
+	}
+
+	compare := func(strict, wantErr bool, message string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			h := &Host{ByteOrder: binary.LittleEndian, StrictDecode: strict}
+			buf := &bytes.Buffer{}
+			for _, m := range []string{message, `{"key":"next"}`} {
+				header := make([]byte, 4)
+				binary.LittleEndian.PutUint32(header, uint32(len(m)))
+				buf.Write(append(header, m...))
+			}
+
+			if err := h.OnMessage(buf, &request{}); !wantErr && err != nil {
+				t.Fatalf("got error: %v", err)
+			} else if wantErr && err == nil {
+				t.Fatal("want error")
+			}
+
+			// The stream is positioned at next message either way.
+			got := &request{}
+			if err := h.OnMessage(buf, got); err != nil || got.Key != "next" {
+				t.Errorf("next message mismatch (got: %+v, err: %v)", got, err)
+			}
+		}
+	}
+
+	t.Run("with known fields", compare(true, false, `{"key":"value"}`))
+	t.Run("with unknown field", compare(true, true, `{"key":"value","other":1}`))
+	t.Run("with unknown field on loose decode", compare(false, false, `{"key":"value","other":1}`))
+}
+
+func TestHostOnMessageValidate(t *testing.T) {
+	t.Parallel()
+
+	errMissing := errors.New("missing action")
+	validate := func(v interface{}) error {
+		if m, ok := v.(*H); !ok || (*m)["action"] == nil {
+			return errMissing
+		}
+		return nil
+	}
+
+	compare := func(codec Codec, wantErr error, message string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			header := make([]byte, 4)
+			binary.LittleEndian.PutUint32(header, uint32(len(message)))
+			h := &Host{ByteOrder: binary.LittleEndian, Codec: codec, ValidateMessage: validate}
+
+			err := h.OnMessage(bytes.NewReader(append(header, message...)), &H{})
+			if !errors.Is(err, wantErr) {
+				t.Errorf("error mismatch (want: %v, got: %v)", wantErr, err)
+			}
+		}
+	}
+
+	t.Run("with valid message", compare(nil, nil, `{"action":"ping"}`))
+	t.Run("with rejected message", compare(nil, errMissing, `{"key":"value"}`))
+	t.Run("with rejected message on codec", compare(JSONCodec{}, errMissing, `{"key":"value"}`))
+	t.Run("with empty message", compare(nil, ErrEmptyMessage, ""))
+}
+
+func TestHostOnMessageN(t *testing.T) {
+	t.Parallel()
+
+	compare := func(wantErr bool, message string, length uint32) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			header := make([]byte, 4)
+			binary.LittleEndian.PutUint32(header, length)
+			reader := bytes.NewReader(append(header, []byte(message)...))
+
+			n, err := (&Host{ByteOrder: binary.LittleEndian}).OnMessageN(reader, &H{})
+			if wantErr != (err != nil) {
+				t.Fatalf("error mismatch (want: %t, got: %v)", wantErr, err)
+			}
+
+			if n != int(length) {
+				t.Errorf("length mismatch (want: %d, got: %d)", length, n)
+			}
+		}
+	}
+
+	large := `{"key":"` + strings.Repeat("v", 70000) + `"}`
+
+	t.Run("with keep-alive", compare(false, "", 0))
+	t.Run("with empty object", compare(false, "{}", 2))
+	t.Run("with valid object", compare(false, `{"key":"value"}`, 15))
+	t.Run("with large object", compare(false, large, uint32(len(large))))
+	t.Run("with invalid object", compare(true, `{"key":"value}`, 14))
+}
+
 func TestHostPostMessage(t *testing.T) {
 	t.Parallel()
 
@@ -241,3 +573,545 @@ func TestHostPostMessage(t *testing.T) {
 	t.Run("with empty object", compare(false, &H{}, &H{}, &writer{}))
 	t.Run("with valid object", compare(false, &H{"key": "value"}, &H{"key": "value"}, &writer{}))
 }
+
+func TestHostPostMessageConcurrent(t *testing.T) {
+	t.Parallel()
+
+	// The same framing as MessageReader.
+	h := &Host{ByteOrder: nativeByteOrder}
+	buffers := make([]*bytes.Buffer, 8)
+	done := make(chan error, len(buffers))
+
+	// The pooled buffers shouldn't leak between writers.
+	for i := range buffers {
+		buffers[i] = &bytes.Buffer{}
+		go func(id int, buf *bytes.Buffer) {
+			for n := 0; n < 100; n++ {
+				value := strings.Repeat("v", id*n%64)
+				if err := h.PostMessage(buf, &H{"id": id, "n": n, "value": value}); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}(i, buffers[i])
+	}
+
+	for range buffers {
+		if err := <-done; err != nil {
+			t.Fatalf("post message error: %v", err)
+		}
+	}
+
+	for id, buf := range buffers {
+		reader := NewMessageReader(buf)
+		for n := 0; n < 100; n++ {
+			got := H{}
+			if err := reader.ReadMessage(&got); err != nil {
+				t.Fatalf("read message error %d/%d: %v", id, n, err)
+			}
+
+			want := H{"id": float64(id), "n": float64(n), "value": strings.Repeat("v", id*n%64)}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("mismatch %d/%d (-want +got):\n%s", id, n, diff)
+			}
+		}
+	}
+}
+
+func TestHostPostRaw(t *testing.T) {
+	t.Parallel()
+
+	compare := func(wantErr bool, message interface{}, got *writer) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			h := &Host{ByteOrder: binary.LittleEndian}
+			payload, _ := json.Marshal(message)
+
+			if err := h.PostRaw(got, payload); !wantErr && err != nil {
+				t.Fatalf("got error %+v: %v", message, err)
+			} else if wantErr && err == nil {
+				t.Fatalf("want error: %v", message)
+			}
+
+			if !wantErr {
+				want := &writer{}
+				if err := h.PostMessage(want, message); err != nil {
+					t.Fatalf("post message error %v: %v", message, err)
+				}
+
+				if diff := cmp.Diff(want.Bytes(), got.Bytes()); diff != "" {
+					t.Errorf("framing mismatch (-want +got):\n%s", diff)
+				}
+			}
+		}
+	}
+
+	t.Run("with header writer error", compare(true, &H{}, &writer{err: 1}))
+	t.Run("with message writer error", compare(true, &H{}, &writer{err: 2}))
+	t.Run("with empty object", compare(false, &H{}, &writer{}))
+	t.Run("with valid object", compare(false, &H{"key": "value"}, &writer{}))
+	t.Run("with escaped string", compare(false, &H{"html": "<a href='#'>&</a>"}, &writer{}))
+	t.Run("with nested object", compare(false, &H{"items": []H{{"id": 1}, {"id": 2}}}, &writer{}))
+}
+
+func TestHostBuildVersion(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	oldDebugReadBuildInfo := debugReadBuildInfo
+	defer func() { debugReadBuildInfo = oldDebugReadBuildInfo }()
+
+	compare := func(version, buildVersion string, available bool, want string, wantAutoUpdate bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			resolved := false
+			debugReadBuildInfo = func() (*debug.BuildInfo, bool) {
+				resolved = true
+				return &debug.BuildInfo{Main: debug.Module{Version: buildVersion}}, available
+			}
+
+			h := (&Host{UpdateUrl: "https://sub.domain.tld/updates.xml", Version: version}).Init()
+
+			if h.Version != want || h.AutoUpdate != wantAutoUpdate {
+				t.Errorf("mismatch (want: %q %t, got: %q %t)", want, wantAutoUpdate, h.Version, h.AutoUpdate)
+			}
+
+			if resolved != (version == "") {
+				t.Errorf("build info resolution mismatch (want: %t, got: %t)", version == "", resolved)
+			}
+		}
+	}
+
+	t.Run("with provided version", compare("1.0.0", "v1.2.3", true, "1.0.0", true))
+	t.Run("with build version", compare("", "v1.2.3", true, "v1.2.3", true))
+	t.Run("with development build", compare("", "(devel)", true, "", false))
+	t.Run("with no build info", compare("", "", false, "", false))
+}
+
+func TestHostOnMessageRawMessage(t *testing.T) {
+	t.Parallel()
+
+	h := &Host{ByteOrder: binary.LittleEndian}
+
+	compare := func(first string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			buf := &bytes.Buffer{}
+			_ = h.PostRaw(buf, []byte(first))
+			_ = h.PostRaw(buf, []byte(`{"type":"second"}`))
+			reader := bytes.NewReader(buf.Bytes())
+
+			raw := json.RawMessage{}
+			if err := h.OnMessage(reader, &raw); err != nil {
+				t.Fatalf("first message error: %v", err)
+			}
+
+			if diff := cmp.Diff(strings.TrimSpace(first), string(raw)); diff != "" {
+				t.Errorf("raw mismatch (-want +got):\n%s", diff)
+			}
+
+			second := H{}
+			if err := h.OnMessage(reader, &second); err != nil {
+				t.Fatalf("second message error: %v", err)
+			}
+
+			if diff := cmp.Diff(H{"type": "second"}, second); diff != "" {
+				t.Errorf("second mismatch (-want +got):\n%s", diff)
+			}
+
+			if reader.Len() != 0 {
+				t.Errorf("unread bytes: %d", reader.Len())
+			}
+		}
+	}
+
+	t.Run("with object", compare(`{"type":"first","data":[1,2]}`))
+	t.Run("with trailing newline", compare(`{"type":"first"}`+"\n"))
+	t.Run("with large trailing whitespace", compare(`{"type":"first"}`+strings.Repeat(" ", 4096)))
+	t.Run("with large object", compare(`{"data":"`+strings.Repeat("x", 4096)+`"}`))
+}
+
+func TestHostOnMessages(t *testing.T) {
+	t.Parallel()
+
+	h := &Host{ByteOrder: binary.LittleEndian}
+	frames := func(partial bool, messages ...string) []byte {
+		buf := &bytes.Buffer{}
+		for _, message := range messages {
+			_ = h.PostRaw(buf, []byte(message))
+		}
+		if partial {
+			// Header with half of the body.
+			_ = h.PostRaw(buf, []byte(`{"key":"value"}`))
+			buf.Truncate(buf.Len() - 7)
+		}
+		return buf.Bytes()
+	}
+
+	compare := func(reader func([]byte) io.Reader, content []byte, max int, want [][]string,
+		wantRemaining int) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			r := reader(content)
+			got := [][]string{}
+
+			for range want {
+				messages, err := h.OnMessages(r, max)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+
+				batch := []string{}
+				for _, message := range messages {
+					batch = append(batch, string(message))
+				}
+				got = append(got, batch)
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			if buffered, ok := r.(*bufio.Reader); ok && buffered.Buffered() != wantRemaining {
+				t.Errorf("remaining mismatch (want: %d, got: %d)", wantRemaining, buffered.Buffered())
+			}
+		}
+	}
+
+	buffered := func(content []byte) io.Reader { return bufio.NewReader(bytes.NewReader(content)) }
+	unbuffered := func(content []byte) io.Reader { return bytes.NewReader(content) }
+	content := frames(false, `{"id":1}`, `{"id":2}`, `{"id":3}`)
+
+	t.Run("with all buffered messages", compare(buffered, content, 10,
+		[][]string{{`{"id":1}`, `{"id":2}`, `{"id":3}`}}, 0))
+	t.Run("with max messages", compare(buffered, content, 2,
+		[][]string{{`{"id":1}`, `{"id":2}`}, {`{"id":3}`}}, 0))
+	t.Run("with zero max", compare(buffered, content, 0,
+		[][]string{{`{"id":1}`}, {`{"id":2}`}}, 12))
+	t.Run("with partial trailing message", compare(buffered, frames(true, `{"id":1}`, `{"id":2}`), 10,
+		[][]string{{`{"id":1}`, `{"id":2}`}}, 12))
+	t.Run("with unbuffered reader", compare(unbuffered, content, 10,
+		[][]string{{`{"id":1}`}, {`{"id":2}`}}, 0))
+
+	t.Run("with empty message", func(t *testing.T) {
+		t.Parallel()
+
+		// The messages before the empty one are returned with the error, and
+		// the following ones are left for the next call.
+		r := bufio.NewReader(bytes.NewReader(frames(false, `{"id":1}`, ``, `{"id":2}`)))
+		got := [][]string{}
+
+		for _, wantErr := range []error{ErrEmptyMessage, nil} {
+			messages, err := h.OnMessages(r, 10)
+			if err != wantErr {
+				t.Fatalf("error mismatch (want: %v, got: %v)", wantErr, err)
+			}
+
+			batch := []string{}
+			for _, message := range messages {
+				batch = append(batch, string(message))
+			}
+			got = append(got, batch)
+		}
+
+		if diff := cmp.Diff([][]string{{`{"id":1}`}, {`{"id":2}`}}, got); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("with truncated header", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := h.OnMessages(bytes.NewReader([]byte{1, 0}), 10); err == nil {
+			t.Error("want error")
+		}
+	})
+
+	t.Run("with truncated body", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := h.OnMessages(bytes.NewReader(frames(true)), 10); err == nil {
+			t.Error("want error")
+		}
+	})
+
+	t.Run("with malformed length", func(t *testing.T) {
+		t.Parallel()
+
+		// The declared 4 GiB body isn't allocated upfront.
+		_, err := h.OnMessages(bytes.NewReader(append([]byte{0xff, 0xff, 0xff, 0xff}, "{}"...)), 10)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("error mismatch (want: %v, got: %v)", io.ErrUnexpectedEOF, err)
+		}
+	})
+}
+
+// blockingWriter is an io.Writer that blocks until it is released.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	<-b.release
+	return len(p), nil
+}
+
+func TestHostWriteHeaderOverflow(t *testing.T) {
+	t.Parallel()
+
+	compare := func(length uint64, wantErr error) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			if uint64(int(length)) != length {
+				t.Skipf("%d doesn't fit into int", length)
+			}
+
+			got := &writer{}
+			h := &Host{ByteOrder: binary.LittleEndian}
+
+			if err := h.writeHeader(got, int(length)); err != wantErr {
+				t.Fatalf("error mismatch (want: %v, got: %v)", wantErr, err)
+			}
+
+			// Nothing is written on overflow to keep the stream intact.
+			if wantErr != nil && got.count != 0 {
+				t.Errorf("written on overflow: %v", got.Bytes())
+			}
+		}
+	}
+
+	t.Run("with max length", compare(math.MaxUint32, nil))
+	t.Run("with overflow length", compare(math.MaxUint32+1, ErrMessageTooLarge))
+}
+
+func TestHostPostMessageContext(t *testing.T) {
+	t.Parallel()
+
+	compare := func(wantErr error, writer func() (io.Writer, func()), timeout time.Duration) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			w, cleanup := writer()
+			defer cleanup()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			h := &Host{ByteOrder: binary.LittleEndian}
+			start := time.Now()
+			err := h.PostMessageContext(ctx, w, &H{"key": "value"})
+
+			if !errors.Is(err, wantErr) {
+				t.Errorf("error mismatch (want: %v, got: %v)", wantErr, err)
+			}
+
+			if elapsed := time.Since(start); elapsed > timeout+time.Second {
+				t.Errorf("write is not bounded: %v", elapsed)
+			}
+		}
+	}
+
+	t.Run("with available writer", compare(nil, func() (io.Writer, func()) {
+		return &writer{}, func() {}
+	}, time.Second))
+	t.Run("with blocking writer", compare(context.DeadlineExceeded, func() (io.Writer, func()) {
+		w := &blockingWriter{release: make(chan struct{})}
+		return w, func() { close(w.release) }
+	}, 20*time.Millisecond))
+	// Anonymous pipe doesn't support write deadline on Windows.
+	if runtime.GOOS != "windows" {
+		t.Run("with blocking pipe", compare(context.DeadlineExceeded, func() (io.Writer, func()) {
+			r, w, _ := os.Pipe()
+			// Fill the pipe buffer, so the next write blocks.
+			_ = w.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			_, _ = w.Write(make([]byte, 1<<20))
+			_ = w.SetWriteDeadline(time.Time{})
+			return w, func() {
+				r.Close()
+				w.Close()
+			}
+		}, 20*time.Millisecond))
+	}
+	t.Run("with expired context", compare(context.DeadlineExceeded, func() (io.Writer, func()) {
+		return &writer{}, func() {}
+	}, 0))
+
+	t.Run("with cancelled blocking conn", func(t *testing.T) {
+		t.Parallel()
+
+		clientSide, hostSide := net.Pipe()
+		defer clientSide.Close()
+		defer hostSide.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+
+		h := &Host{ByteOrder: binary.LittleEndian}
+		if err := h.PostMessageContext(ctx, hostSide, &H{"key": "value"}); err != context.Canceled {
+			t.Fatalf("error mismatch (want: %v, got: %v)", context.Canceled, err)
+		}
+
+		// The interrupted write doesn't carry on after the return.
+		_ = clientSide.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if n, err := clientSide.Read(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("write leaked after return (got: %d bytes, %v)", n, err)
+		}
+	})
+}
+
+type reverseCodec struct{}
+
+func (reverseCodec) reverse(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+	return reversed
+}
+
+func (c reverseCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	return c.reverse(data), err
+}
+
+func (c reverseCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(c.reverse(data), v)
+}
+
+func TestHostCodec(t *testing.T) {
+	t.Parallel()
+
+	compare := func(codec Codec, wantBody string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			h := &Host{ByteOrder: binary.LittleEndian, Codec: codec}
+			w := &writer{}
+
+			if err := h.PostMessage(w, &H{"key": "value"}); err != nil {
+				t.Fatalf("post message error: %v", err)
+			}
+
+			if body := string(w.Bytes()[4:]); body != wantBody {
+				t.Errorf("body mismatch (want: %s, got: %s)", wantBody, body)
+			}
+
+			if length := binary.LittleEndian.Uint32(w.Bytes()[:4]); int(length) != len(wantBody) {
+				t.Errorf("length mismatch (want: %d, got: %d)", len(wantBody), length)
+			}
+
+			got := &H{}
+			if err := h.OnMessage(bytes.NewReader(w.Bytes()), got); err != nil {
+				t.Fatalf("on message error: %v", err)
+			}
+
+			if diff := cmp.Diff(&H{"key": "value"}, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with default codec", compare(nil, `{"key":"value"}`))
+	t.Run("with JSON codec", compare(JSONCodec{}, `{"key":"value"}`))
+	t.Run("with custom codec", compare(reverseCodec{}, `}"eulav":"yek"{`))
+}
+
+func TestHostCodecError(t *testing.T) {
+	t.Parallel()
+
+	h := &Host{ByteOrder: binary.LittleEndian, Codec: reverseCodec{}}
+
+	if err := h.PostMessage(&writer{}, make(chan int)); err == nil {
+		t.Error("missing marshal error")
+	}
+
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint32(header, 10)
+	if err := h.OnMessage(bytes.NewReader(append(header, []byte("{}")...)), &H{}); err == nil {
+		t.Error("missing short body error")
+	}
+}
+
+func TestHostReadPayload(t *testing.T) {
+	t.Parallel()
+
+	compare := func(length uint32, body string, wantErr error) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			got, err := readPayload(strings.NewReader(body), length)
+			if err != wantErr {
+				t.Fatalf("error mismatch (want: %v, got: %v)", wantErr, err)
+			}
+
+			if wantErr == nil && string(got) != body {
+				t.Errorf("body mismatch (want: %q, got: %q)", body, got)
+			}
+		}
+	}
+
+	t.Run("with whole body", compare(2, "{}", nil))
+	t.Run("with empty body", compare(0, "", nil))
+	t.Run("with short body", compare(10, "{}", io.ErrUnexpectedEOF))
+	// A malformed header doesn't allocate the declared length upfront.
+	t.Run("with maximum length", compare(math.MaxUint32, "{}", io.ErrUnexpectedEOF))
+}
+
+func BenchmarkHostPostMessage(b *testing.B) {
+	h := &Host{ByteOrder: binary.LittleEndian}
+	items := make([]H, 4096)
+	for i := range items {
+		items[i] = H{"id": i, "name": "item name", "value": bytes.Repeat([]byte("v"), 32)}
+	}
+	message := &H{"items": items}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := h.PostMessage(ioutil.Discard, message); err != nil {
+			b.Fatalf("post message error: %v", err)
+		}
+	}
+}
+
+func BenchmarkHostPostMessageSmall(b *testing.B) {
+	h := &Host{ByteOrder: binary.LittleEndian}
+	message := &struct {
+		Type string `json:"type"`
+		Id   int    `json:"id"`
+	}{"ping", 1}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := h.PostMessage(ioutil.Discard, message); err != nil {
+			b.Fatalf("post message error: %v", err)
+		}
+	}
+}
+
+func BenchmarkHostPostRaw(b *testing.B) {
+	h := &Host{ByteOrder: binary.LittleEndian}
+	items := make([]H, 4096)
+	for i := range items {
+		items[i] = H{"id": i, "name": "item name", "value": bytes.Repeat([]byte("v"), 32)}
+	}
+	payload, err := json.Marshal(&H{"items": items})
+	if err != nil {
+		b.Fatalf("marshal error: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := h.PostRaw(ioutil.Discard, payload); err != nil {
+			b.Fatalf("post raw error: %v", err)
+		}
+	}
+}
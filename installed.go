@@ -0,0 +1,228 @@
+// installed.go - Installed manifest file related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrInvalidManifest is returned when installed native-messaging manifest file
+// doesn't match the host configuration.
+var ErrInvalidManifest = errors.New("manifest is invalid")
+
+// ErrRelativeExec is returned by Install when RelativeExec is set on a platform
+// where the browser can't resolve a relative manifest path.
+var ErrRelativeExec = errors.New("relative executable path is only supported on Windows")
+
+// ErrNotInstalled is returned when native-messaging manifest file is absent.
+var ErrNotInstalled = errors.New("manifest is not installed")
+
+// installedManifest represents the verified keys of installed native-messaging
+// manifest file for any Browser.
+type installedManifest struct {
+	AllowedExtensions []string `json:"allowed_extensions"`
+	AllowedOrigins    []string `json:"allowed_origins"`
+	AppName           string   `json:"name"`
+	ExecName          string   `json:"path"`
+}
+
+// InstallResult represents the side effects of a successful install, i.e.: for
+// an installer to log and verify them.
+//
+// RegistryKey is the windows registry entry with root key abbreviation, i.e.:
+// HKCU\Software\..., and it is empty on other platforms.
+type InstallResult struct {
+	Browsers     []Browser `json:"browsers"`
+	BytesWritten int       `json:"bytes_written"`
+	ManifestPath string    `json:"manifest_path"`
+	RegistryKey  string    `json:"registry_key,omitempty"`
+}
+
+// getManifestDirMode returns configured manifest folder mode, otherwise 0755.
+func (h *Host) getManifestDirMode() os.FileMode {
+	if h.ManifestDirMode != 0 {
+		return h.ManifestDirMode
+	}
+	return 0755
+}
+
+// getManifestFileMode returns configured manifest file mode, otherwise 0644.
+func (h *Host) getManifestFileMode() os.FileMode {
+	if h.ManifestFileMode != 0 {
+		return h.ManifestFileMode
+	}
+	return 0644
+}
+
+// writeFileAtomic writes given data to a temporary file next to given file name
+// and renames it over given file name once it is synced, so the browser never
+// reads a partial manifest. The mode is applied on the temporary file, which is
+// created with 0600 mode, regardless of umask when given chmod is true. The
+// temporary file is removed on failure. It will return error when it come
+// across one.
+func writeFileAtomic(name string, data []byte, perm os.FileMode, chmod bool) error {
+	file, err := ioutilTempFile(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := file.Name()
+
+	_, err = file.Write(data)
+	if err == nil && chmod {
+		err = osChmod(tmpName, perm)
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if err = appendError(err, file.Close()); err == nil {
+		err = osRename(tmpName, name)
+	}
+
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return nil
+}
+
+// installManifest returns native messaging host manifest content to be written
+// into given manifest file. Its path is relative to the manifest folder when
+// RelativeExec is true. It will return error when it come across one.
+func (h *Host) installManifest(name string) ([]byte, error) {
+	if !h.RelativeExec {
+		return h.Manifest()
+	}
+
+	rel, err := filepath.Rel(filepath.Dir(name), h.ExecName)
+	if err != nil {
+		return nil, err
+	}
+
+	target := *h
+	target.ExecName = rel
+
+	return target.Manifest()
+}
+
+// ManifestPath returns an absolute path where Install writes native-messaging
+// manifest file for configured Browser and Scope, without installing. It will
+// return error when AppName is invalid.
+func (h *Host) ManifestPath() (string, error) {
+	if err := validateAppName(h.AppName); err != nil {
+		return "", err
+	}
+	return h.getTargetName(), nil
+}
+
+// InstalledAt returns modification time of installed native-messaging manifest
+// file. It will return ErrNotInstalled when the manifest file is absent, or
+// other error when it come across one.
+func (h *Host) InstalledAt() (time.Time, error) {
+	name, err := h.getInstalledName()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, fmt.Errorf("%s: %w", name, ErrNotInstalled)
+		}
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// VerifyInstall checks installed native-messaging manifest file, which is pointed
+// by windows registry on Windows, is a valid JSON with matching AppName, its
+// path resolves to ExecName, relative to the manifest folder when it isn't
+// absolute, and it allows at least one extension. It will return
+// ErrNotInstalled when the manifest file is absent, ErrInvalidManifest when it
+// doesn't match, or other error when it come across one.
+//
+//   messaging := (&host.Host{}).Init()
+//
+//   if err := messaging.VerifyInstall(); err != nil {
+//     log.Fatalf("messaging.VerifyInstall error: %v", err)
+//   }
+func (h *Host) VerifyInstall() error {
+	if err := validateAppName(h.AppName); err != nil {
+		return err
+	}
+
+	name, err := h.getInstalledName()
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s: %w", name, ErrNotInstalled)
+		}
+		return err
+	}
+
+	manifest := &installedManifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return fmt.Errorf("%s: %v: %w", name, err, ErrInvalidManifest)
+	}
+
+	if manifest.AppName != h.AppName {
+		return fmt.Errorf("%s: name %q != %q: %w", name, manifest.AppName, h.AppName, ErrInvalidManifest)
+	}
+
+	// A relative path is resolved against the manifest folder.
+	execName := manifest.ExecName
+	if execName != "" && !filepath.IsAbs(execName) {
+		execName = filepath.Join(filepath.Dir(name), execName)
+	}
+
+	if !isSamePath(execName, h.ExecName) {
+		return fmt.Errorf("%s: path %q != %q: %w", name, manifest.ExecName, h.ExecName, ErrInvalidManifest)
+	}
+
+	allowed := manifest.AllowedOrigins
+	if h.Browser == Firefox {
+		allowed = manifest.AllowedExtensions
+	}
+
+	if len(allowed) == 0 {
+		return fmt.Errorf("%s: no allowed extensions: %w", name, ErrInvalidManifest)
+	}
+
+	return nil
+}
+
+// isSamePath returns true if both given paths resolve to the same location,
+// otherwise false.
+func isSamePath(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+
+	if resolved, err := filepath.EvalSymlinks(a); err == nil {
+		a = resolved
+	}
+
+	if resolved, err := filepath.EvalSymlinks(b); err == nil {
+		b = resolved
+	}
+
+	return filepath.Clean(a) == filepath.Clean(b)
+}
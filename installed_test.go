@@ -0,0 +1,86 @@
+// installed_test.go - Test for installed manifest file related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInstalledWriteFileAtomic(t *testing.T) {
+	oldChmod := osChmod
+	oldRename := osRename
+	oldTempFile := ioutilTempFile
+	defer func() {
+		osChmod = oldChmod
+		osRename = oldRename
+		ioutilTempFile = oldTempFile
+	}()
+
+	compare := func(wantErr int, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			osChmod = oldChmod
+			osRename = oldRename
+			ioutilTempFile = oldTempFile
+
+			switch wantErr {
+			case 1:
+				// Simulate a failed write with a read-only temporary file.
+				ioutilTempFile = func(dir, pattern string) (*os.File, error) {
+					file, err := oldTempFile(dir, pattern)
+					if err != nil {
+						return nil, err
+					}
+					file.Close()
+					return os.Open(file.Name())
+				}
+			case 2:
+				osChmod = func(string, os.FileMode) error { return errors.New("Chmod error") }
+			case 3:
+				osRename = func(string, string) error { return errors.New("Rename error") }
+			}
+
+			targetName := fmt.Sprintf("testdata/atomic-%d.json", wantErr)
+			defer func() { os.Remove(targetName) }()
+
+			if err := ioutil.WriteFile(targetName, []byte(`{"name":"original"}`), 0644); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+
+			err := writeFileAtomic(targetName, []byte(`{"name":"replaced"}`), 0644, true)
+			if wantErr == 0 && err != nil {
+				t.Fatalf("write error: %v", err)
+			} else if wantErr > 0 && err == nil {
+				t.Fatal("want error")
+			}
+
+			if got, _ := ioutil.ReadFile(targetName); string(got) != want {
+				t.Errorf("content mismatch (want: %s, got: %s)", want, got)
+			}
+
+			if wantErr == 0 {
+				if info, err := os.Stat(targetName); err != nil || info.Mode().Perm() != 0644 {
+					t.Errorf("mode mismatch (want: 0644, got: %v %v)", info.Mode().Perm(), err)
+				}
+			}
+
+			if leftovers, _ := filepath.Glob(targetName + ".*.tmp"); len(leftovers) != 0 {
+				t.Errorf("temporary file is left behind: %v", leftovers)
+			}
+		}
+	}
+
+	t.Run("with replaced file", compare(0, `{"name":"replaced"}`))
+	t.Run("with write error", compare(1, `{"name":"original"}`))
+	t.Run("with chmod error", compare(2, `{"name":"original"}`))
+	t.Run("with rename error", compare(3, `{"name":"original"}`))
+}
@@ -0,0 +1,28 @@
+// lock_other.go - Advisory file lock for non Windows.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package host
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an exclusive advisory lock on given file without blocking.
+// The lock is released when the file is closed. It will return errUpdateLocked
+// when the lock is held by other instance.
+var lockFile = func(file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return errUpdateLocked
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+// lock_windows.go - Advisory file lock for Windows.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// lockFile acquires an exclusive lock on given file without blocking. The lock
+// is released when the file is closed. It will return errUpdateLocked when the
+// lock is held by other instance.
+var lockFile = func(file *os.File) error {
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY)
+	overlapped := &windows.Overlapped{}
+
+	if err := windows.LockFileEx(windows.Handle(file.Fd()), flags, 0, 1, 0, overlapped); err != nil {
+		if err == windows.ERROR_LOCK_VIOLATION {
+			return errUpdateLocked
+		}
+		return err
+	}
+	return nil
+}
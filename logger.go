@@ -0,0 +1,31 @@
+// logger.go - Diagnostic output related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import "log"
+
+// Logger is an interface for diagnostic output. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdLogger is an implementation of Logger and wraps the standard logger.
+type stdLogger struct{}
+
+// Printf is an implementation of Logger.Printf and wraps log.Printf.
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// logger returns configured Logger, otherwise the standard logger.
+func (h *Host) logger() Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return stdLogger{}
+}
@@ -10,70 +10,150 @@
 package host
 
 import (
-	"encoding/json"
-	"log"
 	"os"
 	"path/filepath"
 )
 
+// browserDirs are the manifest folders of each target browser for Linux.
+var browserDirs = map[Browser]browserDir{
+	Brave:    {"/etc/opt/chrome/native-messaging-hosts", ".config/BraveSoftware/Brave-Browser/NativeMessagingHosts"},
+	Chrome:   {"/etc/opt/chrome/native-messaging-hosts", ".config/google-chrome/NativeMessagingHosts"},
+	Chromium: {"/etc/chromium/native-messaging-hosts", ".config/chromium/NativeMessagingHosts"},
+	Edge:     {"/etc/opt/edge/native-messaging-hosts", ".config/microsoft-edge/NativeMessagingHosts"},
+	Firefox:  {"/usr/lib/mozilla/native-messaging-hosts", ".mozilla/native-messaging-hosts"},
+}
+
 // getTargetName returns an absolute path to native messaging host manifest
-// location for Linux.
+// location of configured Browser and Scope for Linux.
 //
 // See https://developer.chrome.com/extensions/nativeMessaging#native-messaging-host-location-nix
 func (h *Host) getTargetName() string {
-	target := "/etc/opt/chrome/native-messaging-hosts"
+	dir, ok := browserDirs[h.Browser]
+	if !ok {
+		dir = browserDirs[Chrome]
+	}
 
-	if os.Getuid() != 0 {
+	target := dir.system
+
+	if !h.isSystemWide() {
 		homeDir, _ := os.UserHomeDir()
-		target = homeDir + "/.config/google-chrome/NativeMessagingHosts"
+		target = filepath.Join(homeDir, dir.user)
 	}
 
 	return filepath.Join(target, h.AppName+".json")
 }
 
+// getInstalledName returns an absolute path to installed native messaging host
+// manifest.
+func (h *Host) getInstalledName() (string, error) {
+	return h.getTargetName(), nil
+}
+
+// writeManifest atomically replaces given manifest file with given manifest
+// content and configured ManifestFileMode, which is applied regardless of
+// umask. It will return error when it come across one.
+func (h *Host) writeManifest(name string, manifest []byte) error {
+	return writeFileAtomic(name, manifest, h.getManifestFileMode(), true)
+}
+
 // Install creates native-messaging manifest file on appropriate location. It
 // will return error when it come across one.
 //
 // See https://developer.chrome.com/extensions/nativeMessaging#native-messaging-host-location-nix
 func (h *Host) Install() error {
-	manifest, _ := json.MarshalIndent(h, "", "  ")
+	_, err := h.InstallWithResult()
+	return err
+}
+
+// InstallWithResult creates native-messaging manifest file on appropriate
+// location like Install does, and returns the written manifest path, target
+// browser, and manifest size. It will return error when it come across one.
+//
+//   messaging := (&host.Host{}).Init()
+//
+//   result, err := messaging.InstallWithResult()
+//   if err != nil {
+//     log.Fatalf("messaging.InstallWithResult error: %v", err)
+//   }
+//   log.Printf("installed %d bytes: %s", result.BytesWritten, result.ManifestPath)
+func (h *Host) InstallWithResult() (*InstallResult, error) {
+	if err := validateAppName(h.AppName); err != nil {
+		return nil, err
+	}
+
+	// The browser requires an absolute path on this platform.
+	if h.RelativeExec {
+		return nil, ErrRelativeExec
+	}
+
 	targetName := h.getTargetName()
 
-	if err := osMkdirAll(filepath.Dir(targetName), 0755); err != nil {
-		return err
+	manifest, err := h.installManifest(targetName)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := ioutilWriteFile(targetName, manifest, 0644); err != nil {
-		return err
+	if err := osMkdirAll(filepath.Dir(targetName), h.getManifestDirMode()); err != nil {
+		return nil, err
 	}
 
-	log.Printf("Installed: %s", targetName)
-	return nil
+	if err := h.writeManifest(targetName, manifest); err != nil {
+		return nil, err
+	}
+
+	h.logger().Printf("Installed: %s", targetName)
+
+	if h.OnInstall != nil {
+		h.OnInstall([]string{targetName})
+	}
+
+	return &InstallResult{
+		Browsers:     []Browser{h.Browser},
+		BytesWritten: len(manifest),
+		ManifestPath: targetName,
+	}, nil
+}
+
+// removeManifest removes native-messaging manifest file of configured Browser
+// and Scope, and returns the removed paths. It will return error when it come
+// across one.
+func (h *Host) removeManifest() ([]string, error) {
+	targetName := h.getTargetName()
+
+	if err := osRemove(targetName); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return []string{targetName}, nil
 }
 
-// Uninstall removes native-messaging manifest file from installed location.
+// Uninstall removes native-messaging manifest file from installed location. It
+// will return error when it come across one, otherwise it will exit gracefully.
 //
 // See https://developer.chrome.com/extensions/nativeMessaging#native-messaging-host-location-nix
-func (h *Host) Uninstall() {
+func (h *Host) Uninstall() error {
 	targetName := h.getTargetName()
 
-	if err := os.Remove(targetName); err != nil {
-		// It might never have been installed.
-		log.Print(err)
-	}
+	removed, err := h.removeManifest()
 
-	if err := os.Remove(h.ExecName); err != nil {
-		// It might be locked by current process.
-		log.Print(err)
+	if rmErr := osRemove(h.ExecName); rmErr != nil {
+		// It might be locked by current process, best effort only.
+		h.logger().Printf("%v", rmErr)
 	}
 
-	if err := os.Remove(h.ExecName + ".chk"); err != nil {
-		// It might not exist.
-		log.Print(err)
+	err = appendError(err, h.removeState())
+
+	if err != nil {
+		return err
 	}
 
-	log.Printf("Uninstalled: %s", targetName)
+	h.logger().Printf("Uninstalled: %s", targetName)
+
+	if h.OnUninstall != nil {
+		h.OnUninstall(removed)
+	}
 
 	// Exit gracefully.
 	runtimeGoexit()
+	return nil
 }
@@ -14,20 +14,75 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
 )
 
 func TestManifestTargetName(t *testing.T) {
 	t.Parallel()
 
-	got := (&Host{AppName: "app"}).getTargetName()
 	homeDir, _ := os.UserHomeDir()
-	want := homeDir +
+	system := "/Library/Google/Chrome/NativeMessagingHosts/app.json"
+	user := homeDir +
 		"/Library/Application Support/Google/Chrome/NativeMessagingHosts/app.json"
 
-	if diff := cmp.Diff(want, got); diff != "" {
-		t.Errorf("mismatch (-want +got):\n%s", diff)
+	compare := func(scope Scope, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			got := (&Host{AppName: "app", Scope: scope}).getTargetName()
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	auto := user
+	if os.Getuid() == 0 {
+		auto = system
 	}
+
+	t.Run("with auto scope", compare(AutoScope, auto))
+	t.Run("with user scope", compare(UserScope, user))
+	t.Run("with system scope", compare(SystemScope, system))
+}
+
+func TestManifestBrowserTargetName(t *testing.T) {
+	t.Parallel()
+
+	homeDir, _ := os.UserHomeDir()
+
+	compare := func(browser Browser, scope Scope, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			got := (&Host{AppName: "app", Browser: browser, Scope: scope}).getTargetName()
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with Brave system", compare(Brave, SystemScope,
+		"/Library/Application Support/BraveSoftware/Brave-Browser/NativeMessagingHosts/app.json"))
+	t.Run("with Brave user", compare(Brave, UserScope, homeDir+
+		"/Library/Application Support/BraveSoftware/Brave-Browser/NativeMessagingHosts/app.json"))
+	t.Run("with Chromium system", compare(Chromium, SystemScope,
+		"/Library/Application Support/Chromium/NativeMessagingHosts/app.json"))
+	t.Run("with Chromium user", compare(Chromium, UserScope, homeDir+
+		"/Library/Application Support/Chromium/NativeMessagingHosts/app.json"))
+	t.Run("with Edge system", compare(Edge, SystemScope,
+		"/Library/Microsoft/Edge/NativeMessagingHosts/app.json"))
+	t.Run("with Edge user", compare(Edge, UserScope, homeDir+
+		"/Library/Application Support/Microsoft Edge/NativeMessagingHosts/app.json"))
+	t.Run("with Firefox system", compare(Firefox, SystemScope,
+		"/Library/Application Support/Mozilla/NativeMessagingHosts/app.json"))
+	t.Run("with Firefox user", compare(Firefox, UserScope, homeDir+
+		"/Library/Application Support/Mozilla/NativeMessagingHosts/app.json"))
+	t.Run("with unknown browser", compare(Browser(-1), UserScope, homeDir+
+		"/Library/Application Support/Google/Chrome/NativeMessagingHosts/app.json"))
 }
 
 func TestManifestInstall(t *testing.T) {
@@ -53,11 +108,14 @@ func TestManifestInstall(t *testing.T) {
 					return errors.New("MkdirAll error")
 				}
 			case 2:
-				oldWriteFile := ioutilWriteFile
-				defer func() { ioutilWriteFile = oldWriteFile }()
-				ioutilWriteFile = func(string, []byte, os.FileMode) error {
-					return errors.New("WriteFile error")
+				oldTempFile := ioutilTempFile
+				defer func() { ioutilTempFile = oldTempFile }()
+				ioutilTempFile = func(string, string) (*os.File, error) {
+					return nil, errors.New("TempFile error")
 				}
+			case 3:
+				want.AppName = "Install"
+				targetName = want.getTargetName()
 			}
 
 			if err := want.Install(); wantErr == 0 && err != nil {
@@ -76,6 +134,12 @@ func TestManifestInstall(t *testing.T) {
 					t.Errorf("read manifest error %s: %v", targetName, err)
 				}
 
+				if content, err := want.Manifest(); err != nil {
+					t.Errorf("manifest error: %v", err)
+				} else if diff := cmp.Diff(string(content), string(manifest)); diff != "" {
+					t.Errorf("content mismatch (-want +got):\n%s", diff)
+				}
+
 				if err := json.Unmarshal(manifest, got); err != nil {
 					t.Errorf("unmarshal manifest error %s: %v", targetName, err)
 				}
@@ -90,13 +154,110 @@ func TestManifestInstall(t *testing.T) {
 	t.Run("with nothing installed", compare(0, false))
 	t.Run("with existing installed", compare(0, true))
 	t.Run("with MkdirAll error", compare(1, false))
-	t.Run("with WriteFile error", compare(2, false))
+	t.Run("with TempFile error", compare(2, false))
+	t.Run("with invalid AppName", compare(3, false))
+}
+
+func TestManifestInstallUninitialized(t *testing.T) {
+	t.Parallel()
+
+	installed := false
+	h := &Host{OnInstall: func([]string) { installed = true }}
+
+	err := h.Install()
+	if err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Fatalf("error mismatch (want: empty AppName, got: %v)", err)
+	}
+
+	if _, err := os.Stat(h.getTargetName()); !os.IsNotExist(err) {
+		t.Errorf("nameless manifest is written: %v", err)
+	}
+
+	if installed {
+		t.Error("OnInstall is called on error")
+	}
+}
+
+func TestManifestHooks(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			var installed, uninstalled []string
+			oldRuntimeGoexit := runtimeGoexit
+			defer func() { runtimeGoexit = oldRuntimeGoexit }()
+			runtimeGoexit = func() {}
+
+			h := &Host{
+				AppName:     "hooks",
+				OnInstall:   func(paths []string) { installed = paths },
+				OnUninstall: func(paths []string) { uninstalled = paths },
+			}
+			targetName := h.getTargetName()
+			want := []string{targetName}
+
+			if wantErr {
+				oldOsMkdirAll := osMkdirAll
+				oldOsRemove := osRemove
+				defer func() {
+					osMkdirAll = oldOsMkdirAll
+					osRemove = oldOsRemove
+				}()
+				osMkdirAll = func(string, os.FileMode) error {
+					return errors.New("MkdirAll error")
+				}
+				osRemove = func(string) error { return errors.New("remove error") }
+				want = nil
+			}
+
+			_ = h.Install()
+			_ = h.Uninstall()
+
+			if diff := cmp.Diff(want, installed); diff != "" {
+				t.Errorf("OnInstall mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(want, uninstalled); diff != "" {
+				t.Errorf("OnUninstall mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with success", compare(false))
+	t.Run("with error", compare(true))
+}
+
+func TestManifestInstalledAt(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	h := &Host{AppName: "installed"}
+	targetName := h.getTargetName()
+	defer func() { os.Remove(targetName) }()
+
+	if _, err := h.InstalledAt(); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("want ErrNotInstalled: %v", err)
+	}
+
+	if err := h.Install(); err != nil {
+		t.Fatalf("install error %s: %v", targetName, err)
+	}
+
+	info, err := os.Stat(targetName)
+	if err != nil {
+		t.Fatalf("missing file %s: %v", targetName, err)
+	}
+
+	if got, err := h.InstalledAt(); err != nil {
+		t.Errorf("installed at error %s: %v", targetName, err)
+	} else if !got.Equal(info.ModTime()) {
+		t.Errorf("mismatch (want: %v, got: %v)", info.ModTime(), got)
+	}
 }
 
 func TestManifestUninstall(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 
-	compare := func(h *Host) func(t *testing.T) {
+	compare := func(h *Host, wantErr bool) func(t *testing.T) {
 		return func(t *testing.T) {
 			exited := false
 			oldRuntimeGoexit := runtimeGoexit
@@ -104,7 +265,24 @@ func TestManifestUninstall(t *testing.T) {
 			runtimeGoexit = func() { exited = true }
 			targetName := h.getTargetName()
 
-			h.Uninstall()
+			if wantErr {
+				oldOsRemove := osRemove
+				defer func() { osRemove = oldOsRemove }()
+				osRemove = func(string) error { return errors.New("remove error") }
+			}
+
+			if err := h.Uninstall(); !wantErr && err != nil {
+				t.Fatalf("uninstall error %s: %v", targetName, err)
+			} else if wantErr && err == nil {
+				t.Fatalf("want error: %s", targetName)
+			}
+
+			if wantErr {
+				if exited {
+					t.Errorf("uninstall should not exit")
+				}
+				return
+			}
 
 			if _, err := os.Stat(targetName); err == nil {
 				t.Errorf("uninstall failed %s", targetName)
@@ -118,11 +296,256 @@ func TestManifestUninstall(t *testing.T) {
 
 	h := &Host{AppName: "uninstall"}
 
-	t.Run("with nothing installed", compare(h))
+	t.Run("with nothing installed", compare(h, false))
 
 	if err := h.Install(); err != nil {
 		t.Errorf("install error %s: %v", h.getTargetName(), err)
 	}
 
-	t.Run("with installed", compare(h))
+	t.Run("with remove error", compare(h, true))
+	t.Run("with installed", compare(h, false))
+}
+
+func TestManifestUninstallFor(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(failing Browser, wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			removed := []string{}
+			h := &Host{AppName: "uninstallfor", OnUninstall: func(names []string) { removed = names }}
+			browsers := []Browser{Chrome, Edge, Firefox}
+
+			targetNames := map[Browser]string{}
+			for _, browser := range browsers {
+				target := *h
+				target.Browser = browser
+				if err := target.Install(); err != nil {
+					t.Fatalf("install error %s: %v", browser, err)
+				}
+				targetNames[browser] = target.getTargetName()
+				defer os.Remove(targetNames[browser])
+			}
+
+			if wantErr {
+				oldOsRemove := osRemove
+				defer func() { osRemove = oldOsRemove }()
+				osRemove = func(name string) error {
+					if name == targetNames[failing] {
+						return errors.New("remove error")
+					}
+					return oldOsRemove(name)
+				}
+			}
+
+			err := h.UninstallFor(browsers...)
+			if !wantErr && err != nil {
+				t.Fatalf("uninstall error: %v", err)
+			} else if wantErr && (err == nil || !strings.HasPrefix(err.Error(), failing.String()+":")) {
+				t.Fatalf("want %s error: %v", failing, err)
+			}
+
+			for _, browser := range browsers {
+				_, statErr := os.Stat(targetNames[browser])
+				if kept := wantErr && browser == failing; kept != (statErr == nil) {
+					t.Errorf("%s manifest mismatch (want kept: %t, got: %v)", browser, kept, statErr)
+				}
+			}
+
+			want := []string{}
+			if !wantErr {
+				want = []string{targetNames[Chrome], targetNames[Edge], targetNames[Firefox]}
+			}
+			if diff := cmp.Diff(want, removed); diff != "" {
+				t.Errorf("removed mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with every browser installed", compare(Chrome, false))
+	t.Run("with remove error on one browser", compare(Edge, true))
+}
+
+func TestManifestManifestPath(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(h *Host, wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			written := ""
+			oldOsMkdirAll := osMkdirAll
+			oldOsRename := osRename
+			oldTempFile := ioutilTempFile
+			defer func() {
+				osMkdirAll = oldOsMkdirAll
+				osRename = oldOsRename
+				ioutilTempFile = oldTempFile
+			}()
+			osMkdirAll = func(string, os.FileMode) error { return nil }
+			osRename = func(tmpName, name string) error {
+				written = name
+				return os.Remove(tmpName)
+			}
+			ioutilTempFile = func(_, pattern string) (*os.File, error) { return ioutil.TempFile("testdata", pattern) }
+
+			got, err := h.ManifestPath()
+			if wantErr != (err != nil) {
+				t.Fatalf("error mismatch (want: %t, got: %v)", wantErr, err)
+			}
+
+			if err := h.Install(); wantErr != (err != nil) {
+				t.Fatalf("install error mismatch (want: %t, got: %v)", wantErr, err)
+			}
+
+			if got != written {
+				t.Errorf("mismatch (want: %q, got: %q)", written, got)
+			}
+		}
+	}
+
+	t.Run("with user scope", compare(&Host{AppName: "path", Scope: UserScope}, false))
+	t.Run("with system scope", compare(&Host{AppName: "path", Scope: SystemScope}, false))
+	t.Run("with Firefox", compare(&Host{AppName: "path", Browser: Firefox}, false))
+	t.Run("with invalid AppName", compare(&Host{AppName: "Path"}, true))
+}
+
+func TestManifestVerifyInstall(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	h := &Host{AllowedExts: []string{"chrome-extension://XXX/"}, AppName: "verify", ExecName: "/opt/verify"}
+	targetName := h.getTargetName()
+	defer func() { os.Remove(targetName) }()
+
+	compare := func(key string, value interface{}, wantErr error) func(t *testing.T) {
+		return func(t *testing.T) {
+			if err := h.Install(); err != nil {
+				t.Fatalf("install error %s: %v", targetName, err)
+			}
+
+			if key != "" {
+				manifest := H{}
+				content, _ := ioutil.ReadFile(targetName)
+				_ = json.Unmarshal(content, &manifest)
+				manifest[key] = value
+				content, _ = json.Marshal(manifest)
+
+				if err := ioutil.WriteFile(targetName, content, 0644); err != nil {
+					t.Fatalf("tamper error %s: %v", targetName, err)
+				}
+			}
+
+			if err := h.VerifyInstall(); !errors.Is(err, wantErr) {
+				t.Errorf("error mismatch (want: %v, got: %v)", wantErr, err)
+			}
+		}
+	}
+
+	t.Run("with good install", compare("", nil, nil))
+	t.Run("with tampered path", compare("path", "/tmp/evil", ErrInvalidManifest))
+	t.Run("with tampered name", compare("name", "other", ErrInvalidManifest))
+	t.Run("with no allowed origins", compare("allowed_origins", []string{}, ErrInvalidManifest))
+	t.Run("with malformed path", compare("path", 1, ErrInvalidManifest))
+
+	os.Remove(targetName)
+
+	if err := h.VerifyInstall(); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("want ErrNotInstalled: %v", err)
+	}
+}
+
+func TestManifestFileMode(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	h := &Host{AppName: "mode"}
+	targetName := h.getTargetName()
+	defer func() { os.Remove(targetName) }()
+
+	compare := func(dirMode, fileMode, wantDir, wantFile os.FileMode) func(t *testing.T) {
+		return func(t *testing.T) {
+			var gotDir os.FileMode
+			oldOsMkdirAll := osMkdirAll
+			defer func() { osMkdirAll = oldOsMkdirAll }()
+			osMkdirAll = func(name string, perm os.FileMode) error {
+				gotDir = perm
+				return oldOsMkdirAll(name, perm)
+			}
+
+			h.ManifestDirMode = dirMode
+			h.ManifestFileMode = fileMode
+
+			if err := h.Install(); err != nil {
+				t.Fatalf("install error %s: %v", targetName, err)
+			}
+
+			info, err := os.Stat(targetName)
+			if err != nil {
+				t.Fatalf("missing file %s: %v", targetName, err)
+			}
+
+			if gotDir != wantDir || info.Mode().Perm() != wantFile {
+				t.Errorf("mismatch (want: %v %v, got: %v %v)", wantDir, wantFile, gotDir, info.Mode().Perm())
+			}
+		}
+	}
+
+	t.Run("with explicit modes", compare(0700, 0600, 0700, 0600))
+	t.Run("with explicit modes on existing file", compare(0750, 0640, 0750, 0640))
+	// The manifest is replaced as a whole, so the default file mode applies too.
+	t.Run("with default modes", compare(0, 0, 0755, 0644))
+}
+
+func TestManifestRelativeExec(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	h := &Host{AppName: "relative", ExecName: "/opt/relative/bin", RelativeExec: true}
+	targetName := h.getTargetName()
+	defer func() { os.Remove(targetName) }()
+
+	if err := h.Install(); !errors.Is(err, ErrRelativeExec) {
+		t.Errorf("error mismatch (want: %v, got: %v)", ErrRelativeExec, err)
+	}
+
+	if _, err := os.Stat(targetName); !os.IsNotExist(err) {
+		t.Errorf("manifest is written: %v", err)
+	}
+}
+
+func TestManifestInstallWithResult(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(h *Host, wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			targetName := h.getTargetName()
+			defer func() { os.Remove(targetName) }()
+
+			got, err := h.InstallWithResult()
+			if wantErr {
+				if err == nil || got != nil {
+					t.Fatalf("want error with no result (got: %v, %v)", got, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("install error %s: %v", targetName, err)
+			}
+
+			info, err := os.Stat(targetName)
+			if err != nil {
+				t.Fatalf("missing file %s: %v", targetName, err)
+			}
+
+			want := &InstallResult{
+				Browsers:     []Browser{h.Browser},
+				BytesWritten: int(info.Size()),
+				ManifestPath: targetName,
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with Chrome", compare(&Host{AppName: "result"}, false))
+	t.Run("with Firefox", compare(&Host{AppName: "result", Browser: Firefox}, false))
+	t.Run("with invalid AppName", compare(&Host{AppName: "Result"}, true))
 }
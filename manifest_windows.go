@@ -8,80 +8,252 @@
 package host
 
 import (
-	"encoding/json"
+	"fmt"
 	"golang.org/x/sys/windows/registry"
-	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// registryClose is a shortcut to registry.Key.Close. It helps write testable
+// code.
+var registryClose = registry.Key.Close
+
+// registryCreateKey is a shortcut to registry.CreateKey. It helps write
+// testable code.
+var registryCreateKey = registry.CreateKey
+
+// registryDeleteValue is a shortcut to registry.Key.DeleteValue. It helps
+// write testable code.
+var registryDeleteValue = registry.Key.DeleteValue
+
+// registryGetStringValue is a shortcut to registry.Key.GetStringValue. It helps
+// write testable code.
+var registryGetStringValue = registry.Key.GetStringValue
+
+// registryOpenKey is a shortcut to registry.OpenKey. It helps write testable
+// code.
+var registryOpenKey = registry.OpenKey
+
+// registrySetStringValue is a shortcut to registry.Key.SetStringValue. It helps
+// write testable code.
+var registrySetStringValue = registry.Key.SetStringValue
+
+// browserKeys are the windows registry paths of each target browser without
+// root key.
+var browserKeys = map[Browser]string{
+	Brave:    `Software\BraveSoftware\Brave-Browser\NativeMessagingHosts`,
+	Chrome:   `Software\Google\Chrome\NativeMessagingHosts`,
+	Chromium: `Software\Chromium\NativeMessagingHosts`,
+	Edge:     `Software\Microsoft\Edge\NativeMessagingHosts`,
+	Firefox:  `Software\Mozilla\NativeMessagingHosts`,
+}
+
+// getBrowserKey returns windows registry path of configured Browser without
+// root key.
+func (h *Host) getBrowserKey() string {
+	if key, ok := browserKeys[h.Browser]; ok {
+		return key
+	}
+	return browserKeys[Chrome]
+}
+
+// getRegistryName returns windows registry path of native messaging host of
+// configured Browser without root key.
+func (h *Host) getRegistryName() string {
+	return h.getBrowserKey() + `\` + h.AppName
+}
+
+// getRegistryRoot returns windows registry root key of configured Scope and its
+// abbreviation.
+func (h *Host) getRegistryRoot() (registry.Key, string) {
+	if h.isSystemWide() {
+		return registry.LOCAL_MACHINE, "HKLM"
+	}
+	return registry.CURRENT_USER, "HKCU"
+}
+
+// getTargetName returns an absolute path to native messaging host manifest
+// location of configured Browser and Scope. The system-wide manifest is located
+// under ProgramData, otherwise it is next to the executable.
+func (h *Host) getTargetName() string {
+	target := filepath.Dir(h.ExecName)
+
+	if programData := os.Getenv("ProgramData"); h.isSystemWide() && programData != "" {
+		target = filepath.Join(programData, strings.TrimPrefix(h.getBrowserKey(), `Software\`))
+	}
+
+	return filepath.Join(target, h.AppName+".json")
+}
+
+// getInstalledName returns an absolute path to installed native messaging host
+// manifest that is pointed by windows registry. It will return ErrNotInstalled
+// when the registry entry is absent.
+func (h *Host) getInstalledName() (string, error) {
+	registryName := h.getRegistryName()
+	root, rootName := h.getRegistryRoot()
+
+	key, err := registryOpenKey(root, registryName, registry.QUERY_VALUE)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf(`%s\%s: %w`, rootName, registryName, ErrNotInstalled)
+		}
+		return "", err
+	}
+	defer registryClose(key)
+
+	name, _, err := registryGetStringValue(key, "")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf(`%s\%s: %w`, rootName, registryName, ErrNotInstalled)
+		}
+		return "", err
+	}
+
+	return name, nil
+}
+
 // Install creates native-messaging manifest file on appropriate location and
-// add an entry in windows registry. It will return error when it come across
-// one.
+// add an entry in windows registry. The HKEY_LOCAL_MACHINE is used on
+// system-wide Scope, otherwise HKEY_CURRENT_USER. It will return error when it
+// come across one.
 //
 // See https://developer.chrome.com/extensions/nativeMessaging#native-messaging-host-location
 func (h *Host) Install() error {
-	manifest, _ := json.MarshalIndent(h, "", "  ")
-	registryName := `Software\Google\Chrome\NativeMessagingHosts\` + h.AppName
-	targetName := filepath.Join(filepath.Dir(h.ExecName), h.AppName+".json")
+	_, err := h.InstallWithResult()
+	return err
+}
 
-	if err := ioutilWriteFile(targetName, manifest, 0644); err != nil {
-		return err
+// InstallWithResult creates native-messaging manifest file on appropriate
+// location and add an entry in windows registry like Install does, and returns
+// the written manifest path, registry entry, target browser, and manifest size.
+// It will return error when it come across one.
+//
+//   messaging := (&host.Host{}).Init()
+//
+//   result, err := messaging.InstallWithResult()
+//   if err != nil {
+//     log.Fatalf("messaging.InstallWithResult error: %v", err)
+//   }
+//   log.Printf("installed %d bytes: %s", result.BytesWritten, result.RegistryKey)
+func (h *Host) InstallWithResult() (*InstallResult, error) {
+	if err := validateAppName(h.AppName); err != nil {
+		return nil, err
+	}
+
+	registryName := h.getRegistryName()
+	targetName := h.getTargetName()
+	root, rootName := h.getRegistryRoot()
+
+	manifest, err := h.installManifest(targetName)
+	if err != nil {
+		return nil, err
+	}
+
+	// The modes are ignored on Windows, other than the read-only attribute.
+	if err := osMkdirAll(filepath.Dir(targetName), h.getManifestDirMode()); err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(targetName, manifest, h.getManifestFileMode(), false); err != nil {
+		return nil, err
 	}
 
 	// CreateKey creates a key named path under open key k. CreateKey returns the
 	// new key and a boolean flag that reports whether the key already existed.
-	key, _, err := registry.CreateKey(registry.CURRENT_USER, registryName, registry.SET_VALUE)
+	key, _, err := registryCreateKey(root, registryName, registry.SET_VALUE)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer key.Close()
+	defer registryClose(key)
 
-	if err := key.SetStringValue("", targetName); err != nil {
-		return err
+	if err := registrySetStringValue(key, "", targetName); err != nil {
+		return nil, err
 	}
 
-	log.Printf(`Installed: HKCU\%s`, registryName)
-	return nil
+	h.logger().Printf(`Installed: %s\%s`, rootName, registryName)
+
+	if h.OnInstall != nil {
+		h.OnInstall([]string{targetName, rootName + `\` + registryName})
+	}
+
+	return &InstallResult{
+		Browsers:     []Browser{h.Browser},
+		BytesWritten: len(manifest),
+		ManifestPath: targetName,
+		RegistryKey:  rootName + `\` + registryName,
+	}, nil
 }
 
-// Uninstall removes entry from windows registry and removes native-messaging
-// manifest file from installed location.
-//
-// See https://developer.chrome.com/extensions/nativeMessaging#native-messaging-host-location
-func (h *Host) Uninstall() {
-	registryName := `Software\Google\Chrome\NativeMessagingHosts\` + h.AppName
-	targetName := filepath.Join(filepath.Dir(h.ExecName), h.AppName+".json")
+// removeManifest removes entry from windows registry of configured Browser and
+// Scope and removes native-messaging manifest file pointed by it, otherwise
+// from the default location, and returns the removed paths. It will return
+// error when it come across one.
+func (h *Host) removeManifest() ([]string, error) {
+	registryName := h.getRegistryName()
+	targetName := h.getTargetName()
+	root, rootName := h.getRegistryRoot()
 
-	key, err := registry.OpenKey(registry.CURRENT_USER, registryName, registry.SET_VALUE)
-	if err != nil {
-		// Unable to open windows registry.
-		log.Print(err)
+	// The manifest might have been installed on other location.
+	if installedName, err := h.getInstalledName(); err == nil && installedName != "" {
+		targetName = installedName
 	}
-	defer key.Close()
 
-	if err := key.DeleteValue(""); err != nil {
+	var err error
+
+	if key, keyErr := registryOpenKey(root, registryName, registry.SET_VALUE); keyErr != nil {
 		// It might never have been installed.
-		log.Print(err)
+		if !os.IsNotExist(keyErr) {
+			err = appendError(err, keyErr)
+		}
+	} else {
+		if delErr := registryDeleteValue(key, ""); delErr != nil && !os.IsNotExist(delErr) {
+			err = appendError(err, delErr)
+		}
+		registryClose(key)
 	}
 
-	if err := os.Remove(targetName); err != nil {
-		// It might never have been installed.
-		log.Print(err)
+	if rmErr := osRemove(targetName); rmErr != nil && !os.IsNotExist(rmErr) {
+		err = appendError(err, rmErr)
 	}
 
-	if err := os.Remove(h.ExecName); err != nil {
-		// It might be locked by current process.
-		log.Print(err)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := os.Remove(h.ExecName + ".chk"); err != nil {
-		// It might not exist.
-		log.Print(err)
+	return []string{targetName, rootName + `\` + registryName}, nil
+}
+
+// Uninstall removes entry from windows registry of configured Scope and removes
+// native-messaging manifest file pointed by it, otherwise from the default
+// location. It will return error when it come across one, otherwise it will
+// exit gracefully.
+//
+// See https://developer.chrome.com/extensions/nativeMessaging#native-messaging-host-location
+func (h *Host) Uninstall() error {
+	registryName := h.getRegistryName()
+	_, rootName := h.getRegistryRoot()
+
+	removed, err := h.removeManifest()
+
+	if rmErr := osRemove(h.ExecName); rmErr != nil {
+		// It might be locked by current process, best effort only.
+		h.logger().Printf("%v", rmErr)
 	}
 
-	log.Printf(`Uninstalled: HKCU\%s`, registryName)
+	err = appendError(err, h.removeState())
+
+	if err != nil {
+		return err
+	}
+
+	h.logger().Printf(`Uninstalled: %s\%s`, rootName, registryName)
+
+	if h.OnUninstall != nil {
+		h.OnUninstall(removed)
+	}
 
 	// Exit gracefully.
 	runtimeGoexit()
+	return nil
 }
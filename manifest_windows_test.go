@@ -0,0 +1,522 @@
+// manifest_windows_test.go - Test for manifest related functionality on Windows.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/windows/registry"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifestRegistryRoot(t *testing.T) {
+	t.Parallel()
+
+	compare := func(scope Scope, wantKey registry.Key, wantName string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			key, name := (&Host{AppName: "app", Scope: scope}).getRegistryRoot()
+			if key != wantKey || name != wantName {
+				t.Errorf("mismatch (want: %s, got: %s)", wantName, name)
+			}
+		}
+	}
+
+	t.Run("with auto scope", compare(AutoScope, registry.CURRENT_USER, "HKCU"))
+	t.Run("with user scope", compare(UserScope, registry.CURRENT_USER, "HKCU"))
+	t.Run("with system scope", compare(SystemScope, registry.LOCAL_MACHINE, "HKLM"))
+}
+
+func TestManifestTargetName(t *testing.T) {
+	t.Parallel()
+
+	execName := `C:\Program Files\App\app.exe`
+	system := `C:\Program Files\App\app.json`
+	if programData := os.Getenv("ProgramData"); programData != "" {
+		system = filepath.Join(programData, "Google", "Chrome", "NativeMessagingHosts", "app.json")
+	}
+
+	compare := func(scope Scope, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			got := (&Host{AppName: "app", ExecName: execName, Scope: scope}).getTargetName()
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with auto scope", compare(AutoScope, `C:\Program Files\App\app.json`))
+	t.Run("with user scope", compare(UserScope, `C:\Program Files\App\app.json`))
+	t.Run("with system scope", compare(SystemScope, system))
+}
+
+func TestManifestRegistryName(t *testing.T) {
+	t.Parallel()
+
+	compare := func(browser Browser, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			got := (&Host{AppName: "app", Browser: browser}).getRegistryName()
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with Brave", compare(Brave, `Software\BraveSoftware\Brave-Browser\NativeMessagingHosts\app`))
+	t.Run("with Chrome", compare(Chrome, `Software\Google\Chrome\NativeMessagingHosts\app`))
+	t.Run("with Chromium", compare(Chromium, `Software\Chromium\NativeMessagingHosts\app`))
+	t.Run("with Edge", compare(Edge, `Software\Microsoft\Edge\NativeMessagingHosts\app`))
+	t.Run("with Firefox", compare(Firefox, `Software\Mozilla\NativeMessagingHosts\app`))
+	t.Run("with unknown browser", compare(Browser(-1), `Software\Google\Chrome\NativeMessagingHosts\app`))
+}
+
+func TestManifestRegistryHive(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(scope Scope, want registry.Key) func(t *testing.T) {
+		return func(t *testing.T) {
+			created := []registry.Key{}
+			opened := []registry.Key{}
+			removed := []string{}
+			values := map[registry.Key]string{}
+
+			oldRegistryClose := registryClose
+			oldRegistryCreateKey := registryCreateKey
+			oldRegistryDeleteValue := registryDeleteValue
+			oldRegistryGetStringValue := registryGetStringValue
+			oldRegistryOpenKey := registryOpenKey
+			oldRegistrySetStringValue := registrySetStringValue
+			oldIoutilTempFile := ioutilTempFile
+			oldOsMkdirAll := osMkdirAll
+			oldOsRemove := osRemove
+			oldOsRename := osRename
+			oldRuntimeGoexit := runtimeGoexit
+			defer func() {
+				registryClose = oldRegistryClose
+				registryCreateKey = oldRegistryCreateKey
+				registryDeleteValue = oldRegistryDeleteValue
+				registryGetStringValue = oldRegistryGetStringValue
+				registryOpenKey = oldRegistryOpenKey
+				registrySetStringValue = oldRegistrySetStringValue
+				ioutilTempFile = oldIoutilTempFile
+				osMkdirAll = oldOsMkdirAll
+				osRemove = oldOsRemove
+				osRename = oldOsRename
+				runtimeGoexit = oldRuntimeGoexit
+			}()
+
+			registryClose = func(registry.Key) error { return nil }
+			registryCreateKey = func(k registry.Key, path string, access uint32) (registry.Key, bool, error) {
+				created = append(created, k)
+				return k, false, nil
+			}
+			registryDeleteValue = func(k registry.Key, name string) error {
+				delete(values, k)
+				return nil
+			}
+			registryGetStringValue = func(k registry.Key, name string) (string, uint32, error) {
+				if value, ok := values[k]; ok {
+					return value, registry.SZ, nil
+				}
+				return "", 0, registry.ErrNotExist
+			}
+			registryOpenKey = func(k registry.Key, path string, access uint32) (registry.Key, error) {
+				opened = append(opened, k)
+				return k, nil
+			}
+			registrySetStringValue = func(k registry.Key, name, value string) error {
+				values[k] = value
+				return nil
+			}
+			ioutilTempFile = func(_, pattern string) (*os.File, error) { return ioutil.TempFile("testdata", pattern) }
+			osMkdirAll = func(string, os.FileMode) error { return nil }
+			osRename = func(tmpName, _ string) error { return os.Remove(tmpName) }
+			osRemove = func(name string) error {
+				removed = append(removed, name)
+				return nil
+			}
+			runtimeGoexit = func() {}
+
+			h := &Host{AppName: "hive", ExecName: `C:\Program Files\App\hive.exe`, Scope: scope}
+			result, err := h.InstallWithResult()
+			if err != nil {
+				t.Fatalf("install error: %v", err)
+			}
+
+			_, rootName := h.getRegistryRoot()
+			manifest, _ := h.Manifest()
+			wantResult := &InstallResult{
+				Browsers:     []Browser{Chrome},
+				BytesWritten: len(manifest),
+				ManifestPath: h.getTargetName(),
+				RegistryKey:  rootName + `\` + h.getRegistryName(),
+			}
+
+			if diff := cmp.Diff(wantResult, result); diff != "" {
+				t.Errorf("result mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff([]registry.Key{want}, created); diff != "" {
+				t.Errorf("created mismatch (-want +got):\n%s", diff)
+			}
+
+			if values[want] != h.getTargetName() {
+				t.Errorf("manifest mismatch: %s", values[want])
+			}
+
+			if err := h.Uninstall(); err != nil {
+				t.Fatalf("uninstall error: %v", err)
+			}
+
+			if diff := cmp.Diff([]registry.Key{want, want}, opened); diff != "" {
+				t.Errorf("opened mismatch (-want +got):\n%s", diff)
+			}
+
+			if len(values) != 0 {
+				t.Errorf("registry value is not deleted: %v", values)
+			}
+
+			if len(removed) == 0 || removed[0] != h.getTargetName() {
+				t.Errorf("removed mismatch: %v", removed)
+			}
+		}
+	}
+
+	t.Run("with auto scope", compare(AutoScope, registry.CURRENT_USER))
+	t.Run("with user scope", compare(UserScope, registry.CURRENT_USER))
+	t.Run("with system scope", compare(SystemScope, registry.LOCAL_MACHINE))
+}
+
+func TestManifestInstallUninitialized(t *testing.T) {
+	t.Parallel()
+
+	installed := false
+	h := &Host{OnInstall: func([]string) { installed = true }}
+
+	err := h.Install()
+	if err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Fatalf("error mismatch (want: empty AppName, got: %v)", err)
+	}
+
+	if _, err := os.Stat(h.getTargetName()); !os.IsNotExist(err) {
+		t.Errorf("nameless manifest is written: %v", err)
+	}
+
+	if installed {
+		t.Error("OnInstall is called on error")
+	}
+}
+
+func TestManifestUninstall(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(h *Host) func(t *testing.T) {
+		return func(t *testing.T) {
+			exited := false
+			oldOsRemove := osRemove
+			oldRuntimeGoexit := runtimeGoexit
+			defer func() {
+				osRemove = oldOsRemove
+				runtimeGoexit = oldRuntimeGoexit
+			}()
+			osRemove = func(string) error { return errors.New("remove error") }
+			runtimeGoexit = func() { exited = true }
+
+			if err := h.Uninstall(); err == nil {
+				t.Fatalf("want error: %s", h.AppName)
+			}
+
+			if exited {
+				t.Errorf("uninstall should not exit")
+			}
+		}
+	}
+
+	t.Run("with remove error", compare(&Host{AppName: "uninstall"}))
+}
+
+func TestManifestUninstallFor(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	oldRegistryClose := registryClose
+	oldRegistryDeleteValue := registryDeleteValue
+	oldRegistryGetStringValue := registryGetStringValue
+	oldRegistryOpenKey := registryOpenKey
+	oldOsRemove := osRemove
+	defer func() {
+		registryClose = oldRegistryClose
+		registryDeleteValue = oldRegistryDeleteValue
+		registryGetStringValue = oldRegistryGetStringValue
+		registryOpenKey = oldRegistryOpenKey
+		osRemove = oldOsRemove
+	}()
+
+	compare := func(failing string, want []string) func(t *testing.T) {
+		return func(t *testing.T) {
+			deleted := []string{}
+			opened := registry.Key(0)
+			paths := map[registry.Key]string{}
+			removed := []string{}
+
+			registryClose = func(registry.Key) error { return nil }
+			registryDeleteValue = func(k registry.Key, name string) error {
+				deleted = append(deleted, paths[k])
+				return nil
+			}
+			registryGetStringValue = func(registry.Key, string) (string, uint32, error) {
+				return "", 0, registry.ErrNotExist
+			}
+			registryOpenKey = func(k registry.Key, path string, access uint32) (registry.Key, error) {
+				opened++
+				paths[opened] = path
+				return opened, nil
+			}
+			osRemove = func(name string) error {
+				if filepath.Base(filepath.Dir(name)) == failing {
+					return errors.New("remove error")
+				}
+				removed = append(removed, name)
+				return nil
+			}
+
+			h := &Host{AppName: "uninstallfor", ExecName: `C:\Program Files\App\uninstallfor.exe`}
+			err := h.UninstallFor(Chrome, Edge, Firefox)
+			if failing == "" && err != nil {
+				t.Fatalf("uninstall error: %v", err)
+			} else if failing != "" && err == nil {
+				t.Fatal("want error")
+			}
+
+			if diff := cmp.Diff([]string{
+				`Software\Google\Chrome\NativeMessagingHosts\uninstallfor`,
+				`Software\Microsoft\Edge\NativeMessagingHosts\uninstallfor`,
+				`Software\Mozilla\NativeMessagingHosts\uninstallfor`,
+			}, deleted); diff != "" {
+				t.Errorf("deleted mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(want, removed); diff != "" {
+				t.Errorf("removed mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	manifest := `C:\Program Files\App\uninstallfor.json`
+	t.Run("with every browser installed", compare("", []string{manifest, manifest, manifest}))
+	t.Run("with remove error", compare("App", []string{}))
+}
+
+func TestManifestManifestPath(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(h *Host, wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			registered := ""
+			written := ""
+			oldRegistryClose := registryClose
+			oldRegistryCreateKey := registryCreateKey
+			oldRegistrySetStringValue := registrySetStringValue
+			oldOsMkdirAll := osMkdirAll
+			oldOsRename := osRename
+			oldTempFile := ioutilTempFile
+			defer func() {
+				registryClose = oldRegistryClose
+				registryCreateKey = oldRegistryCreateKey
+				registrySetStringValue = oldRegistrySetStringValue
+				osMkdirAll = oldOsMkdirAll
+				osRename = oldOsRename
+				ioutilTempFile = oldTempFile
+			}()
+			registryClose = func(registry.Key) error { return nil }
+			registryCreateKey = func(k registry.Key, path string, access uint32) (registry.Key, bool, error) {
+				return k, false, nil
+			}
+			registrySetStringValue = func(k registry.Key, name, value string) error {
+				registered = value
+				return nil
+			}
+			osMkdirAll = func(string, os.FileMode) error { return nil }
+			osRename = func(tmpName, name string) error {
+				written = name
+				return os.Remove(tmpName)
+			}
+			ioutilTempFile = func(_, pattern string) (*os.File, error) { return ioutil.TempFile("testdata", pattern) }
+
+			got, err := h.ManifestPath()
+			if wantErr != (err != nil) {
+				t.Fatalf("error mismatch (want: %t, got: %v)", wantErr, err)
+			}
+
+			if err := h.Install(); wantErr != (err != nil) {
+				t.Fatalf("install error mismatch (want: %t, got: %v)", wantErr, err)
+			}
+
+			if got != written || got != registered {
+				t.Errorf("mismatch (want: %q %q, got: %q)", written, registered, got)
+			}
+		}
+	}
+
+	execName := `C:\Program Files\App\path.exe`
+
+	t.Run("with user scope", compare(&Host{AppName: "path", ExecName: execName, Scope: UserScope}, false))
+	t.Run("with system scope", compare(&Host{AppName: "path", ExecName: execName, Scope: SystemScope}, false))
+	t.Run("with invalid AppName", compare(&Host{AppName: "Path", ExecName: execName}, true))
+}
+
+func TestManifestVerifyInstall(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	execName, _ := filepath.Abs(`testdata\verify.exe`)
+	h := &Host{AllowedExts: []string{"chrome-extension://XXX/"}, AppName: "verify", ExecName: execName,
+		Scope: UserScope}
+	targetName := h.getTargetName()
+	registered := ""
+
+	oldRegistryClose := registryClose
+	oldRegistryCreateKey := registryCreateKey
+	oldRegistryGetStringValue := registryGetStringValue
+	oldRegistryOpenKey := registryOpenKey
+	oldRegistrySetStringValue := registrySetStringValue
+	defer func() {
+		registryClose = oldRegistryClose
+		registryCreateKey = oldRegistryCreateKey
+		registryGetStringValue = oldRegistryGetStringValue
+		registryOpenKey = oldRegistryOpenKey
+		registrySetStringValue = oldRegistrySetStringValue
+		os.Remove(targetName)
+	}()
+
+	registryClose = func(registry.Key) error { return nil }
+	registryCreateKey = func(k registry.Key, path string, access uint32) (registry.Key, bool, error) {
+		return k, false, nil
+	}
+	registryGetStringValue = func(k registry.Key, name string) (string, uint32, error) {
+		if registered == "" {
+			return "", 0, registry.ErrNotExist
+		}
+		return registered, registry.SZ, nil
+	}
+	registryOpenKey = func(k registry.Key, path string, access uint32) (registry.Key, error) {
+		return k, nil
+	}
+	registrySetStringValue = func(k registry.Key, name, value string) error {
+		registered = value
+		return nil
+	}
+
+	if err := h.VerifyInstall(); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("want ErrNotInstalled: %v", err)
+	}
+
+	compare := func(key string, value interface{}, wantErr error) func(t *testing.T) {
+		return func(t *testing.T) {
+			if err := h.Install(); err != nil {
+				t.Fatalf("install error %s: %v", targetName, err)
+			}
+
+			if key != "" {
+				manifest := H{}
+				content, _ := ioutil.ReadFile(targetName)
+				_ = json.Unmarshal(content, &manifest)
+				manifest[key] = value
+				content, _ = json.Marshal(manifest)
+
+				if err := ioutil.WriteFile(targetName, content, 0644); err != nil {
+					t.Fatalf("tamper error %s: %v", targetName, err)
+				}
+			}
+
+			if err := h.VerifyInstall(); !errors.Is(err, wantErr) {
+				t.Errorf("error mismatch (want: %v, got: %v)", wantErr, err)
+			}
+		}
+	}
+
+	t.Run("with good install", compare("", nil, nil))
+	t.Run("with tampered path", compare("path", `C:\evil.exe`, ErrInvalidManifest))
+	t.Run("with no allowed origins", compare("allowed_origins", []string{}, ErrInvalidManifest))
+
+	// The registry points at a missing manifest.
+	os.Remove(targetName)
+
+	if err := h.VerifyInstall(); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("want ErrNotInstalled: %v", err)
+	}
+}
+
+func TestManifestRelativeExec(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	execName, _ := filepath.Abs(`testdata\relative.exe`)
+	h := &Host{AllowedExts: []string{"chrome-extension://XXX/"}, AppName: "relative", ExecName: execName,
+		RelativeExec: true, Scope: UserScope}
+	targetName := h.getTargetName()
+	registered := ""
+
+	oldRegistryClose := registryClose
+	oldRegistryCreateKey := registryCreateKey
+	oldRegistryGetStringValue := registryGetStringValue
+	oldRegistryOpenKey := registryOpenKey
+	oldRegistrySetStringValue := registrySetStringValue
+	defer func() {
+		registryClose = oldRegistryClose
+		registryCreateKey = oldRegistryCreateKey
+		registryGetStringValue = oldRegistryGetStringValue
+		registryOpenKey = oldRegistryOpenKey
+		registrySetStringValue = oldRegistrySetStringValue
+		os.Remove(targetName)
+	}()
+
+	registryClose = func(registry.Key) error { return nil }
+	registryCreateKey = func(k registry.Key, path string, access uint32) (registry.Key, bool, error) {
+		return k, false, nil
+	}
+	registryGetStringValue = func(k registry.Key, name string) (string, uint32, error) {
+		return registered, registry.SZ, nil
+	}
+	registryOpenKey = func(k registry.Key, path string, access uint32) (registry.Key, error) {
+		return k, nil
+	}
+	registrySetStringValue = func(k registry.Key, name, value string) error {
+		registered = value
+		return nil
+	}
+
+	if err := h.Install(); err != nil {
+		t.Fatalf("install error %s: %v", targetName, err)
+	}
+
+	manifest := &installedManifest{}
+	content, _ := ioutil.ReadFile(targetName)
+	if err := json.Unmarshal(content, manifest); err != nil {
+		t.Fatalf("unmarshal manifest error %s: %v", targetName, err)
+	}
+
+	// The manifest is next to the executable on user scope.
+	if manifest.ExecName != "relative.exe" {
+		t.Errorf("path mismatch (want: relative.exe, got: %s)", manifest.ExecName)
+	}
+
+	if err := h.VerifyInstall(); err != nil {
+		t.Errorf("verify error: %v", err)
+	}
+}
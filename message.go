@@ -0,0 +1,79 @@
+// message.go - Framed message reader and writer.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// MessageReader reads framed messages from the underlying reader with native
+// byte order and JSON body, without a configured Host.
+type MessageReader struct {
+	host   *Host
+	reader io.Reader
+}
+
+// MessageWriter writes framed messages to the underlying writer with native
+// byte order and JSON body, without a configured Host.
+type MessageWriter struct {
+	host   *Host
+	writer io.Writer
+}
+
+// NewMessageReader returns a reader of framed messages on given reader, i.e.:
+// the other end of MessageWriter.
+//
+//   reader := host.NewMessageReader(os.Stdin)
+//
+//   request := &host.H{}
+//   if err := reader.ReadMessage(request); err != nil {
+//     log.Fatalf("reader.ReadMessage error: %v", err)
+//   }
+func NewMessageReader(r io.Reader) *MessageReader {
+	return &MessageReader{host: &Host{ByteOrder: nativeByteOrder}, reader: r}
+}
+
+// NewMessageWriter returns a writer of framed messages on given writer, which
+// is the same framing as PostMessage.
+//
+//   writer := host.NewMessageWriter(os.Stdout)
+//
+//   if err := writer.WriteMessage(&host.H{"key": "value"}); err != nil {
+//     log.Fatalf("writer.WriteMessage error: %v", err)
+//   }
+func NewMessageWriter(w io.Writer) *MessageWriter {
+	return &MessageWriter{host: &Host{ByteOrder: nativeByteOrder}, writer: w}
+}
+
+// ReadMessage reads a framed message and unmarshals it into given struct. It
+// returns io.EOF when the underlying reader has no more message, instead of
+// exiting like OnMessage. It will return ErrEmptyMessage on zero length message,
+// or error when it come across one.
+func (r *MessageReader) ReadMessage(v interface{}) error {
+	return r.host.readMessage(r.reader, v)
+}
+
+// WriteMessage marshals given struct and writes it as a framed message. It will
+// return error when it come across one.
+func (w *MessageWriter) WriteMessage(v interface{}) error {
+	return w.host.PostMessage(w.writer, v)
+}
+
+// readMessage reads a framed message from given reader and unmarshals it into
+// given struct, without exiting on io.EOF. It will return error when it come
+// across one.
+func (h *Host) readMessage(reader io.Reader, v interface{}) error {
+	var length uint32
+
+	if err := binary.Read(reader, h.ByteOrder, &length); err != nil {
+		return err
+	}
+
+	return h.readBody(reader, length, v)
+}
@@ -0,0 +1,98 @@
+// message_test.go - Test for framed message reader and writer.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"bytes"
+	"github.com/google/go-cmp/cmp"
+	"io"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	type message struct {
+		Key   string `json:"key"`
+		Count int    `json:"count"`
+	}
+
+	compare := func(messages []message) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			buf := &bytes.Buffer{}
+			writer := NewMessageWriter(buf)
+			for _, m := range messages {
+				if err := writer.WriteMessage(m); err != nil {
+					t.Fatalf("write error: %v", err)
+				}
+			}
+
+			got := []message{}
+			reader := NewMessageReader(buf)
+			for {
+				m := message{}
+				if err := reader.ReadMessage(&m); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("read error: %v", err)
+				}
+				got = append(got, m)
+			}
+
+			if diff := cmp.Diff(messages, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with no message", compare([]message{}))
+	t.Run("with one message", compare([]message{{Key: "value", Count: 1}}))
+	t.Run("with many messages", compare([]message{{Key: "first", Count: 1}, {Key: "second", Count: 2},
+		{Key: "", Count: 0}}))
+}
+
+func TestMessageFraming(t *testing.T) {
+	t.Parallel()
+
+	want := &bytes.Buffer{}
+	if err := (&Host{}).Init().PostMessage(want, &H{"key": "value"}); err != nil {
+		t.Fatalf("post error: %v", err)
+	}
+
+	got := &bytes.Buffer{}
+	if err := NewMessageWriter(got).WriteMessage(&H{"key": "value"}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	if !bytes.Equal(want.Bytes(), got.Bytes()) {
+		t.Errorf("framing mismatch (want: %q, got: %q)", want.Bytes(), got.Bytes())
+	}
+
+	// A truncated message body is an error, not the end of messages.
+	got.Truncate(got.Len() - 1)
+	if err := NewMessageReader(got).ReadMessage(&H{}); err == nil || err == io.EOF {
+		t.Errorf("missing truncated message error: %v", err)
+	}
+
+	// A zero length message is reported, and the following one is intact.
+	reader := NewMessageReader(bytes.NewReader(append([]byte{0, 0, 0, 0}, want.Bytes()...)))
+	if err := reader.ReadMessage(&H{}); err != ErrEmptyMessage {
+		t.Errorf("error mismatch (want: %v, got: %v)", ErrEmptyMessage, err)
+	}
+
+	message := H{}
+	if err := reader.ReadMessage(&message); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+
+	if diff := cmp.Diff(H{"key": "value"}, message); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,17 @@
+// movefile_other.go - Deferred file replacement for non Windows.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package host
+
+import "errors"
+
+// scheduleReplace is unsupported outside Windows. It helps write testable code.
+var scheduleReplace = func(src, dst string) error {
+	return errors.New("Deferred replace is only supported on Windows")
+}
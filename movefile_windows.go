@@ -0,0 +1,26 @@
+// movefile_windows.go - Deferred file replacement for Windows.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import "golang.org/x/sys/windows"
+
+// scheduleReplace schedules given source file to replace given destination
+// file on next reboot. It will return error when it come across one.
+var scheduleReplace = func(src, dst string) error {
+	from, err := windows.UTF16PtrFromString(src)
+	if err != nil {
+		return err
+	}
+
+	to, err := windows.UTF16PtrFromString(dst)
+	if err != nil {
+		return err
+	}
+
+	return windows.MoveFileEx(from, to, windows.MOVEFILE_REPLACE_EXISTING|windows.MOVEFILE_DELAY_UNTIL_REBOOT)
+}
@@ -0,0 +1,56 @@
+// option.go - Functional options of Host construction.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"encoding/binary"
+)
+
+// An Option configures a Host that is constructed by New.
+type Option func(*Host)
+
+// New returns a new Host configured by given options, with the same defaults
+// as Init.
+//
+//   messaging := host.New(
+//     host.WithAppName("tld.domain.sub.app.name"),
+//     host.WithUpdateUrl("https://sub.domain.tld/updates.xml"),
+//     host.WithVersion("1.0.0"),
+//   )
+func New(opts ...Option) *Host {
+	h := &Host{}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h.Init()
+}
+
+// WithAllowedExts sets given extension identifiers as AllowedExts.
+func WithAllowedExts(exts ...string) Option {
+	return func(h *Host) { h.AllowedExts = exts }
+}
+
+// WithAppName sets given name as AppName.
+func WithAppName(name string) Option {
+	return func(h *Host) { h.AppName = name }
+}
+
+// WithByteOrder sets given byte order as ByteOrder.
+func WithByteOrder(order binary.ByteOrder) Option {
+	return func(h *Host) { h.ByteOrder = order }
+}
+
+// WithUpdateUrl sets given updates.xml URL as UpdateUrl.
+func WithUpdateUrl(url string) Option {
+	return func(h *Host) { h.UpdateUrl = url }
+}
+
+// WithVersion sets given version as Version.
+func WithVersion(version string) Option {
+	return func(h *Host) { h.Version = version }
+}
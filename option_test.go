@@ -0,0 +1,43 @@
+// option_test.go - Test for functional options of Host construction.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"encoding/binary"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestOptionNew(t *testing.T) {
+	t.Parallel()
+
+	compare := func(got *Host, want *Host) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with default", compare(New(), (&Host{}).Init()))
+	t.Run("with AppName", compare(New(WithAppName("x")), (&Host{AppName: "x"}).Init()))
+	t.Run("with AllowedExts", compare(New(WithAllowedExts("chrome-extension://123/",
+		"chrome-extension://456/")), (&Host{AllowedExts: []string{"chrome-extension://123/",
+		"chrome-extension://456/"}}).Init()))
+	t.Run("with ByteOrder", compare(New(WithByteOrder(binary.BigEndian)),
+		(&Host{ByteOrder: binary.BigEndian}).Init()))
+	t.Run("with update", compare(New(WithAppName("tld.domain.sub.app.name"),
+		WithUpdateUrl("https://sub.domain.tld/updates.xml"), WithVersion("1.0.0")), (&Host{
+		AppName:   "tld.domain.sub.app.name",
+		UpdateUrl: "https://sub.domain.tld/updates.xml",
+		Version:   "1.0.0",
+	}).Init()))
+	t.Run("with later option winning", compare(New(WithVersion("1.0.0"), WithVersion("1.0.1")),
+		(&Host{Version: "1.0.1"}).Init()))
+}
@@ -7,7 +7,7 @@
 
 // Package packer provides extracting archive related syntactic sugar.
 //
-// * Extract tar.gz content
+// * Extract tar.gz, tar.bz2, tar.xz, tar.zst, or tar content
 //
 //   ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 //   defer cancel()
@@ -26,15 +26,408 @@
 //   defer resp.Body.Close()
 //
 //   packer.Unzip(resp.Body, "/path/to/extract")
+//
+// * Extract content without exiting on error
+//
+//   if err := packer.UntarE(resp.Body, "/path/to/extract"); err != nil {
+//     log.Printf("untar error: %v", err)
+//   }
+//
+// * Extract content with size limits
+//
+//   opts := &packer.Options{MaxEntryBytes: 64 << 20, MaxExtractBytes: 256 << 20}
+//   if err := packer.UntarWithOptions(resp.Body, "/path/to/extract", opts); err != nil {
+//     log.Printf("untar error: %v", err)
+//   }
+//
+// * Extract large zip content through a temporary file instead of memory
+//
+//   opts := &packer.Options{SpoolBytes: 32 << 20}
+//   if err := packer.UnzipWithOptions(resp.Body, "/path/to/extract", opts); err != nil {
+//     log.Printf("unzip error: %v", err)
+//   }
+//
+// * Extract content without group and other write permission
+//
+//   opts := &packer.Options{ModeMask: 0022}
+//   if err := packer.UntarWithOptions(resp.Body, "/path/to/extract", opts); err != nil {
+//     log.Printf("untar error: %v", err)
+//   }
+//
+// * Extract content with symlinks skipped, instead of symlinks that resolve
+// within target dir only
+//
+//   opts := &packer.Options{Symlink: packer.SkipSymlink}
+//   if err := packer.UntarWithOptions(resp.Body, "/path/to/extract", opts); err != nil {
+//     log.Printf("untar error: %v", err)
+//   }
+//
+// * Extract content until given context is done, i.e.: on shutdown
+//
+//   if err := packer.UntarContext(ctx, resp.Body, "/path/to/extract"); err == context.Canceled {
+//     log.Printf("untar is cancelled")
+//   }
+//
+// * Extract content and list extracted files, i.e.: for later uninstall
+//
+//   files, err := packer.UntarFiles(resp.Body, "/path/to/extract", nil)
+//   if err != nil {
+//     log.Printf("untar error: %v", err)
+//   }
+//
+// * Custom diagnostic output
+//
+//   packer.SetLogger(log.New(ioutil.Discard, "", 0))
 package packer
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
-// logFatalf is a shortcut to log.Fatalf. It helps write testable code.
-var logFatalf = log.Fatalf
+// logFatalf is a shortcut to fatalf. It helps write testable code.
+var logFatalf = fatalf
 
 // osRemove is a shortcut to os.Remove. It helps write testable code.
 var osRemove = os.Remove
+
+// logger is the diagnostic output, it is defaulted to the standard logger.
+var logger Logger = stdLogger{}
+
+// osExit is a shortcut to os.Exit. It helps write testable code.
+var osExit = os.Exit
+
+// ErrTooLarge is returned when extracted content exceeds configured limit.
+var ErrTooLarge = errors.New("extract size limit exceeded")
+
+// An EntryPolicy is a handling policy for unsupported archive entries, e.g.
+// block, char, fifo, sparse, or unknown tar entry types.
+type EntryPolicy int
+
+// The unsupported archive entry handling policies.
+const (
+	// SkipEntry skips unsupported entry with a warning, it is the default.
+	SkipEntry EntryPolicy = iota
+	// RejectEntry fails the extraction with an error.
+	RejectEntry
+	// FatalEntry exits the process.
+	FatalEntry
+)
+
+// A SymlinkPolicy is a handling policy for symlink archive entries.
+type SymlinkPolicy int
+
+// The symlink entry handling policies.
+const (
+	// AllowSymlinkWithinDir creates symlink that resolves within target dir,
+	// and fails the extraction on others, it is the default.
+	AllowSymlinkWithinDir SymlinkPolicy = iota
+	// RejectSymlink fails the extraction on any symlink.
+	RejectSymlink
+	// SkipSymlink skips any symlink with a warning.
+	SkipSymlink
+)
+
+// Options represents optional extraction configurations.
+type Options struct {
+	// MaxEntryBytes is a maximum bytes of a single entry, zero means unlimited.
+	MaxEntryBytes int64
+	// MaxExtractBytes is a maximum total bytes of all entries, zero means
+	// unlimited.
+	MaxExtractBytes int64
+	// ModeMask is a umask-like mask of mode bits to be cleared from entries,
+	// e.g. 0022 to strip group and other write bits, zero preserves the
+	// archive stored modes under the process umask. A non-zero mask applies
+	// the masked modes to overwritten entries too.
+	ModeMask os.FileMode
+	// Progress is an optional callback that is invoked with entry name, written
+	// bytes, and declared total bytes at the start of each entry and on every
+	// write.
+	Progress func(entryName string, bytesWritten, totalBytes int64)
+	// SpoolBytes is a zip archive size threshold, beyond which the archive is
+	// spooled to a temporary file instead of memory, zero means always in
+	// memory.
+	SpoolBytes int64
+	// Symlink is a handling policy for symlink entries.
+	Symlink SymlinkPolicy
+	// TempDir is a writable folder of the spooled archive, the default folder
+	// for temporary files is used when it is empty.
+	TempDir string
+	// UnsupportedEntry is a handling policy for unsupported entries.
+	UnsupportedEntry EntryPolicy
+}
+
+// progressWriter is a counting writer that reports written bytes to given
+// progress callback.
+type progressWriter struct {
+	io.Writer
+	entry    string
+	progress func(string, int64, int64)
+	total    int64
+	written  int64
+}
+
+// Write is an implementation of io.Writer that reports written bytes.
+func (p *progressWriter) Write(buf []byte) (int, error) {
+	n, err := p.Writer.Write(buf)
+	p.written += int64(n)
+	p.progress(p.entry, p.written, p.total)
+	return n, err
+}
+
+// contextReader is a reader that stops reading once given context is done.
+type contextReader struct {
+	io.Reader
+	ctx context.Context
+}
+
+// Read is an implementation of io.Reader that returns the context error once
+// the context is done.
+func (c *contextReader) Read(buf []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.Reader.Read(buf)
+}
+
+// extraction tracks extraction options and progress.
+type extraction struct {
+	Options
+	ctx     context.Context
+	files   []string
+	written int64
+}
+
+// newExtraction returns new extraction with given context and options, if any.
+func newExtraction(ctx context.Context, opts *Options) *extraction {
+	e := &extraction{ctx: ctx}
+	if opts != nil {
+		e.Options = *opts
+	}
+	return e
+}
+
+// contextErr returns the context error when the context is done, otherwise
+// given error. It lets the context variants return the context error as-is
+// instead of the wrapped read error.
+func (e *extraction) contextErr(err error) error {
+	if ctxErr := e.ctx.Err(); err != nil && ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// mode returns given entry mode with configured ModeMask bits cleared, the
+// file type bits are always kept.
+func (e *extraction) mode(m os.FileMode) os.FileMode {
+	return m &^ (e.ModeMask &^ os.ModeType)
+}
+
+// chmod applies given masked mode to given name when ModeMask is configured,
+// so an overwritten entry doesn't keep its old, possibly looser, mode. The
+// created entries are left with the process umask applied otherwise.
+func (e *extraction) chmod(name string, m os.FileMode) error {
+	if e.ModeMask == 0 {
+		return nil
+	}
+	return os.Chmod(name, m)
+}
+
+// record appends given extracted name as an absolute path into the extracted
+// files list.
+func (e *extraction) record(name string) {
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	e.files = append(e.files, name)
+}
+
+// Logger is an interface for diagnostic output. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdLogger is an implementation of Logger and wraps the standard logger.
+type stdLogger struct{}
+
+// Printf is an implementation of Logger.Printf and wraps log.Printf.
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// fatalf writes given message to the diagnostic output and exits with status 1.
+func fatalf(format string, v ...interface{}) {
+	logger.Printf(format, v...)
+	osExit(1)
+}
+
+// SetLogger replaces the diagnostic output, nil restores the standard logger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = stdLogger{}
+	}
+	logger = l
+}
+
+// safeJoin joins given relative entry name onto given target dir. It will
+// return error when the entry name is invalid or escapes the target dir.
+func safeJoin(dir, entry string) (string, error) {
+	if !validRelPath(entry) {
+		return "", fmt.Errorf("invalid name: %q", entry)
+	}
+
+	root := filepath.Clean(dir)
+	name := filepath.Join(root, filepath.FromSlash(entry))
+
+	if name != root && !strings.HasPrefix(name, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid name: %q escapes %s", entry, dir)
+	}
+
+	return name, nil
+}
+
+// withinDir returns true if given symlink target of given entry name resolves
+// within given target dir, otherwise false.
+func withinDir(dir, name, linkname string) bool {
+	if filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") {
+		return false
+	}
+
+	root := filepath.Clean(dir)
+	resolved := filepath.Join(filepath.Dir(name), filepath.FromSlash(linkname))
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return false
+	}
+
+	rel = filepath.ToSlash(rel)
+	return rel == "." || (rel != ".." && validRelPath(rel))
+}
+
+// realPath returns given path after the evaluation of any symbolic links in its
+// existing leading part, the rest is appended as-is. It will return error when
+// the existing part can't be evaluated, i.e.: a dangling symlink.
+func realPath(name string) (string, error) {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+
+	existing, rest := name, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(resolved, rest), nil
+}
+
+// checkWithin returns error when given name, after the evaluation of symbolic
+// links, i.e.: the ones extracted earlier, resolves outside given target dir.
+func checkWithin(dir, name string) error {
+	root, err := realPath(dir)
+	if err != nil {
+		return err
+	}
+
+	resolved, err := realPath(name)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s escapes %s through symlink", name, dir)
+	}
+
+	return nil
+}
+
+// removeSymlink removes given name when it is a symlink, so the entry is
+// written in place of the symlink instead of its target. It will return error
+// when it come across one.
+func removeSymlink(name string) error {
+	if info, err := os.Lstat(name); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := osRemove(name); err != nil {
+			return fmt.Errorf("rm %s error: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// validRelPath validates given relative path.
+func validRelPath(p string) bool {
+	if p == "" || strings.Contains(p, `\`) || strings.HasPrefix(p, "/") || strings.Contains(p, "../") {
+		return false
+	}
+	return true
+}
+
+// limit returns maximum bytes allowed for next entry, negative means unlimited.
+func (e *extraction) limit() int64 {
+	limit := int64(-1)
+
+	if e.MaxExtractBytes > 0 {
+		limit = e.MaxExtractBytes - e.written
+	}
+
+	if e.MaxEntryBytes > 0 && (limit < 0 || e.MaxEntryBytes < limit) {
+		limit = e.MaxEntryBytes
+	}
+
+	return limit
+}
+
+// check returns ErrTooLarge when given entry declared size exceeds allowed
+// limit.
+func (e *extraction) check(entry string, size int64) error {
+	if limit := e.limit(); limit >= 0 && size > limit {
+		return fmt.Errorf("%s %d bytes: %w", entry, size, ErrTooLarge)
+	}
+	return nil
+}
+
+// copy copies given entry source to given destination within allowed limit and
+// reports progress, if configured. It will return ErrTooLarge when actual size
+// exceeds allowed limit.
+func (e *extraction) copy(entry string, total int64, dst io.Writer, src io.Reader) (int64, error) {
+	src = &contextReader{Reader: src, ctx: e.ctx}
+
+	limit := e.limit()
+	if limit >= 0 {
+		src = io.LimitReader(src, limit+1)
+	}
+
+	if e.Progress != nil {
+		e.Progress(entry, 0, total)
+		dst = &progressWriter{Writer: dst, entry: entry, progress: e.Progress, total: total}
+	}
+
+	n, err := io.Copy(dst, src)
+	e.written += n
+
+	if err == nil && limit >= 0 && n > limit {
+		err = fmt.Errorf("%s over %d bytes: %w", entry, limit, ErrTooLarge)
+	}
+
+	return n, err
+}
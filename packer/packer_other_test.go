@@ -0,0 +1,89 @@
+// packer_other_test.go - Test for umask related functionality on non Windows.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package packer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestPackerDefaultModeUmask is not parallel since the umask is process-wide.
+func TestPackerDefaultModeUmask(t *testing.T) {
+	oldUmask := syscall.Umask(0022)
+	defer syscall.Umask(oldUmask)
+
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+	for _, h := range []*tar.Header{
+		{Name: "folder/", Mode: 0777, Typeflag: tar.TypeDir},
+		{Name: "folder/file", Mode: 0666, Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("tar header error: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar close error: %v", err)
+	}
+
+	zipBuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zipBuf)
+	for _, name := range []string{"folder/", "folder/file"} {
+		h := &zip.FileHeader{Name: name}
+		if strings.HasSuffix(name, "/") {
+			h.SetMode(os.ModeDir | 0777)
+		} else {
+			h.SetMode(0666)
+		}
+		if _, err := zw.CreateHeader(h); err != nil {
+			t.Fatalf("zip header error: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip close error: %v", err)
+	}
+
+	compare := func(target string, extract func(string) error) func(t *testing.T) {
+		return func(t *testing.T) {
+			defer os.RemoveAll(target)
+
+			if err := extract(target); err != nil {
+				t.Fatalf("extract error: %v", err)
+			}
+
+			for name, want := range map[string]os.FileMode{
+				"folder":      0755,
+				"folder/file": 0644,
+			} {
+				info, err := os.Stat(filepath.Join(target, name))
+				if err != nil {
+					t.Fatalf("stat error: %v", err)
+				}
+
+				if got := info.Mode().Perm(); got != want {
+					t.Errorf("%s mode mismatch (want: %04o, got: %04o)", name, want, got)
+				}
+			}
+		}
+	}
+
+	t.Run("with untar", compare("../testdata/untarumask", func(target string) error {
+		return UntarWithOptions(tarBuf, target, &Options{})
+	}))
+	t.Run("with unzip", compare("../testdata/unzipumask", func(target string) error {
+		return UnzipWithOptions(zipBuf, target, nil)
+	}))
+}
@@ -0,0 +1,77 @@
+// packer_test.go - Test for unpack related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package packer
+
+import (
+	"fmt"
+	"testing"
+)
+
+type recorder struct {
+	messages []string
+}
+
+func (r *recorder) Printf(format string, v ...interface{}) {
+	r.messages = append(r.messages, fmt.Sprintf(format, v...))
+}
+
+func TestPackerFatalf(t *testing.T) {
+	exited := 0
+	oldLogger := logger
+	oldOsExit := osExit
+	r := &recorder{}
+	defer func() {
+		logger = oldLogger
+		osExit = oldOsExit
+	}()
+	osExit = func(code int) { exited = code }
+
+	SetLogger(r)
+	fatalf("untar error: %v", "error")
+
+	if exited != 1 {
+		t.Errorf("exit code mismatch: %d", exited)
+	}
+
+	if len(r.messages) != 1 || r.messages[0] != "untar error: error" {
+		t.Errorf("message mismatch: %v", r.messages)
+	}
+
+	SetLogger(nil)
+
+	if logger != (stdLogger{}) {
+		t.Errorf("logger should be restored: %#v", logger)
+	}
+}
+
+func TestPackerSafeJoin(t *testing.T) {
+	t.Parallel()
+
+	compare := func(wantErr bool, dir, entry, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			got, err := safeJoin(dir, entry)
+			if !wantErr && err != nil {
+				t.Fatalf("safe join error %s: %v", entry, err)
+			} else if wantErr && err == nil {
+				t.Fatalf("want error: %s", entry)
+			}
+
+			if got != want {
+				t.Errorf("mismatch (want: %s, got: %s)", want, got)
+			}
+		}
+	}
+
+	t.Run("with relative path", compare(false, "target", "folder/file", "target/folder/file"))
+	t.Run("with current path", compare(false, "target", "./", "target"))
+	t.Run("with parent path", compare(true, "target", "../evil", ""))
+	t.Run("with nested parent path", compare(true, "target", "folder/../../evil", ""))
+	t.Run("with absolute path", compare(true, "target", "/evil", ""))
+}
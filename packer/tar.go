@@ -9,67 +9,197 @@ package packer
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
+	"context"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
-	"strings"
 )
 
-// removeLink is a wrapper to remove given path and log any error.
-func removeLink(name string) {
+// The magic bytes of supported tar compressions.
+var (
+	bzip2Magic = []byte{0x42, 0x5a, 0x68}
+	gzipMagic  = []byte{0x1f, 0x8b}
+	xzMagic    = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// removeLink is a wrapper to remove given path. It will return error when it
+// come across one.
+func removeLink(name string) error {
 	if _, err := os.Lstat(name); err == nil {
 		if err := osRemove(name); err != nil {
-			logFatalf("untar rm %s error: %v", name, err)
+			return fmt.Errorf("untar rm %s error: %w", name, err)
 		}
 	}
+	return nil
 }
 
-// Untar reads the gzip-compressed tar file from reader and writes it into
-// target dir.
+// Untar reads the compressed or plain tar file from reader and writes it into
+// target dir. It will exit when it come across any error.
 func Untar(r io.Reader, dir string) {
-	zr, err := gzip.NewReader(r)
-	if err != nil {
-		log.Fatalf("gunzip error: %v", err)
+	if err := UntarE(r, dir); err != nil {
+		logFatalf("%v", err)
 	}
-	defer zr.Close()
+}
+
+// UntarE reads the compressed or plain tar file from reader and writes it into
+// target dir. It will return error when it come across one.
+func UntarE(r io.Reader, dir string) error {
+	return UntarWithOptions(r, dir, nil)
+}
+
+// UntarWithOptions reads the compressed or plain tar file from reader and writes
+// it into target dir with given options. The gzip, bzip2, xz, or zstd
+// compression is detected from the leading magic bytes. It will return error
+// when it come across one.
+func UntarWithOptions(r io.Reader, dir string, opts *Options) error {
+	_, err := UntarFiles(r, dir, opts)
+	return err
+}
+
+// UntarFiles is the same as UntarWithOptions, except it returns absolute paths
+// of extracted directories, files, and links in extraction order. Hard links
+// and symlinks are listed by their own path, not their target. Directory
+// entries are listed even when they already exist, and skipped unsupported
+// entries are not listed. The files extracted so far are returned along with
+// error when it come across one.
+func UntarFiles(r io.Reader, dir string, opts *Options) ([]string, error) {
+	e := newExtraction(context.Background(), opts)
+	err := e.untar(r, dir)
+	return e.files, err
+}
 
-	tr := tar.NewReader(zr)
+// UntarContext reads the compressed or plain tar file from reader and writes it
+// into target dir until given context is done. The context is checked between
+// entries and during entry copies, and the context error is returned as-is on
+// cancellation. It will return error when it come across one.
+func UntarContext(ctx context.Context, r io.Reader, dir string) error {
+	e := newExtraction(ctx, nil)
+	return e.contextErr(e.untar(&contextReader{Reader: r, ctx: ctx}, dir))
+}
+
+// untar detects the compression of tar file from reader and writes it into
+// target dir. It will return error when it come across one.
+func (e *extraction) untar(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(xzMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("gunzip error: %w", err)
+		}
+		defer zr.Close()
+		return e.untarReader(zr, dir)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return e.untarReader(bzip2.NewReader(br), dir)
+	case bytes.HasPrefix(magic, xzMagic):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("unxz error: %w", err)
+		}
+		return e.untarReader(xr, dir)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("unzstd error: %w", err)
+		}
+		defer zr.Close()
+		return e.untarReader(zr, dir)
+	}
+
+	return e.untarReader(br, dir)
+}
+
+// UntarReader reads the already-decompressed tar file from reader and writes it
+// into target dir with given options. It will return error when it come across
+// one.
+func UntarReader(r io.Reader, dir string, opts *Options) error {
+	return newExtraction(context.Background(), opts).untarReader(r, dir)
+}
+
+// untarReader reads the already-decompressed tar file from reader and writes it
+// into target dir. It will return error when it come across one.
+func (e *extraction) untarReader(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
 	for {
-		if h, err := tr.Next(); err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				log.Fatalf("untar error: %v", err)
-			}
-		} else if h != nil {
-			if !validRelPath(h.Name) {
-				log.Fatalf("untar invalid name: %q", h.Name)
-			}
-			untarEntry(tr, h, dir)
+		if err := e.ctx.Err(); err != nil {
+			return err
+		}
+
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("untar error: %w", err)
+		}
+
+		if isExtendedHeader(h.Typeflag) {
+			continue
+		}
+
+		name, err := safeJoin(dir, h.Name)
+		if err != nil {
+			return fmt.Errorf("untar %w", err)
+		}
+
+		if err := e.untarEntry(tr, h, name, dir); err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
-// untarEntry creates new file or folder on given tar header.
-func untarEntry(tr *tar.Reader, h *tar.Header, dir string) {
-	mode := h.FileInfo().Mode()
-	name := filepath.Join(dir, filepath.FromSlash(h.Name))
+// untarEntry creates new file or folder with given name on given tar header. It
+// will return error when it come across one.
+func (e *extraction) untarEntry(tr *tar.Reader, h *tar.Header, name, dir string) error {
+	mode := e.mode(h.FileInfo().Mode())
+
+	// The parent folder might go through an extracted symlink.
+	if name != filepath.Clean(dir) {
+		if err := checkWithin(dir, filepath.Dir(name)); err != nil {
+			return fmt.Errorf("untar %w", err)
+		}
+	}
 
 	switch h.Typeflag {
 	case tar.TypeDir:
+		// The folder itself might be an extracted symlink.
+		if err := checkWithin(dir, name); err != nil {
+			return fmt.Errorf("untar %w", err)
+		}
 		if err := os.MkdirAll(name, mode); err != nil {
-			log.Fatalf("untar mkdir -p %s error: %v", name, err)
+			return fmt.Errorf("untar mkdir -p %s error: %w", name, err)
 		}
+		// An existing folder keeps its mode on mkdir.
+		if err := e.chmod(name, mode); err != nil {
+			return fmt.Errorf("untar chmod %s error: %w", name, err)
+		}
+		e.record(name)
 	case tar.TypeReg, tar.TypeRegA:
+		if err := e.check(h.Name, h.Size); err != nil {
+			return fmt.Errorf("untar %w", err)
+		}
+
+		if err := removeSymlink(name); err != nil {
+			return fmt.Errorf("untar %w", err)
+		}
+
 		file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
 		if err != nil {
-			log.Fatalf("untar create %s error: %v", name, err)
+			return fmt.Errorf("untar create %s error: %w", name, err)
 		}
 
-		n, err := io.Copy(file, tr)
+		n, err := e.copy(h.Name, h.Size, file, tr)
 		if closeErr := file.Close(); closeErr != nil {
 			if err == nil {
 				err = closeErr
@@ -79,33 +209,112 @@ func untarEntry(tr *tar.Reader, h *tar.Header, dir string) {
 		}
 
 		if err != nil {
-			log.Fatalf("untar write %s error: %v", name, err)
+			return fmt.Errorf("untar write %s error: %w", name, err)
 		}
 
 		if n != h.Size {
-			log.Fatalf("wrote %s only %d bytes of %d", name, n, h.Size)
+			return fmt.Errorf("wrote %s only %d bytes of %d", name, n, h.Size)
+		}
+
+		// An existing file keeps its mode on open.
+		if err := e.chmod(name, mode); err != nil {
+			return fmt.Errorf("untar chmod %s error: %w", name, err)
 		}
+		e.record(name)
 	case tar.TypeLink:
-		removeLink(name)
-		if err := os.Link(filepath.Join(dir, h.Linkname), name); err != nil {
-			log.Fatalf("untar ln %s: %v", name, err)
+		target, err := safeJoin(dir, h.Linkname)
+		if err != nil {
+			return fmt.Errorf("untar ln %w", err)
+		}
+		if err := checkWithin(dir, target); err != nil {
+			return fmt.Errorf("untar ln %w", err)
 		}
+		if err := removeLink(name); err != nil {
+			return err
+		}
+		if err := os.Link(target, name); err != nil {
+			return fmt.Errorf("untar ln %s: %w", name, err)
+		}
+		e.record(name)
 	case tar.TypeSymlink:
-		removeLink(name)
+		if skip, err := e.checkSymlink(h, name, dir); skip || err != nil {
+			return err
+		}
+		if err := removeLink(name); err != nil {
+			return err
+		}
 		if err := os.Symlink(h.Linkname, name); err != nil {
-			log.Fatalf("untar ln -s %s: %v", name, err)
+			return fmt.Errorf("untar ln -s %s: %w", name, err)
 		}
-	case tar.TypeBlock, tar.TypeChar, tar.TypeFifo, tar.TypeGNUSparse, tar.TypeXGlobalHeader:
-		break
+		// A target through other symlinks is checked once it resolves.
+		if _, err := filepath.EvalSymlinks(name); err == nil {
+			if err := checkWithin(dir, name); err != nil {
+				osRemove(name)
+				return fmt.Errorf("untar ln -s %w", err)
+			}
+		}
+		e.record(name)
 	default:
-		log.Fatalf("untar unknown type %s: %s", mode, name)
+		// It covers block, char, fifo, sparse, and unknown types.
+		return e.unsupportedEntry(h, name)
+	}
+
+	return nil
+}
+
+// isExtendedHeader returns true if given typeflag is a PAX or GNU extended
+// header, otherwise false. The tar.Reader merges PAX local, GNU long name, and
+// GNU long link headers into the next entry, so only PAX global header, which
+// carries archive-wide metadata and might be named with an absolute path, i.e.:
+// $TMPDIR/GlobalHead.%p.%n, reaches here. They are skipped as they have nothing
+// to extract.
+func isExtendedHeader(typeflag byte) bool {
+	switch typeflag {
+	case tar.TypeXHeader, tar.TypeXGlobalHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+		return true
+	}
+	return false
+}
+
+// checkSymlink returns true when given symlink entry should be skipped
+// according to configured Symlink policy. It will return error when the symlink
+// is rejected.
+func (e *extraction) checkSymlink(h *tar.Header, name, dir string) (bool, error) {
+	switch e.Symlink {
+	case RejectSymlink:
+		return false, fmt.Errorf("untar ln -s %s: symlink is rejected", name)
+	case SkipSymlink:
+		logger.Printf("untar skip symlink %s -> %s", name, h.Linkname)
+		return true, nil
 	}
+
+	// The link target is resolved against the real folders, not the names.
+	root, err := realPath(dir)
+	if err != nil {
+		return false, fmt.Errorf("untar ln -s %s: %w", name, err)
+	}
+
+	parent, err := realPath(filepath.Dir(name))
+	if err != nil {
+		return false, fmt.Errorf("untar ln -s %s: %w", name, err)
+	}
+
+	if !withinDir(root, filepath.Join(parent, filepath.Base(name)), h.Linkname) {
+		return false, fmt.Errorf("untar ln -s %s: %q escapes %s", name, h.Linkname, dir)
+	}
+	return false, nil
 }
 
-// validRelPath validates given relative path.
-func validRelPath(p string) bool {
-	if p == "" || strings.Contains(p, `\`) || strings.HasPrefix(p, "/") || strings.Contains(p, "../") {
-		return false
+// unsupportedEntry handles given unsupported tar entry according to configured
+// UnsupportedEntry policy. It will return error on RejectEntry policy.
+func (e *extraction) unsupportedEntry(h *tar.Header, name string) error {
+	switch e.UnsupportedEntry {
+	case RejectEntry:
+		return fmt.Errorf("untar unsupported type %q: %s", h.Typeflag, name)
+	case FatalEntry:
+		logFatalf("untar unsupported type %q: %s", h.Typeflag, name)
+	default:
+		logger.Printf("untar skip unsupported type %q: %s", h.Typeflag, name)
 	}
-	return true
+	return nil
 }
@@ -8,10 +8,19 @@
 package packer
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -20,22 +29,12 @@ func TestTarRemoveLink(t *testing.T) {
 
 	compare := func(wantErr int) func(t *testing.T) {
 		return func(t *testing.T) {
-			fatal := false
-			oldLogFatalf := logFatalf
 			oldOsRemove := osRemove
 			removed := 0
 			targetName := fmt.Sprintf("../testdata/tarlink-%d", wantErr)
 
-			defer func() {
-				_ = recover()
-				logFatalf = oldLogFatalf
-				osRemove = oldOsRemove
-			}()
+			defer func() { osRemove = oldOsRemove }()
 
-			logFatalf = func(msg string, v ...interface{}) {
-				fatal = true
-				panic(fmt.Sprintf(msg, v))
-			}
 			osRemove = func(string) error { removed++; return nil }
 
 			switch wantErr {
@@ -55,20 +54,20 @@ func TestTarRemoveLink(t *testing.T) {
 				}
 			}
 
-			removeLink(targetName)
+			err := removeLink(targetName)
 
 			switch wantErr {
 			case 0:
-				if fatal || removed < 1 {
-					t.Errorf("should not panic and removed: %v, %d", fatal, removed)
+				if err != nil || removed < 1 {
+					t.Errorf("should not error and removed: %v, %d", err, removed)
 				}
 			case 1:
-				if fatal || removed > 0 {
-					t.Errorf("should not panic and not removed: %v, %d", fatal, removed)
+				if err != nil || removed > 0 {
+					t.Errorf("should not error and not removed: %v, %d", err, removed)
 				}
 			case 2:
-				if !fatal || removed > 0 {
-					t.Errorf("should panic and not removed: %v, %d", fatal, removed)
+				if err == nil || removed != 1 {
+					t.Errorf("should error and attempted once: %v, %d", err, removed)
 				}
 			}
 		}
@@ -88,10 +87,14 @@ func TestTarUntar(t *testing.T) {
 
 			target := "../testdata/untar"
 			file, _ := os.Open("../testdata/packer.tgz")
+			defer file.Close()
 			Untar(file, target)
 
 			switch wantErr {
 			case 0:
+				if _, err := os.Stat(target + "/folder/file"); err != nil {
+					t.Errorf("missing file %s: %v", target+"/folder/file", err)
+				}
 			}
 
 			os.RemoveAll(target)
@@ -101,6 +104,32 @@ func TestTarUntar(t *testing.T) {
 	t.Run("with valid file", compare(0))
 }
 
+func TestTarUntarE(t *testing.T) {
+	t.Parallel()
+
+	compare := func(wantErr bool, r io.Reader) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			target := fmt.Sprintf("../testdata/untare-%t", wantErr)
+			defer os.RemoveAll(target)
+
+			if err := UntarE(r, target); !wantErr && err != nil {
+				t.Errorf("untar error: %v", err)
+			} else if wantErr && err == nil {
+				t.Error("want error")
+			}
+		}
+	}
+
+	valid, _ := ioutil.ReadFile("../testdata/packer.tgz")
+	corrupt := append([]byte{}, valid[:len(valid)/2]...)
+
+	t.Run("with valid file", compare(false, bytes.NewReader(valid)))
+	t.Run("with corrupt file", compare(true, strings.NewReader("corrupt")))
+	t.Run("with truncated file", compare(true, bytes.NewReader(corrupt)))
+}
+
 func TestTarValidRelPath(t *testing.T) {
 	t.Parallel()
 
@@ -120,3 +149,612 @@ func TestTarValidRelPath(t *testing.T) {
 	t.Run(`with "\"`, compare(false, `path\to\nowhere`))
 	t.Run(`with "../"`, compare(false, "../path/to/nowhere"))
 }
+
+func TestTarUntarWithOptions(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	for _, name := range []string{"first", "second"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 100,
+			Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("tar header error: %v", err)
+		}
+		if _, err := tw.Write(make([]byte, 100)); err != nil {
+			t.Fatalf("tar write error: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar close error: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip close error: %v", err)
+	}
+
+	compare := func(wantErr bool, opts *Options) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			target := fmt.Sprintf("../testdata/untaropts-%p", opts)
+			defer os.RemoveAll(target)
+
+			if err := os.MkdirAll(target, 0755); err != nil {
+				t.Fatalf("mkdir error: %v", err)
+			}
+
+			err := UntarWithOptions(bytes.NewReader(buf.Bytes()), target, opts)
+			if !wantErr && err != nil {
+				t.Errorf("untar error: %v", err)
+			} else if wantErr && !errors.Is(err, ErrTooLarge) {
+				t.Errorf("want ErrTooLarge: %v", err)
+			}
+		}
+	}
+
+	t.Run("without options", compare(false, nil))
+	t.Run("within limits", compare(false, &Options{MaxEntryBytes: 100, MaxExtractBytes: 200}))
+	t.Run("with entry over limit", compare(true, &Options{MaxEntryBytes: 99}))
+	t.Run("with total over limit", compare(true, &Options{MaxExtractBytes: 150}))
+}
+
+func TestTarUntarCompressions(t *testing.T) {
+	t.Parallel()
+
+	compare := func(source string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			target := "../testdata/untar-" + source
+			defer os.RemoveAll(target)
+
+			file, err := os.Open("../testdata/" + source)
+			if err != nil {
+				t.Fatalf("open error %s: %v", source, err)
+			}
+			defer file.Close()
+
+			if err := UntarE(file, target); err != nil {
+				t.Fatalf("untar error %s: %v", source, err)
+			}
+
+			if _, err := os.Stat(target + "/folder/file"); err != nil {
+				t.Errorf("missing file %s: %v", target+"/folder/file", err)
+			}
+		}
+	}
+
+	t.Run("with gzip", compare("packer.tgz"))
+	t.Run("with bzip2", compare("packer.tar.bz2"))
+	t.Run("with xz", compare("packer.tar.xz"))
+	t.Run("with zstd", compare("packer.tar.zst"))
+	t.Run("with plain tar", compare("packer.tar"))
+}
+
+func TestTarUntarProgress(t *testing.T) {
+	t.Parallel()
+
+	size := int64(100 * 1024)
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: "large", Mode: 0644, Size: size,
+		Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("tar header error: %v", err)
+	}
+	if _, err := tw.Write(make([]byte, size)); err != nil {
+		t.Fatalf("tar write error: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar close error: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip close error: %v", err)
+	}
+
+	target := "../testdata/untarprogress"
+	defer os.RemoveAll(target)
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatalf("mkdir error: %v", err)
+	}
+
+	var written []int64
+	opts := &Options{Progress: func(entry string, n, total int64) {
+		if entry != "large" || total != size {
+			t.Errorf("progress mismatch: %s, %d", entry, total)
+		}
+		written = append(written, n)
+	}}
+
+	if err := UntarWithOptions(bytes.NewReader(buf.Bytes()), target, opts); err != nil {
+		t.Fatalf("untar error: %v", err)
+	}
+
+	if len(written) < 3 {
+		t.Fatalf("progress should be reported periodically: %v", written)
+	}
+
+	for i := 1; i < len(written); i++ {
+		if written[i] < written[i-1] {
+			t.Errorf("progress should increase monotonically: %v", written)
+		}
+	}
+
+	if written[0] != 0 || written[len(written)-1] != size {
+		t.Errorf("progress should go from 0 to %d: %v", size, written)
+	}
+}
+
+func TestTarUntarUnsupportedEntry(t *testing.T) {
+	compare := func(typeflag byte, policy EntryPolicy) func(t *testing.T) {
+		return func(t *testing.T) {
+			fatal := false
+			oldLogFatalf := logFatalf
+			oldLogger := logger
+			r := &recorder{}
+			defer func() {
+				logFatalf = oldLogFatalf
+				logger = oldLogger
+			}()
+			logFatalf = func(string, ...interface{}) { fatal = true }
+			logger = r
+
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			if err := tw.WriteHeader(&tar.Header{Name: "entry", Mode: 0644,
+				Typeflag: typeflag}); err != nil {
+				t.Fatalf("tar header error: %v", err)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("tar close error: %v", err)
+			}
+
+			target := fmt.Sprintf("../testdata/untarunsupported-%c-%d", typeflag, policy)
+			defer os.RemoveAll(target)
+
+			err := UntarWithOptions(buf, target, &Options{UnsupportedEntry: policy})
+
+			switch policy {
+			case SkipEntry:
+				if err != nil || fatal || len(r.messages) != 1 {
+					t.Errorf("should skip with warning: %v, %v, %v", err, fatal, r.messages)
+				}
+			case RejectEntry:
+				if err == nil || fatal {
+					t.Errorf("should error: %v, %v", err, fatal)
+				}
+			case FatalEntry:
+				if !fatal {
+					t.Errorf("should exit: %v, %v", err, fatal)
+				}
+			}
+
+			if _, err := os.Lstat(target + "/entry"); err == nil {
+				t.Errorf("unsupported entry should not be created")
+			}
+		}
+	}
+
+	t.Run("with fifo skipped", compare(tar.TypeFifo, SkipEntry))
+	t.Run("with fifo rejected", compare(tar.TypeFifo, RejectEntry))
+	t.Run("with fifo fatal", compare(tar.TypeFifo, FatalEntry))
+	t.Run("with bogus type skipped", compare('Z', SkipEntry))
+	t.Run("with bogus type rejected", compare('Z', RejectEntry))
+	t.Run("with bogus type fatal", compare('Z', FatalEntry))
+}
+
+func TestTarUntarFiles(t *testing.T) {
+	t.Parallel()
+
+	archive := func(headers ...*tar.Header) io.Reader {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, h := range headers {
+			if err := tw.WriteHeader(h); err != nil {
+				t.Fatalf("tar header error: %v", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("tar close error: %v", err)
+		}
+		return buf
+	}
+
+	dir := &tar.Header{Name: "./", Mode: 0755, Typeflag: tar.TypeDir}
+	file := &tar.Header{Name: "file", Mode: 0644, Typeflag: tar.TypeReg}
+
+	compare := func(name string, r io.Reader, wantErr bool, want []string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			target := "../testdata/untarfiles-" + name
+			defer os.RemoveAll(target)
+
+			abs, _ := filepath.Abs(target)
+			for i, name := range want {
+				want[i] = filepath.Join(abs, name)
+			}
+
+			got, err := UntarFiles(r, target, nil)
+			if !wantErr && err != nil {
+				t.Fatalf("untar error: %v", err)
+			} else if wantErr && err == nil {
+				t.Fatal("want error")
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	tgz, _ := ioutil.ReadFile("../testdata/packer.tgz")
+
+	t.Run("with archive content", compare("archive", bytes.NewReader(tgz), false,
+		[]string{"", "file", "folder", "folder/file"}))
+	t.Run("with links", compare("links", archive(dir, file,
+		&tar.Header{Name: "hardlink", Linkname: "file", Typeflag: tar.TypeLink},
+		&tar.Header{Name: "symlink", Linkname: "file", Typeflag: tar.TypeSymlink}), false,
+		[]string{"", "file", "hardlink", "symlink"}))
+	t.Run("with invalid entry", compare("invalid", archive(dir, file,
+		&tar.Header{Name: "../escape", Mode: 0644, Typeflag: tar.TypeReg}), true,
+		[]string{"", "file"}))
+}
+
+func TestTarUntarSymlink(t *testing.T) {
+	oldLogger := logger
+	defer func() { logger = oldLogger }()
+
+	compare := func(name, linkname string, policy SymlinkPolicy, wantErr bool, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			r := &recorder{}
+			logger = r
+
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			for _, h := range []*tar.Header{
+				{Name: "./", Mode: 0755, Typeflag: tar.TypeDir},
+				{Name: "folder/", Mode: 0755, Typeflag: tar.TypeDir},
+				{Name: "file", Mode: 0644, Typeflag: tar.TypeReg},
+				{Name: name, Linkname: linkname, Typeflag: tar.TypeSymlink},
+			} {
+				if err := tw.WriteHeader(h); err != nil {
+					t.Fatalf("tar header error: %v", err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("tar close error: %v", err)
+			}
+
+			target := fmt.Sprintf("../testdata/untarsymlink-%d-%t", policy, wantErr)
+			defer os.RemoveAll(target)
+
+			err := UntarWithOptions(buf, target, &Options{Symlink: policy})
+			if !wantErr && err != nil {
+				t.Fatalf("untar error: %v", err)
+			} else if wantErr && err == nil {
+				t.Fatal("want error")
+			}
+
+			got, _ := os.Readlink(filepath.Join(target, name))
+			if got != want {
+				t.Errorf("link mismatch (want: %q, got: %q)", want, got)
+			}
+
+			if policy == SkipSymlink && len(r.messages) != 1 {
+				t.Errorf("should skip with warning: %v", r.messages)
+			}
+		}
+	}
+
+	t.Run("with in-bounds symlink", compare("link", "file", AllowSymlinkWithinDir, false, "file"))
+	t.Run("with nested in-bounds symlink", compare("folder/link", "../file", AllowSymlinkWithinDir,
+		false, "../file"))
+	t.Run("with escaping symlink", compare("folder/link", "../../file", AllowSymlinkWithinDir, true, ""))
+	t.Run("with absolute symlink", compare("link", "/etc/passwd", AllowSymlinkWithinDir, true, ""))
+	t.Run("with rejected symlink", compare("link", "file", RejectSymlink, true, ""))
+	t.Run("with skipped symlink", compare("link", "/etc/passwd", SkipSymlink, false, ""))
+}
+
+func TestTarUntarSymlinkChain(t *testing.T) {
+	compare := func(name string, headers []*tar.Header, wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			headers = append([]*tar.Header{{Name: "./", Mode: 0755, Typeflag: tar.TypeDir}}, headers...)
+			for _, h := range headers {
+				if err := tw.WriteHeader(h); err != nil {
+					t.Fatalf("tar header error: %v", err)
+				}
+				if _, err := tw.Write(bytes.Repeat([]byte("x"), int(h.Size))); err != nil {
+					t.Fatalf("tar write error: %v", err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("tar close error: %v", err)
+			}
+
+			target := "../testdata/untarsymlinkchain-" + name
+			outside := "../testdata/evil"
+			defer func() {
+				os.RemoveAll(target)
+				os.Remove(outside)
+			}()
+
+			err := UntarE(buf, target)
+			if !wantErr && err != nil {
+				t.Fatalf("untar error: %v", err)
+			} else if wantErr && (err == nil || !strings.Contains(err.Error(), "escapes")) {
+				t.Fatalf("want escape error: %v", err)
+			}
+
+			if _, err := os.Lstat(outside); !os.IsNotExist(err) {
+				t.Errorf("file is written outside target: %v", err)
+			}
+
+			if !wantErr {
+				info, err := os.Lstat(filepath.Join(target, "link"))
+				if err != nil || !info.Mode().IsRegular() {
+					t.Errorf("symlink is not replaced: %v", err)
+				}
+
+				if info, err := os.Stat(filepath.Join(target, "file")); err != nil || info.Size() != 0 {
+					t.Errorf("symlink target is written: %v", err)
+				}
+			}
+		}
+	}
+
+	t.Run("with chained parent symlinks", compare("parent", []*tar.Header{
+		{Name: "x", Linkname: ".", Typeflag: tar.TypeSymlink},
+		{Name: "x/y", Linkname: "..", Typeflag: tar.TypeSymlink},
+		{Name: "y/evil", Mode: 0644, Size: 4, Typeflag: tar.TypeReg},
+	}, true))
+	t.Run("with chained link target", compare("target", []*tar.Header{
+		{Name: "x", Linkname: ".", Typeflag: tar.TypeSymlink},
+		{Name: "y", Linkname: "x/..", Typeflag: tar.TypeSymlink},
+		{Name: "y/evil", Mode: 0644, Size: 4, Typeflag: tar.TypeReg},
+	}, true))
+	t.Run("with chained folder", compare("folder", []*tar.Header{
+		{Name: "x", Linkname: ".", Typeflag: tar.TypeSymlink},
+		{Name: "x/y", Linkname: "..", Typeflag: tar.TypeSymlink},
+		{Name: "y/", Mode: 0755, Typeflag: tar.TypeDir},
+	}, true))
+	t.Run("with file over symlink", compare("file", []*tar.Header{
+		{Name: "file", Mode: 0644, Typeflag: tar.TypeReg},
+		{Name: "link", Linkname: "file", Typeflag: tar.TypeSymlink},
+		{Name: "link", Mode: 0644, Size: 4, Typeflag: tar.TypeReg},
+	}, false))
+}
+
+func TestTarUntarHardLink(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, h := range []*tar.Header{
+		{Name: "./", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "link", Linkname: "../outside", Typeflag: tar.TypeLink},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("tar header error: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar close error: %v", err)
+	}
+
+	target := "../testdata/untarhardlink"
+	defer os.RemoveAll(target)
+
+	if err := UntarE(buf, target); err == nil {
+		t.Error("escaping hard link should error")
+	}
+}
+
+func TestTarUntarModeMask(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("file mode bits are not supported on windows")
+	}
+
+	compare := func(mask os.FileMode, overwrite bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			for _, h := range []*tar.Header{
+				{Name: "folder/", Mode: 0777, Typeflag: tar.TypeDir},
+				{Name: "folder/file", Mode: 0777, Typeflag: tar.TypeReg},
+			} {
+				if err := tw.WriteHeader(h); err != nil {
+					t.Fatalf("tar header error: %v", err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("tar close error: %v", err)
+			}
+
+			target := fmt.Sprintf("../testdata/untarmodemask-%04o-%t", mask, overwrite)
+			defer os.RemoveAll(target)
+
+			if overwrite {
+				// The existing file has every mode bit set.
+				existing := filepath.Join(target, "folder/file")
+				if err := os.MkdirAll(filepath.Dir(existing), 0755); err != nil {
+					t.Fatalf("mkdir error: %v", err)
+				}
+				if err := ioutil.WriteFile(existing, []byte("OLD"), 0644); err != nil {
+					t.Fatalf("write error: %v", err)
+				}
+				if err := os.Chmod(existing, 0777); err != nil {
+					t.Fatalf("chmod error: %v", err)
+				}
+			}
+
+			if err := UntarWithOptions(buf, target, &Options{ModeMask: mask}); err != nil {
+				t.Fatalf("untar error: %v", err)
+			}
+
+			for _, name := range []string{"folder", "folder/file"} {
+				info, err := os.Stat(filepath.Join(target, name))
+				if err != nil {
+					t.Fatalf("stat error: %v", err)
+				}
+
+				if got := info.Mode().Perm(); got&mask != 0 || got&0700 != 0700 {
+					t.Errorf("%s mode mismatch (mask: %04o, got: %04o)", name, mask, got)
+				}
+			}
+		}
+	}
+
+	t.Run("with default mask", compare(0, false))
+	t.Run("with group and other write mask", compare(0022, false))
+	t.Run("with group write and other mask", compare(0027, false))
+	t.Run("with overwritten file", compare(0027, true))
+}
+
+func TestTarUntarLongName(t *testing.T) {
+	t.Parallel()
+
+	folder := strings.Repeat("long-folder-name/", 8)
+	long := folder + "file"
+
+	compare := func(name string, format tar.Format, global *tar.Header) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			headers := []*tar.Header{
+				{Name: folder, Mode: 0755, Typeflag: tar.TypeDir, Format: format},
+				{Name: long, Mode: 0644, Size: 4, Typeflag: tar.TypeReg, Format: format},
+				{Name: long + "-link", Linkname: long, Typeflag: tar.TypeLink, Format: format},
+			}
+			if global != nil {
+				headers = append([]*tar.Header{global}, headers...)
+			}
+			for _, h := range headers {
+				if err := tw.WriteHeader(h); err != nil {
+					t.Fatalf("tar header error: %v", err)
+				}
+				if h.Size > 0 {
+					if _, err := tw.Write([]byte("data")); err != nil {
+						t.Fatalf("tar write error: %v", err)
+					}
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("tar close error: %v", err)
+			}
+
+			target := "../testdata/untarlongname-" + name
+			defer os.RemoveAll(target)
+
+			if err := UntarE(buf, target); err != nil {
+				t.Fatalf("untar error: %v", err)
+			}
+
+			for _, entry := range []string{long, long + "-link"} {
+				got, err := ioutil.ReadFile(filepath.Join(target, filepath.FromSlash(entry)))
+				if err != nil {
+					t.Fatalf("read error: %v", err)
+				}
+				if string(got) != "data" {
+					t.Errorf("%s mismatch (want: data, got: %s)", entry, got)
+				}
+			}
+		}
+	}
+
+	t.Run("with PAX long name", compare("pax", tar.FormatPAX, nil))
+	t.Run("with GNU long name", compare("gnu", tar.FormatGNU, nil))
+	t.Run("with PAX global header", compare("global", tar.FormatPAX,
+		&tar.Header{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "global"}}))
+	t.Run("with named PAX global header", compare("named-global", tar.FormatPAX,
+		&tar.Header{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader,
+			PAXRecords: map[string]string{"comment": "global"}}))
+	// POSIX names it $TMPDIR/GlobalHead.%p.%n by default.
+	t.Run("with absolute PAX global header", compare("absolute-global", tar.FormatPAX,
+		&tar.Header{Name: "/tmp/GlobalHead.1.1", Typeflag: tar.TypeXGlobalHeader,
+			PAXRecords: map[string]string{"comment": "global"}}))
+}
+
+// cancelReader is a reader that calls given cancel function once given bytes
+// are read.
+type cancelReader struct {
+	io.Reader
+	cancel func()
+	after  int
+	read   int
+}
+
+func (c *cancelReader) Read(buf []byte) (int, error) {
+	n, err := c.Reader.Read(buf)
+	if c.read += n; c.read >= c.after {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestTarUntarContext(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, name := range []string{"first", "second"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 64 << 10, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("tar header error: %v", err)
+		}
+		if _, err := tw.Write(make([]byte, 64<<10)); err != nil {
+			t.Fatalf("tar write error: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar close error: %v", err)
+	}
+
+	compare := func(name string, after int, wantErr error, want []string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			target := "../testdata/untarcontext-" + name
+			defer os.RemoveAll(target)
+
+			if err := os.MkdirAll(target, 0755); err != nil {
+				t.Fatalf("mkdir error: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var r io.Reader = bytes.NewReader(buf.Bytes())
+			if after >= 0 {
+				r = &cancelReader{Reader: r, cancel: cancel, after: after}
+			}
+
+			if err := UntarContext(ctx, r, target); err != wantErr {
+				t.Fatalf("error mismatch (want: %v, got: %v)", wantErr, err)
+			}
+
+			got := []string{}
+			for _, entry := range []string{"first", "second"} {
+				if _, err := os.Stat(filepath.Join(target, entry)); err == nil {
+					got = append(got, entry)
+				}
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with background context", compare("background", -1, nil, []string{"first", "second"}))
+	t.Run("with cancelled context", compare("cancelled", 0, context.Canceled, []string{}))
+	t.Run("with cancel mid-extraction", compare("mid", 32<<10, context.Canceled, []string{"first"}))
+}
@@ -10,58 +10,192 @@ package packer
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"math"
 	"os"
-	"path/filepath"
 )
 
 // Unzip reads the zip-compressed file from reader and writes it into target dir.
+// It will exit when it come across any error.
 func Unzip(r io.Reader, dir string) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		log.Fatalf("unzip mkdir -p %s error: %v", dir, err)
+	if err := UnzipE(r, dir); err != nil {
+		logFatalf("%v", err)
 	}
+}
 
-	buf := &bytes.Buffer{}
-	if _, err := io.Copy(buf, r); err != nil {
-		log.Fatalf("download zip error: %v", err)
+// UnzipE reads the zip-compressed file from reader and writes it into target
+// dir. It will return error when it come across one.
+func UnzipE(r io.Reader, dir string) error {
+	return UnzipWithOptions(r, dir, nil)
+}
+
+// UnzipWithOptions reads the zip-compressed file from reader and writes it into
+// target dir with given options. It will return error when it come across one.
+func UnzipWithOptions(r io.Reader, dir string, opts *Options) error {
+	_, err := UnzipFiles(r, dir, opts)
+	return err
+}
+
+// UnzipFiles is the same as UnzipWithOptions, except it returns absolute paths
+// of extracted directories and files in extraction order. Symlinks aren't
+// supported, they are extracted as regular files of their target path.
+// Directory entries are listed even when they already exist. The files
+// extracted so far are returned along with error when it come across one.
+func UnzipFiles(r io.Reader, dir string, opts *Options) ([]string, error) {
+	e := newExtraction(context.Background(), opts)
+	err := e.unzip(r, dir)
+	return e.files, err
+}
+
+// UnzipContext reads the zip-compressed file from reader and writes it into
+// target dir until given context is done. The context is checked while the
+// archive is read, between entries, and during entry copies, and the context
+// error is returned as-is on cancellation. It will return error when it come
+// across one.
+func UnzipContext(ctx context.Context, r io.Reader, dir string) error {
+	e := newExtraction(ctx, nil)
+	return e.contextErr(e.unzip(&contextReader{Reader: r, ctx: ctx}, dir))
+}
+
+// unzip reads the zip-compressed file from reader and writes it into target
+// dir. It will return error when it come across one.
+func (e *extraction) unzip(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unzip mkdir -p %s error: %w", dir, err)
 	}
 
-	b := bytes.NewReader(buf.Bytes())
-	zr, err := zip.NewReader(b, int64(b.Len()))
+	zr, closer, err := e.openZip(r)
 	if err != nil {
-		log.Fatalf("open zip error: %v", err)
+		return err
 	}
+	defer closer()
 
 	for _, f := range zr.File {
-		name := filepath.Join(dir, f.Name)
+		if err := e.ctx.Err(); err != nil {
+			return err
+		}
+
+		name, err := safeJoin(dir, f.Name)
+		if err != nil {
+			return fmt.Errorf("unzip %w", err)
+		}
+
+		// The entry might go through a symlink in the target dir.
+		if err := checkWithin(dir, name); err != nil {
+			return fmt.Errorf("unzip %w", err)
+		}
 
 		if f.FileInfo().IsDir() {
-			if err := os.MkdirAll(name, f.Mode()); err != nil {
-				log.Fatalf("unzip mkdir -p %s error: %v", name, err)
+			if err := os.MkdirAll(name, e.mode(f.Mode())); err != nil {
+				return fmt.Errorf("unzip mkdir -p %s error: %w", name, err)
+			}
+			// An existing folder keeps its mode on mkdir.
+			if err := e.chmod(name, e.mode(f.Mode())); err != nil {
+				return fmt.Errorf("unzip chmod %s error: %w", name, err)
 			}
+			e.record(name)
 			continue
 		}
 
-		unzipEntry(f, name)
+		if err := e.unzipEntry(f, name); err != nil {
+			return err
+		}
+		e.record(name)
+	}
+
+	return nil
+}
+
+// openZip reads the zip-compressed file from reader into memory, or into a
+// temporary file when it is larger than configured SpoolBytes, since zip needs
+// random access. It returns a function to remove the temporary file, if any. It
+// will return error when it come across one.
+func (e *extraction) openZip(r io.Reader) (*zip.Reader, func(), error) {
+	buf := &bytes.Buffer{}
+
+	var err error
+	if e.SpoolBytes > 0 {
+		_, err = io.CopyN(buf, r, e.SpoolBytes+1)
+	} else {
+		_, err = io.Copy(buf, r)
+	}
+
+	if err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("download zip error: %w", err)
+	}
+
+	if e.SpoolBytes <= 0 || err == io.EOF {
+		// The whole archive is read within the threshold.
+		b := bytes.NewReader(buf.Bytes())
+		zr, err := zip.NewReader(b, int64(b.Len()))
+		if err != nil {
+			return nil, nil, fmt.Errorf("open zip error: %w", err)
+		}
+		return zr, func() {}, nil
+	}
+
+	file, err := ioutil.TempFile(e.TempDir, "unzip-*.zip")
+	if err != nil {
+		return nil, nil, fmt.Errorf("unzip spool error: %w", err)
+	}
+	closer := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	size, err := io.Copy(file, io.MultiReader(buf, r))
+	if err != nil {
+		closer()
+		return nil, nil, fmt.Errorf("download zip error: %w", err)
 	}
+
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		closer()
+		return nil, nil, fmt.Errorf("open zip error: %w", err)
+	}
+
+	return zr, closer, nil
 }
 
-// unzipEntry creates new file or folder on given zip file entry.
-func unzipEntry(f *zip.File, name string) {
+// unzipEntry creates new file on given zip file entry. It will return error
+// when it come across one.
+func (e *extraction) unzipEntry(f *zip.File, name string) error {
+	if f.UncompressedSize64 > math.MaxInt64 {
+		return fmt.Errorf("unzip %s: %w", name, ErrTooLarge)
+	}
+
+	if err := e.check(f.Name, int64(f.UncompressedSize64)); err != nil {
+		return fmt.Errorf("unzip %w", err)
+	}
+
 	src, err := f.Open()
 	if err != nil {
-		log.Fatalf("unzip open file error: %v", err)
+		return fmt.Errorf("unzip open file error: %w", err)
 	}
 	defer src.Close()
 
-	dst, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, f.Mode())
+	if err := removeSymlink(name); err != nil {
+		return fmt.Errorf("unzip %w", err)
+	}
+
+	dst, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, e.mode(f.Mode()))
 	if err != nil {
-		log.Fatalf("unzip create file error: %v", err)
+		return fmt.Errorf("unzip create file error: %w", err)
 	}
 	defer dst.Close()
 
-	if _, err := io.Copy(dst, src); err != nil {
-		log.Fatalf("unzip write file error: %v", err)
+	if _, err := e.copy(f.Name, int64(f.UncompressedSize64), dst, src); err != nil {
+		return fmt.Errorf("unzip write file error: %w", err)
 	}
+
+	// An existing file keeps its mode on open.
+	if err := e.chmod(name, e.mode(f.Mode())); err != nil {
+		return fmt.Errorf("unzip chmod file error: %w", err)
+	}
+
+	return nil
 }
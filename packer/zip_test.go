@@ -8,7 +8,18 @@
 package packer
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -21,10 +32,14 @@ func TestZipUnzip(t *testing.T) {
 
 			target := "../testdata/unzip"
 			file, _ := os.Open("../testdata/packer.zip")
+			defer file.Close()
 			Unzip(file, target)
 
 			switch wantErr {
 			case 0:
+				if _, err := os.Stat(target + "/folder/file"); err != nil {
+					t.Errorf("missing file %s: %v", target+"/folder/file", err)
+				}
 			}
 
 			os.RemoveAll(target)
@@ -33,3 +48,348 @@ func TestZipUnzip(t *testing.T) {
 
 	t.Run("with valid file", compare(0))
 }
+
+func TestZipUnzipE(t *testing.T) {
+	t.Parallel()
+
+	compare := func(wantErr bool, r io.Reader) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			target := fmt.Sprintf("../testdata/unzipe-%t", wantErr)
+			defer os.RemoveAll(target)
+
+			if err := UnzipE(r, target); !wantErr && err != nil {
+				t.Errorf("unzip error: %v", err)
+			} else if wantErr && err == nil {
+				t.Error("want error")
+			}
+		}
+	}
+
+	valid, _ := ioutil.ReadFile("../testdata/packer.zip")
+	corrupt := append([]byte{}, valid[:len(valid)/2]...)
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	if w, err := zw.Create("../evil"); err != nil {
+		t.Fatalf("zip create error: %v", err)
+	} else if _, err := w.Write([]byte("evil")); err != nil {
+		t.Fatalf("zip write error: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip close error: %v", err)
+	}
+
+	t.Run("with valid file", compare(false, bytes.NewReader(valid)))
+	t.Run("with path traversal", compare(true, bytes.NewReader(buf.Bytes())))
+	t.Run("with non-zip file", compare(true, strings.NewReader("corrupt")))
+	t.Run("with truncated file", compare(true, bytes.NewReader(corrupt)))
+}
+
+// errReader is a reader that always returns given error.
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+func TestZipUnzipReadError(t *testing.T) {
+	t.Parallel()
+
+	want := errors.New("read error")
+
+	compare := func(opts *Options) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			target := fmt.Sprintf("../testdata/unzipreaderror-%t", opts != nil)
+			defer os.RemoveAll(target)
+
+			r := io.MultiReader(strings.NewReader("PK"), &errReader{want})
+			err := UnzipWithOptions(r, target, opts)
+			if !errors.Is(err, want) || !strings.HasPrefix(err.Error(), "download zip error") {
+				t.Errorf("error mismatch (want: %v, got: %v)", want, err)
+			}
+		}
+	}
+
+	t.Run("with in-memory archive", compare(nil))
+	t.Run("with spooled archive", compare(&Options{SpoolBytes: 1}))
+}
+
+func TestZipUnzipWithOptions(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, name := range []string{"first", "second"} {
+		if w, err := zw.Create(name); err != nil {
+			t.Fatalf("zip create error: %v", err)
+		} else if _, err := w.Write(make([]byte, 100)); err != nil {
+			t.Fatalf("zip write error: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip close error: %v", err)
+	}
+
+	compare := func(wantErr bool, opts *Options) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			target := fmt.Sprintf("../testdata/unzipopts-%p", opts)
+			defer os.RemoveAll(target)
+
+			err := UnzipWithOptions(bytes.NewReader(buf.Bytes()), target, opts)
+			if !wantErr && err != nil {
+				t.Errorf("unzip error: %v", err)
+			} else if wantErr && !errors.Is(err, ErrTooLarge) {
+				t.Errorf("want ErrTooLarge: %v", err)
+			}
+		}
+	}
+
+	t.Run("without options", compare(false, nil))
+	t.Run("within limits", compare(false, &Options{MaxEntryBytes: 100, MaxExtractBytes: 200}))
+	t.Run("with entry over limit", compare(true, &Options{MaxEntryBytes: 99}))
+	t.Run("with total over limit", compare(true, &Options{MaxExtractBytes: 150}))
+}
+
+func TestZipUnzipProgress(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	if w, err := zw.Create("entry"); err != nil {
+		t.Fatalf("zip create error: %v", err)
+	} else if _, err := w.Write(make([]byte, 100)); err != nil {
+		t.Fatalf("zip write error: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip close error: %v", err)
+	}
+
+	target := "../testdata/unzipprogress"
+	defer os.RemoveAll(target)
+
+	var written []int64
+	opts := &Options{Progress: func(entry string, n, total int64) {
+		if entry != "entry" || total != 100 {
+			t.Errorf("progress mismatch: %s, %d", entry, total)
+		}
+		written = append(written, n)
+	}}
+
+	if err := UnzipWithOptions(bytes.NewReader(buf.Bytes()), target, opts); err != nil {
+		t.Fatalf("unzip error: %v", err)
+	}
+
+	if len(written) < 2 || written[0] != 0 || written[len(written)-1] != 100 {
+		t.Errorf("progress should go from 0 to 100: %v", written)
+	}
+}
+
+func TestZipUnzipFiles(t *testing.T) {
+	t.Parallel()
+
+	target := "../testdata/unzipfiles"
+	defer os.RemoveAll(target)
+
+	file, _ := os.Open("../testdata/packer.zip")
+	defer file.Close()
+
+	got, err := UnzipFiles(file, target, nil)
+	if err != nil {
+		t.Fatalf("unzip error: %v", err)
+	}
+
+	abs, _ := filepath.Abs(target)
+	want := []string{filepath.Join(abs, "file"), filepath.Join(abs, "folder"),
+		filepath.Join(abs, "folder", "file")}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestZipUnzipSpool(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	zw.Create("folder/")
+	for i := 0; i < 8; i++ {
+		w, _ := zw.Create(fmt.Sprintf("folder/file-%d", i))
+		w.Write(bytes.Repeat([]byte(fmt.Sprintf("content %d\n", i)), 16<<10))
+	}
+	zw.Close()
+	archive := buf.Bytes()
+
+	spoolDir := "../testdata/unzipspool"
+	os.MkdirAll(spoolDir, 0755)
+	defer os.RemoveAll(spoolDir)
+
+	extract := func(target string, opts *Options) map[string]string {
+		defer os.RemoveAll(target)
+
+		names, err := UnzipFiles(bytes.NewReader(archive), target, opts)
+		if err != nil {
+			t.Fatalf("unzip error: %v", err)
+		}
+
+		abs, _ := filepath.Abs(target)
+		files := map[string]string{}
+		for _, name := range names {
+			if b, err := ioutil.ReadFile(name); err == nil {
+				rel, _ := filepath.Rel(abs, name)
+				files[rel] = string(b)
+			}
+		}
+		return files
+	}
+
+	inMemory := extract("../testdata/unzipmemory", nil)
+	spooled := extract("../testdata/unzipspooled", &Options{SpoolBytes: 1024, TempDir: spoolDir})
+
+	if len(inMemory) != 8 {
+		t.Errorf("file count mismatch (want: 8, got: %d)", len(inMemory))
+	}
+
+	if diff := cmp.Diff(inMemory, spooled); diff != "" {
+		t.Errorf("mismatch (-memory +spooled):\n%s", diff)
+	}
+
+	if left, _ := ioutil.ReadDir(spoolDir); len(left) != 0 {
+		t.Errorf("spooled file is left behind: %v", left[0].Name())
+	}
+
+	if _, err := UnzipFiles(strings.NewReader("not a zip"), "../testdata/unzipinvalid",
+		&Options{SpoolBytes: 4, TempDir: spoolDir}); err == nil {
+		t.Error("want open zip error")
+	}
+	os.RemoveAll("../testdata/unzipinvalid")
+
+	if left, _ := ioutil.ReadDir(spoolDir); len(left) != 0 {
+		t.Errorf("spooled file is left behind on error: %v", left[0].Name())
+	}
+}
+
+func TestZipUnzipModeMask(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("file mode bits are not supported on windows")
+	}
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, name := range []string{"folder/", "folder/file"} {
+		h := &zip.FileHeader{Name: name}
+		if strings.HasSuffix(name, "/") {
+			h.SetMode(os.ModeDir | 0777)
+		} else {
+			h.SetMode(0777)
+		}
+		if _, err := zw.CreateHeader(h); err != nil {
+			t.Fatalf("zip header error: %v", err)
+		}
+	}
+	zw.Close()
+
+	target := "../testdata/unzipmodemask"
+	defer os.RemoveAll(target)
+
+	// The existing file has every mode bit set.
+	existing := filepath.Join(target, "folder/file")
+	if err := os.MkdirAll(filepath.Dir(existing), 0755); err != nil {
+		t.Fatalf("mkdir error: %v", err)
+	}
+	if err := ioutil.WriteFile(existing, []byte("OLD"), 0644); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if err := os.Chmod(existing, 0777); err != nil {
+		t.Fatalf("chmod error: %v", err)
+	}
+
+	if err := UnzipWithOptions(buf, target, &Options{ModeMask: 0027}); err != nil {
+		t.Fatalf("unzip error: %v", err)
+	}
+
+	for _, name := range []string{"folder", "folder/file"} {
+		info, err := os.Stat(filepath.Join(target, name))
+		if err != nil {
+			t.Fatalf("stat error: %v", err)
+		}
+
+		if got := info.Mode().Perm(); got != 0750 {
+			t.Errorf("%s mode mismatch (want: 0750, got: %04o)", name, got)
+		}
+	}
+}
+
+func TestZipUnzipContext(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, name := range []string{"first", "second"} {
+		if w, err := zw.Create(name); err != nil {
+			t.Fatalf("zip create error: %v", err)
+		} else if _, err := w.Write(make([]byte, 64<<10)); err != nil {
+			t.Fatalf("zip write error: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip close error: %v", err)
+	}
+
+	compare := func(name string, cancelAt string, wantErr error, want []string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			target := "../testdata/unzipcontext-" + name
+			defer os.RemoveAll(target)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var err error
+			switch cancelAt {
+			case "":
+				err = UnzipContext(ctx, bytes.NewReader(buf.Bytes()), target)
+			case "read":
+				// The archive is read as a whole before any entry.
+				r := &cancelReader{Reader: bytes.NewReader(buf.Bytes()), cancel: cancel, after: 1}
+				err = UnzipContext(ctx, r, target)
+			default:
+				e := newExtraction(ctx, &Options{Progress: func(entry string, n, total int64) {
+					if entry == cancelAt && n > 0 {
+						cancel()
+					}
+				}})
+				err = e.contextErr(e.unzip(bytes.NewReader(buf.Bytes()), target))
+			}
+
+			if err != wantErr {
+				t.Fatalf("error mismatch (want: %v, got: %v)", wantErr, err)
+			}
+
+			got := []string{}
+			for _, entry := range []string{"first", "second"} {
+				if info, err := os.Stat(filepath.Join(target, entry)); err == nil && info.Size() == 64<<10 {
+					got = append(got, entry)
+				}
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with background context", compare("background", "", nil, []string{"first", "second"}))
+	t.Run("with cancel while reading", compare("read", "read", context.Canceled, []string{}))
+	t.Run("with cancel mid-entry", compare("entry", "first", context.Canceled, []string{}))
+}
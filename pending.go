@@ -0,0 +1,152 @@
+// pending.go - Pending update related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// getPendingNames returns pending update file name and its marker file name.
+func (h *Host) getPendingNames() (string, string) {
+	return h.getStateName(".new"), h.getStateName(".pending")
+}
+
+// writePending will write given content to a new file next to current
+// executable and mark it as pending with its SHA-256 checksum, after it is
+// verified against given SHA-256 checksum, if any, and validated against given
+// version on VerifyArgs. It will return error when it come across one.
+func (h *Host) writePending(body io.Reader, hash, version string, mode os.FileMode) error {
+	newName, markerName := h.getPendingNames()
+
+	// The marker is only present when the pending update is complete.
+	if err := os.Remove(markerName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := fs.OpenFile(newName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	_, err = ioCopy(io.MultiWriter(file, hasher), body)
+	err = appendError(err, file.Close())
+
+	sum := hasher.Sum(nil)
+	if err == nil {
+		err = verifyChecksum(sum, hash)
+	}
+
+	if err == nil && len(h.VerifyArgs) > 0 {
+		if err = h.finalizeExecutable(newName, mode); err == nil {
+			err = h.verifyExecutable(newName, version)
+		}
+	}
+
+	if err == nil {
+		err = ioutilWriteFile(markerName, []byte(hex.EncodeToString(sum)), 0644)
+	}
+
+	if err != nil {
+		os.Remove(newName)
+		return err
+	}
+
+	h.logger().Printf("Update is pending until next start")
+	return nil
+}
+
+// ApplyPendingUpdate replaces current executable with pending update that was
+// downloaded by AutoUpdateCheck on DeferUpdate, if any. The pending update will
+// be verified against its recorded SHA-256 checksum and discarded on mismatch.
+// It should be called early in func main, the update takes effect on next
+// start. It will return error when it come across one.
+//
+//   messaging := (&host.Host{DeferUpdate: true}).Init()
+//
+//   if err := messaging.ApplyPendingUpdate(); err != nil {
+//     log.Printf("messaging.ApplyPendingUpdate error: %v", err)
+//   }
+func (h *Host) ApplyPendingUpdate() error {
+	newName, markerName := h.getPendingNames()
+
+	marker, err := ioutil.ReadFile(markerName)
+	if err != nil {
+		// Nothing is pending, or it is still incomplete.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	sum, err := fileChecksum(newName)
+	if err == nil {
+		err = verifyChecksum(sum, strings.TrimSpace(string(marker)))
+	}
+
+	if err != nil {
+		os.Remove(newName)
+		os.Remove(markerName)
+		return fmt.Errorf("Pending update is discarded: %w", err)
+	}
+
+	// Reuse original mode, otherwise fall back to 0755.
+	mode := os.FileMode(0755)
+	if info, err := os.Stat(h.ExecName); err == nil {
+		mode = fileMode(info)
+	}
+
+	if err := h.finalizeExecutable(newName, mode); err != nil {
+		return err
+	}
+
+	// Running executable can't be overwritten on Windows, but it can be moved.
+	if err := osRename(newName, h.ExecName); err != nil {
+		backupName := h.getStateName(h.getBackupSuffix())
+		if err := moveFile(h.ExecName, backupName); err != nil {
+			return err
+		}
+
+		if err := moveFile(newName, h.ExecName); err != nil {
+			if mvErr := moveFile(backupName, h.ExecName); mvErr != nil {
+				err = fmt.Errorf("%w %v", err, mvErr)
+			}
+			return err
+		}
+
+		// It might be locked by current process, best effort only.
+		os.Remove(backupName)
+	}
+
+	os.Remove(markerName)
+	h.logger().Printf("Pending update is applied")
+	return nil
+}
+
+// fileChecksum returns SHA-256 sum of given file content. It will return error
+// when it come across one.
+func fileChecksum(name string) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, err
+	}
+
+	return hasher.Sum(nil), nil
+}
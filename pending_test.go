@@ -0,0 +1,189 @@
+// pending_test.go - Test for pending update related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPendingApplyPendingUpdate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	sum := sha256.Sum256([]byte("NEW"))
+
+	compare := func(wantErr int, want *H) func(t *testing.T) {
+		return func(t *testing.T) {
+			targetName := fmt.Sprintf("testdata/pending-%d", wantErr)
+			h := &Host{ExecName: targetName}
+
+			defer func() {
+				os.Remove(targetName)
+				os.Remove(targetName + ".new")
+				os.Remove(targetName + ".pending")
+			}()
+
+			if err := ioutil.WriteFile(targetName, []byte("OLD"), 0750); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+
+			switch wantErr {
+			case 0, 2:
+				marker := hex.EncodeToString(sum[:])
+				if wantErr == 2 {
+					marker = hex.EncodeToString(make([]byte, sha256.Size))
+				}
+				if err := ioutil.WriteFile(targetName+".new", []byte("NEW"), 0644); err != nil {
+					t.Fatalf("touch file error: %v", err)
+				}
+				if err := ioutil.WriteFile(targetName+".pending", []byte(marker), 0644); err != nil {
+					t.Fatalf("touch file error: %v", err)
+				}
+			case 1:
+				// Incomplete download has no marker.
+				if err := ioutil.WriteFile(targetName+".new", []byte("NEW"), 0644); err != nil {
+					t.Fatalf("touch file error: %v", err)
+				}
+			}
+
+			if err := h.ApplyPendingUpdate(); wantErr < 2 && err != nil {
+				t.Fatalf("apply error: %v", err)
+			} else if wantErr == 2 && err == nil {
+				t.Fatal("want error")
+			}
+
+			current, _ := ioutil.ReadFile(targetName)
+			info, _ := os.Stat(targetName)
+			_, newErr := os.Stat(targetName + ".new")
+			_, markerErr := os.Stat(targetName + ".pending")
+			got := &H{"current": string(current), "mode": info.Mode().Perm().String(),
+				"new": newErr == nil, "marker": markerErr == nil}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch for %d (-want +got):\n%s", wantErr, diff)
+			}
+		}
+	}
+
+	t.Run("with valid pending update", compare(0, &H{"current": "NEW", "mode": "-rwxr-x---",
+		"new": false, "marker": false}))
+	t.Run("with no pending update", compare(-1, &H{"current": "OLD", "mode": "-rwxr-x---",
+		"new": false, "marker": false}))
+	t.Run("with incomplete pending update", compare(1, &H{"current": "OLD", "mode": "-rwxr-x---",
+		"new": true, "marker": false}))
+	t.Run("with mismatching checksum", compare(2, &H{"current": "OLD", "mode": "-rwxr-x---",
+		"new": false, "marker": false}))
+}
+
+func TestPendingDeferUpdate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	oldRuntimeGOOS := runtimeGOOS
+	defer func() { runtimeGOOS = oldRuntimeGOOS }()
+	runtimeGOOS = "linux"
+
+	compare := func(wantErr bool, hash string, want *H) func(t *testing.T) {
+		return func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_, _ = rw.Write([]byte("NEW"))
+			}))
+			targetName := fmt.Sprintf("testdata/defer-%t", wantErr)
+			h := &Host{DeferUpdate: true, ExecName: targetName}
+
+			defer func() {
+				os.Remove(targetName)
+				os.Remove(targetName + ".new")
+				os.Remove(targetName + ".pending")
+				server.Close()
+			}()
+
+			if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+
+			if err := h.downloadLatest(server.URL, hash, ""); !wantErr && err != nil {
+				t.Fatalf("download error: %v", err)
+			} else if wantErr && err == nil {
+				t.Fatal("want error")
+			}
+
+			current, _ := ioutil.ReadFile(targetName)
+			pending, _ := ioutil.ReadFile(targetName + ".new")
+			_, markerErr := os.Stat(targetName + ".pending")
+
+			if err := h.ApplyPendingUpdate(); err != nil {
+				t.Fatalf("apply error: %v", err)
+			}
+
+			applied, _ := ioutil.ReadFile(targetName)
+			got := &H{"current": string(current), "pending": string(pending),
+				"marker": markerErr == nil, "applied": string(applied)}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	sum := sha256.Sum256([]byte("NEW"))
+
+	t.Run("with matching checksum", compare(false, hex.EncodeToString(sum[:]),
+		&H{"current": "OLD", "pending": "NEW", "marker": true, "applied": "NEW"}))
+	t.Run("with mismatching checksum", compare(true, hex.EncodeToString(make([]byte, sha256.Size)),
+		&H{"current": "OLD", "pending": "", "marker": false, "applied": "OLD"}))
+}
+
+func TestPendingStateDir(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	stateDir := "testdata/pending-state"
+	targetName := "testdata/stateful-pending"
+	h := &Host{ExecName: targetName, StateDir: stateDir}
+
+	defer func() {
+		os.Remove(targetName)
+		os.RemoveAll(stateDir)
+	}()
+
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		t.Fatalf("mkdir error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(targetName, []byte("OLD"), 0755); err != nil {
+		t.Fatalf("touch file error: %v", err)
+	}
+
+	if err := h.writePending(bytes.NewBufferString("NEW"), "", "", 0755); err != nil {
+		t.Fatalf("write pending error: %v", err)
+	}
+
+	for _, ext := range []string{".new", ".pending"} {
+		if _, err := os.Stat(filepath.Join(stateDir, "stateful-pending"+ext)); err != nil {
+			t.Errorf("missing %s: %v", ext, err)
+		}
+		if _, err := os.Stat(targetName + ext); !os.IsNotExist(err) {
+			t.Errorf("%s is written next to executable: %v", ext, err)
+		}
+	}
+
+	if err := h.ApplyPendingUpdate(); err != nil {
+		t.Fatalf("apply error: %v", err)
+	}
+
+	if got, _ := ioutil.ReadFile(targetName); string(got) != "NEW" {
+		t.Errorf("content mismatch (want: NEW, got: %s)", got)
+	}
+}
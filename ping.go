@@ -0,0 +1,76 @@
+// ping.go - Readiness probe related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Ping is like PingContext, but it gives up after PingTimeout seconds. It will
+// return error when it come across one.
+//
+//   messaging := (&host.Host{}).Init()
+//
+//   if err := messaging.Ping(conn); err != nil {
+//     log.Fatalf("messaging.Ping error: %v", err)
+//   }
+func (h *Host) Ping(rw io.ReadWriter) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PingTimeout*time.Second)
+	defer cancel()
+
+	return h.PingContext(ctx, rw)
+}
+
+// PingContext sends a framed {"type":"ping"} message to given connected peer
+// and waits for a framed {"type":"pong"} response, i.e.: as a readiness probe.
+// It returns the context error when given context is done first. The read is
+// interrupted with a read deadline when given peer supports it, i.e.: *os.File
+// or net.Conn, and it is waited for, otherwise the read carries on in
+// background. Either way, given peer shouldn't be reused after the abort. It
+// will return error when it come across one.
+//
+//   messaging := (&host.Host{}).Init()
+//
+//   ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//   defer cancel()
+//
+//   if err := messaging.PingContext(ctx, conn); err != nil {
+//     log.Fatalf("messaging.PingContext error: %v", err)
+//   }
+func (h *Host) PingContext(ctx context.Context, rw io.ReadWriter) error {
+	if err := h.PostMessageContext(ctx, rw, H{"type": "ping"}); err != nil {
+		return err
+	}
+
+	var setDeadline func(time.Time) error
+	if deadliner, ok := rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+		setDeadline = deadliner.SetReadDeadline
+	}
+
+	setDeadline = applyDeadline(ctx, setDeadline)
+	if setDeadline != nil {
+		defer setDeadline(time.Time{})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		response := H{}
+		if err := h.readMessage(rw, &response); err != nil {
+			done <- err
+		} else if response["type"] != "pong" {
+			done <- fmt.Errorf("Unexpected ping response: %v", response)
+		} else {
+			done <- nil
+		}
+	}()
+
+	return awaitContext(ctx, done, setDeadline)
+}
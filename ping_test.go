@@ -0,0 +1,102 @@
+// ping_test.go - Test for readiness probe related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// pingPeer answers a ping on given connection with given response, if any.
+func pingPeer(conn io.ReadWriter, response H) {
+	request := H{}
+	if err := NewMessageReader(conn).ReadMessage(&request); err != nil {
+		return
+	}
+	if request["type"] == "ping" && response != nil {
+		NewMessageWriter(conn).WriteMessage(response)
+	}
+}
+
+func TestPingPing(t *testing.T) {
+	t.Parallel()
+
+	clientSide, hostSide := NewPipe()
+	defer clientSide.Close()
+	defer hostSide.Close()
+
+	go pingPeer(hostSide, H{"type": "pong"})
+
+	if err := (&Host{ByteOrder: nativeByteOrder}).Ping(clientSide); err != nil {
+		t.Errorf("ping error: %v", err)
+	}
+}
+
+func TestPingPingContext(t *testing.T) {
+	t.Parallel()
+
+	compare := func(response H, wantErr bool, wantTimeout bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			clientSide, hostSide := NewPipe()
+			defer clientSide.Close()
+			defer hostSide.Close()
+
+			go pingPeer(hostSide, response)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			err := (&Host{ByteOrder: nativeByteOrder}).PingContext(ctx, clientSide)
+			if !wantErr && err != nil {
+				t.Fatalf("ping error: %v", err)
+			} else if wantErr && err == nil {
+				t.Fatal("want error")
+			}
+
+			if timeout := err == context.DeadlineExceeded; timeout != wantTimeout {
+				t.Errorf("timeout mismatch (want: %t, got: %v)", wantTimeout, err)
+			}
+		}
+	}
+
+	t.Run("with pong", compare(H{"type": "pong"}, false, false))
+	t.Run("with unexpected response", compare(H{"type": "ping"}, true, false))
+	t.Run("with silent peer", compare(nil, true, true))
+}
+
+func TestPingPingContextCancel(t *testing.T) {
+	t.Parallel()
+
+	clientSide, hostSide := net.Pipe()
+	defer clientSide.Close()
+	defer hostSide.Close()
+
+	// Read the ping, then stay silent.
+	go NewMessageReader(hostSide).ReadMessage(&H{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	if err := (&Host{ByteOrder: nativeByteOrder}).PingContext(ctx, clientSide); err != context.Canceled {
+		t.Fatalf("error mismatch (want: %v, got: %v)", context.Canceled, err)
+	}
+
+	// The interrupted read doesn't carry on after the return, so a late pong
+	// has no reader.
+	_ = hostSide.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := NewMessageWriter(hostSide).WriteMessage(H{"type": "pong"}); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read leaked after return: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+// router.go - Message type dispatch router.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrUnknownType is returned by Dispatch when no handler is registered for the
+// message type.
+var ErrUnknownType = errors.New("message type is unknown")
+
+// A HandlerFunc handles given message and returns the response.
+type HandlerFunc func(H) (H, error)
+
+// A Router dispatches messages to registered handlers by the message type, its
+// zero value is ready to use.
+//
+// Key is the message field that holds the message type, "type" is used when it
+// is empty.
+type Router struct {
+	Key string
+
+	handlers map[string]HandlerFunc
+	mu       sync.RWMutex
+}
+
+// Handle registers given handler for given message type, it replaces the
+// previous handler of the same message type, if any.
+//
+//   router := &host.Router{}
+//
+//   router.Handle("ping", func(request host.H) (host.H, error) {
+//     return host.H{"type": "pong"}, nil
+//   })
+func (r *Router) Handle(messageType string, handler HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.handlers == nil {
+		r.handlers = map[string]HandlerFunc{}
+	}
+	r.handlers[messageType] = handler
+}
+
+// Dispatch calls the registered handler of given message type and returns its
+// response. It will return ErrUnknownType when the message type is absent or
+// has no handler, or the handler error.
+//
+//   request := &host.H{}
+//   if err := messaging.OnMessage(os.Stdin, request); err != nil {
+//     log.Fatalf("messaging.OnMessage error: %v", err)
+//   }
+//
+//   response, err := router.Dispatch(*request)
+//   if err != nil {
+//     response = host.H{"error": err.Error()}
+//   }
+func (r *Router) Dispatch(msg H) (H, error) {
+	key := r.getKey()
+
+	messageType, _ := msg[key].(string)
+
+	r.mu.RLock()
+	handler, ok := r.handlers[messageType]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%s %q: %w", key, messageType, ErrUnknownType)
+	}
+
+	return handler(msg)
+}
+
+// getKey returns configured message type field, otherwise "type".
+func (r *Router) getKey() string {
+	if r.Key != "" {
+		return r.Key
+	}
+	return "type"
+}
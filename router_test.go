@@ -0,0 +1,75 @@
+// router_test.go - Test for message type dispatch router.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestRouterDispatch(t *testing.T) {
+	t.Parallel()
+
+	handlerErr := errors.New("handler error")
+
+	newRouter := func(key string) *Router {
+		r := &Router{Key: key}
+		r.Handle("ping", func(msg H) (H, error) {
+			return H{"type": "pong", "id": msg["id"]}, nil
+		})
+		r.Handle("fail", func(H) (H, error) {
+			return nil, handlerErr
+		})
+		return r
+	}
+
+	compare := func(r *Router, msg H, wantErr error, want H) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			got, err := r.Dispatch(msg)
+			if !errors.Is(err, wantErr) {
+				t.Errorf("error mismatch (want: %v, got: %v)", wantErr, err)
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with known type", compare(newRouter(""), H{"type": "ping", "id": 1.0}, nil,
+		H{"type": "pong", "id": 1.0}))
+	t.Run("with handler error", compare(newRouter(""), H{"type": "fail"}, handlerErr, nil))
+	t.Run("with unknown type", compare(newRouter(""), H{"type": "other"}, ErrUnknownType, nil))
+	t.Run("with missing type", compare(newRouter(""), H{"action": "ping"}, ErrUnknownType, nil))
+	t.Run("with non-string type", compare(newRouter(""), H{"type": 1.0}, ErrUnknownType, nil))
+	t.Run("with custom key", compare(newRouter("action"), H{"action": "ping", "id": 2.0}, nil,
+		H{"type": "pong", "id": 2.0}))
+	t.Run("with custom key ignoring type", compare(newRouter("action"), H{"type": "ping"},
+		ErrUnknownType, nil))
+	t.Run("with no handlers", compare(&Router{}, H{"type": "ping"}, ErrUnknownType, nil))
+}
+
+func TestRouterHandle(t *testing.T) {
+	t.Parallel()
+
+	r := &Router{}
+	r.Handle("ping", func(H) (H, error) { return H{"version": 1.0}, nil })
+	r.Handle("ping", func(H) (H, error) { return H{"version": 2.0}, nil })
+
+	got, err := r.Dispatch(H{"type": "ping"})
+	if err != nil {
+		t.Fatalf("dispatch error: %v", err)
+	}
+
+	if diff := cmp.Diff(H{"version": 2.0}, got); diff != "" {
+		t.Errorf("later handler should win (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,38 @@
+// scope.go - Install location scope related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import "os"
+
+// Scope represents whether native messaging host is installed for current user
+// or system-wide.
+type Scope int
+
+// The install location scopes.
+const (
+	// AutoScope selects SystemScope for root user, otherwise UserScope.
+	AutoScope Scope = iota
+	// UserScope selects per-user location, i.e.: HKEY_CURRENT_USER.
+	UserScope
+	// SystemScope selects system-wide location, i.e.: HKEY_LOCAL_MACHINE.
+	SystemScope
+)
+
+// isSystemWide returns true if configured Scope is system-wide, otherwise
+// false.
+func (h *Host) isSystemWide() bool {
+	switch h.Scope {
+	case UserScope:
+		return false
+	case SystemScope:
+		return true
+	}
+
+	// It is always -1 on Windows.
+	return os.Getuid() == 0
+}
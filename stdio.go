@@ -0,0 +1,55 @@
+// stdio.go - Standard streams messaging related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"io"
+	"os"
+)
+
+// Receive is the same as OnMessage, except it reads from configured In,
+// otherwise os.Stdin. It will return ErrEmptyMessage on zero length message, or
+// error when it come across one.
+//
+//   messaging := (&host.Host{}).Init()
+//   request := &host.H{}
+//
+//   if err := messaging.Receive(request); err != nil {
+//     log.Fatalf("messaging.Receive error: %v", err)
+//   }
+func (h *Host) Receive(v interface{}) error {
+	return h.OnMessage(h.in(), v)
+}
+
+// Send is the same as PostMessage, except it writes to configured Out,
+// otherwise os.Stdout. It will return error when it come across one.
+//
+//   messaging := (&host.Host{}).Init()
+//
+//   if err := messaging.Send(&host.H{"key": "value"}); err != nil {
+//     log.Fatalf("messaging.Send error: %v", err)
+//   }
+func (h *Host) Send(v interface{}) error {
+	return h.PostMessage(h.out(), v)
+}
+
+// in returns configured In, otherwise os.Stdin.
+func (h *Host) in() io.Reader {
+	if h.In != nil {
+		return h.In
+	}
+	return os.Stdin
+}
+
+// out returns configured Out, otherwise os.Stdout.
+func (h *Host) out() io.Writer {
+	if h.Out != nil {
+		return h.Out
+	}
+	return os.Stdout
+}
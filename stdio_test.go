@@ -0,0 +1,58 @@
+// stdio_test.go - Test for standard streams messaging related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"testing"
+)
+
+func TestStdioSendReceive(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	h := &Host{ByteOrder: binary.LittleEndian, In: buf, Out: buf}
+
+	for _, message := range []H{{"key": "value"}, {"id": 2.0}} {
+		if err := h.Send(message); err != nil {
+			t.Fatalf("send error: %v", err)
+		}
+	}
+
+	if got := buf.Bytes()[:4]; !bytes.Equal(got, []byte{15, 0, 0, 0}) {
+		t.Errorf("header mismatch (want: [15 0 0 0], got: %v)", got)
+	}
+
+	for _, want := range []H{{"key": "value"}, {"id": 2.0}} {
+		got := H{}
+		if err := h.Receive(&got); err != nil {
+			t.Fatalf("receive error: %v", err)
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestStdioDefaults(t *testing.T) {
+	t.Parallel()
+
+	h := &Host{}
+
+	if got := h.in(); got != os.Stdin {
+		t.Errorf("in mismatch (want: os.Stdin, got: %v)", got)
+	}
+
+	if got := h.out(); got != os.Stdout {
+		t.Errorf("out mismatch (want: os.Stdout, got: %v)", got)
+	}
+}
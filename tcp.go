@@ -0,0 +1,123 @@
+// tcp.go - TCP debug transport related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ServeTCP listens on given TCP address and runs the same framed message loop
+// as stdio on each accepted connection, where every request is answered with
+// given handler's response, if any, or {"error": "..."} on handler error. An
+// empty message is skipped without calling given handler. It is meant for
+// development, i.e.: to connect from a test harness without the browser. It
+// blocks until given context is done, then closes the listener and the open
+// connections, and returns the context error. It will return error when it come
+// across one.
+//
+//   messaging := (&host.Host{}).Init()
+//
+//   ctx, cancel := context.WithCancel(context.Background())
+//   defer cancel()
+//
+//   err := messaging.ServeTCP(ctx, "127.0.0.1:9000", func(request host.H) (host.H, error) {
+//     return host.H{"echo": request}, nil
+//   })
+//   if err != nil && err != context.Canceled {
+//     log.Fatalf("messaging.ServeTCP error: %v", err)
+//   }
+func (h *Host) ServeTCP(ctx context.Context, addr string, handler HandlerFunc) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return h.serveListener(ctx, listener, handler)
+}
+
+// serveListener accepts connections from given listener and serves each of
+// them with given handler until given context is done. It will return error
+// when it come across one.
+func (h *Host) serveListener(ctx context.Context, listener net.Listener, handler HandlerFunc) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// The open connections are closed on any return.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.serveConn(ctx, conn, handler)
+		}()
+	}
+}
+
+// serveConn answers framed messages on given connection with given handler
+// until the peer disconnects or given context is done.
+func (h *Host) serveConn(ctx context.Context, conn net.Conn, handler HandlerFunc) {
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		// Unlike OnMessage, a disconnected peer doesn't exit the process.
+		request := H{}
+		if err := h.readMessage(conn, &request); errors.Is(err, ErrEmptyMessage) {
+			// A keep-alive probe has nothing to handle.
+			continue
+		} else if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				h.logger().Printf("TCP read error %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		response, err := handler(request)
+		if err != nil {
+			response = H{"error": err.Error()}
+		}
+
+		if response == nil {
+			continue
+		}
+
+		if err := h.PostMessage(conn, response); err != nil {
+			h.logger().Printf("TCP write error %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
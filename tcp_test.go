@@ -0,0 +1,119 @@
+// tcp_test.go - Test for TCP debug transport related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTcpServeListener(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+
+	h := &Host{ByteOrder: nativeByteOrder, Logger: &recorder{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- h.serveListener(ctx, listener, func(request H) (H, error) {
+			switch request["type"] {
+			case "ping":
+				return H{"type": "pong"}, nil
+			case "silent":
+				return nil, nil
+			}
+			return nil, errors.New("unknown type")
+		})
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+
+	reader, writer := NewMessageReader(conn), NewMessageWriter(conn)
+	for _, request := range []H{{"type": "ping"}, {"type": "silent"}, {"type": "other"}} {
+		if err := writer.WriteMessage(request); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+
+		// An empty message is skipped without a response.
+		if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+
+	got := []H{}
+	for range []int{0, 1} {
+		response := H{}
+		if err := reader.ReadMessage(&response); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		got = append(got, response)
+	}
+
+	if diff := cmp.Diff([]H{{"type": "pong"}, {"error": "unknown type"}}, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Errorf("serve error mismatch (want: %v, got: %v)", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve did not return after cancel")
+	}
+
+	// The open connection is closed on return.
+	if err := reader.ReadMessage(&H{}); err != io.EOF {
+		t.Errorf("connection error mismatch (want: %v, got: %v)", io.EOF, err)
+	}
+}
+
+func TestTcpServeTCP(t *testing.T) {
+	t.Parallel()
+
+	handler := func(request H) (H, error) { return request, nil }
+
+	compare := func(addr string, cancelled bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if cancelled {
+				cancel()
+			}
+			defer cancel()
+
+			err := (&Host{ByteOrder: nativeByteOrder}).ServeTCP(ctx, addr, handler)
+			if cancelled && err != context.Canceled {
+				t.Errorf("error mismatch (want: %v, got: %v)", context.Canceled, err)
+			} else if !cancelled && err == nil {
+				t.Error("want error")
+			}
+		}
+	}
+
+	t.Run("with cancelled context", compare("127.0.0.1:0", true))
+	t.Run("with invalid address", compare("127.0.0.1:-1", false))
+}
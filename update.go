@@ -8,76 +8,461 @@
 package host
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/hashicorp/go-version"
 	"io/ioutil"
-	"log"
+	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 )
 
-// AutoUpdateCheck downloads the latest update as necessary.
+// errUpdateLocked is returned when update lock is held by other instance.
+var errUpdateLocked = errors.New("Update is locked by other instance")
+
+// updateRuns are the in-flight AutoUpdateCheck of each Host, which can be
+// cancelled by Close.
+var updateRuns = struct {
+	sync.Mutex
+	runs map[*Host]*updateRun
+}{runs: map[*Host]*updateRun{}}
+
+// updateRun represents an in-flight AutoUpdateCheck.
+type updateRun struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// An UpdateCheckError is returned by AutoUpdateCheckE when updates.xml can't be
+// fetched or either version isn't a valid SemVer.
+type UpdateCheckError struct {
+	Err error
+}
+
+// Error is an implementation of error interface.
+func (e *UpdateCheckError) Error() string {
+	return fmt.Sprintf("Update check error: %v", e.Err)
+}
+
+// Unwrap returns the underlying cause.
+func (e *UpdateCheckError) Unwrap() error {
+	return e.Err
+}
+
+// A DownloadError is returned by AutoUpdateCheckE when the update can't be
+// downloaded from given Url or its checksum mismatches, which wraps
+// ErrChecksumMismatch.
+type DownloadError struct {
+	Url string
+	Err error
+}
+
+// Error is an implementation of error interface.
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("Update download error: %v", e.Err)
+}
+
+// Unwrap returns the underlying cause.
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// A SwapError is returned by AutoUpdateCheckE when the downloaded update can't
+// replace current executable, or it fails the VerifyArgs run. The previous
+// executable is restored on best effort basis.
+type SwapError struct {
+	Err error
+}
+
+// Error is an implementation of error interface.
+func (e *SwapError) Error() string {
+	return fmt.Sprintf("Update swap error: %v", e.Err)
+}
+
+// Unwrap returns the underlying cause.
+func (e *SwapError) Unwrap() error {
+	return e.Err
+}
+
+// AutoUpdateCheck downloads the latest update as necessary and logs any error,
+// see AutoUpdateCheckE.
 func (h *Host) AutoUpdateCheck() {
-	if h.AutoUpdate {
-		if needed, downloadUrl := h.needUpdate(); needed {
-			if err := h.downloadLatest(downloadUrl); err != nil {
-				log.Printf("Update download error: %v", err)
-			} else {
-				log.Print("Update is downloaded")
+	if err := h.AutoUpdateCheckE(); err != nil {
+		h.logger().Printf("%v", err)
+	}
+}
+
+// AutoUpdateCheckE downloads the latest update as necessary. Only one instance
+// of the same executable performs the update at a time, others will skip it.
+// The OnUpdate hook is called after the update is downloaded, and the
+// OnUpdateError hook is called when it come across an error. It will return
+// UpdateCheckError, DownloadError, or SwapError when it come across one.
+//
+//   if err := messaging.AutoUpdateCheckE(); err != nil {
+//     var swapErr *host.SwapError
+//     if errors.As(err, &swapErr) {
+//       log.Printf("update swap failed: %v", swapErr.Err)
+//     }
+//   }
+func (h *Host) AutoUpdateCheckE() error {
+	return h.autoUpdateCheck(context.Background())
+}
+
+// autoUpdateCheck is the same as AutoUpdateCheckE, except its in-flight run is
+// cancelled when given context is done as well.
+func (h *Host) autoUpdateCheck(ctx context.Context) error {
+	if !h.AutoUpdate {
+		return nil
+	}
+
+	run := h.startUpdate(ctx)
+	if run == nil {
+		h.logger().Printf("Update is in progress")
+		return nil
+	}
+	defer h.finishUpdate(run)
+
+	unlock, err := h.lockUpdate()
+	if err == errUpdateLocked {
+		h.logger().Printf("Update is in progress by other instance")
+		return nil
+	} else if err != nil {
+		// Carry on as before, i.e.: on read-only install.
+		h.logger().Printf("Update lock error: %v", err)
+	} else {
+		defer unlock()
+	}
+
+	needed, update, err := h.needUpdate()
+	if err != nil {
+		return h.onUpdateError(&UpdateCheckError{Err: err})
+	} else if !needed {
+		return nil
+	}
+
+	if err := h.downloadLatest(update.getUrl(), update.getHash(), update.getVersion()); err != nil {
+		return h.onUpdateError(err)
+	}
+
+	h.logger().Printf("Update is downloaded")
+	if h.OnUpdate != nil {
+		h.OnUpdate(h.Version, update.getVersion())
+	}
+
+	return nil
+}
+
+// Close cancels in-flight AutoUpdateCheck, if any, and waits until it releases
+// the update lock. It will return error when it come across one.
+//
+//   messaging := (&host.Host{}).Init()
+//   go messaging.AutoUpdateCheck()
+//
+//   // On SIGTERM.
+//   if err := messaging.Close(); err != nil {
+//     log.Printf("messaging.Close error: %v", err)
+//   }
+func (h *Host) Close() error {
+	updateRuns.Lock()
+	run := updateRuns.runs[h]
+	updateRuns.Unlock()
+
+	if run != nil {
+		run.cancel()
+		<-run.done
+	}
+
+	return nil
+}
+
+// StartAutoUpdate runs AutoUpdateCheck in background right away, then every
+// configured UpdateInterval after the recorded update check timestamp, so it
+// doesn't depend on stdin being closed. It runs until given context is done or
+// the returned stop function is called, either aborts its own in-flight
+// AutoUpdateCheck only, and the stop function waits until the background run
+// returns.
+//
+//   messaging := (&host.Host{
+//     AppName:        "tld.domain.sub.app.name",
+//     UpdateInterval: 6 * time.Hour,
+//     UpdateUrl:      "https://sub.domain.tld/updates.xml",
+//     Version:        "1.0.0",
+//   }).Init()
+//
+//   stop := messaging.StartAutoUpdate(context.Background())
+//   defer stop()
+func (h *Host) StartAutoUpdate(ctx context.Context) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for ctx.Err() == nil {
+			if err := h.autoUpdateCheck(ctx); err != nil {
+				h.logger().Printf("%v", err)
+			}
+
+			timer := time.NewTimer(h.getNextCheckDelay())
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
 			}
 		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+}
+
+// getNextCheckDelay returns duration until the next update check is due, which
+// is configured UpdateInterval after the recorded update check timestamp, or
+// the whole interval when it is already due, i.e.: after a failed check.
+func (h *Host) getNextCheckDelay() time.Duration {
+	interval := h.UpdateInterval
+	if interval <= 0 {
+		interval = DefaultUpdateInterval
 	}
+
+	if delay := time.Until(h.getCheckTimestamp().Add(interval)); delay > 0 && delay <= interval {
+		return delay
+	}
+	return interval
+}
+
+// CheckForUpdate returns true along with the latest version and its download
+// URL if an update is available, otherwise false. Unlike AutoUpdateCheck, it
+// neither downloads the update nor records the update check timestamp. It will
+// return error when it come across one.
+func (h *Host) CheckForUpdate() (available bool, version, url string, err error) {
+	available, update, err := h.checkUpdate()
+	return available, update.getVersion(), update.getUrl(), err
+}
+
+// checkUpdate returns true along with the latest update if current running
+// version is older than updates.xml's version, otherwise false. It will return
+// error when it come across one.
+func (h *Host) checkUpdate() (bool, *Update, error) {
+	localVersion, err := h.getLocalVersion()
+	if err != nil {
+		return false, &Update{}, err
+	}
+
+	update, err := h.getLatestUpdate()
+	if err != nil {
+		return false, update, err
+	}
+
+	if update.getUrl() == "" || update.getVersion() == "" {
+		return false, update, nil
+	}
+
+	remoteVersion, err := version.NewVersion(update.getVersion())
+	if err != nil {
+		return false, update, fmt.Errorf("Invalid remote version %q: %w", update.getVersion(), err)
+	}
+
+	return localVersion.LessThan(remoteVersion), update, nil
 }
 
 // getCheckTimestamp returns previous update check timestamp in Unix
 // nanoseconds.
 func (h *Host) getCheckTimestamp() time.Time {
-	buf, _ := ioutil.ReadFile(h.ExecName + ".chk")
+	buf, _ := ioutil.ReadFile(h.getStateName(h.getCheckSuffix()))
 	nano, _ := strconv.ParseInt(string(buf), 10, 64)
 	return time.Unix(0, nano)
 }
 
-// isCheckedToday returns true if update check was done sometime today,
-// otherwise false.
-func (h *Host) isCheckedToday() bool {
-	y1, m1, d1 := h.getCheckTimestamp().Date()
-	y2, m2, d2 := time.Now().Date()
-	return y1 == y2 && m1 == m2 && d1 == d2
+// getUpdateContext returns the context of in-flight AutoUpdateCheck, otherwise
+// background context.
+func (h *Host) getUpdateContext() context.Context {
+	updateRuns.Lock()
+	defer updateRuns.Unlock()
+
+	if run, ok := updateRuns.runs[h]; ok {
+		return run.ctx
+	}
+	return context.Background()
+}
+
+// getLocalVersion returns parsed current running version. It will return error
+// when it isn't a valid SemVer.
+func (h *Host) getLocalVersion() (*version.Version, error) {
+	localVersion, err := version.NewVersion(h.Version)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid local version %q: %w", h.Version, err)
+	}
+	return localVersion, nil
+}
+
+// isCheckedRecently returns true if update check was done within configured
+// update interval, otherwise false. A future timestamp is treated as not
+// checked.
+func (h *Host) isCheckedRecently() bool {
+	interval := h.UpdateInterval
+	if interval <= 0 {
+		interval = DefaultUpdateInterval
+	}
+
+	elapsed := time.Since(h.getCheckTimestamp())
+	return elapsed >= 0 && elapsed < interval
+}
+
+// lockUpdate acquires update lock of current executable without blocking and
+// returns a function to release it. It will return errUpdateLocked when the
+// lock is held by other instance, or other error when it come across one.
+func (h *Host) lockUpdate() (func(), error) {
+	if h.StateDir != "" {
+		if err := osMkdirAll(h.StateDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(h.getStateName(".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// The lock file is kept, removing it would race with other instances.
+	return func() { file.Close() }, nil
 }
 
 // needUpdate returns true if update is needed, otherwise false.
 //
 // Truthy criteria:
-// - Update check wasn't already done sometime today.
+// - Update check wasn't already done within configured update interval.
 // - Current running version is older than updates.xml's version.
-func (h *Host) needUpdate() (bool, string) {
-	response := false
+//
+// It will return error when updates.xml can't be fetched, or either version
+// isn't a valid SemVer.
+func (h *Host) needUpdate() (bool, *Update, error) {
+	if h.isCheckedRecently() {
+		h.logger().Printf("Update already checked recently")
+		return false, &Update{}, nil
+	}
 
-	if h.isCheckedToday() {
-		log.Print("Update already checked today")
-		return response, ""
+	if _, err := h.getLocalVersion(); err != nil {
+		return false, &Update{}, err
 	}
 
 	if err := h.writeCheckTimestamp(); err != nil {
-		log.Printf("Update timestamp error: %v", err)
+		h.logger().Printf("Update timestamp error: %v", err)
 	}
 
-	localVersion := version.Must(version.NewVersion(h.Version))
+	needed, update, err := h.checkUpdate()
+	switch {
+	case err != nil:
+		return false, update, err
+	case update.getUrl() == "" || update.getVersion() == "":
+		h.logger().Printf("No update entries")
+	case needed:
+		h.logger().Printf("Latest update is found")
+	default:
+		h.logger().Printf("Already up to date")
+	}
 
-	downloadUrl, remoteRawVersion, err := h.getDownloadUrlAndVersion()
-	if err != nil {
-		log.Printf("Update check error: %v", err)
+	return needed, update, nil
+}
+
+// finishUpdate unregisters given in-flight AutoUpdateCheck and notifies Close.
+func (h *Host) finishUpdate(run *updateRun) {
+	updateRuns.Lock()
+	delete(updateRuns.runs, h)
+	updateRuns.Unlock()
+
+	run.cancel()
+	close(run.done)
+}
+
+// getBackupSuffix returns configured BackupSuffix, otherwise ".bak".
+func (h *Host) getBackupSuffix() string {
+	if h.BackupSuffix != "" {
+		return h.BackupSuffix
 	}
+	return ".bak"
+}
 
-	remoteVersion := version.Must(version.NewVersion(remoteRawVersion))
+// getCheckSuffix returns configured CheckSuffix, otherwise ".chk".
+func (h *Host) getCheckSuffix() string {
+	if h.CheckSuffix != "" {
+		return h.CheckSuffix
+	}
+	return ".chk"
+}
 
-	if localVersion.LessThan(remoteVersion) {
-		log.Print("Latest update is found")
-		response = true
-	} else {
-		log.Print("Already up to date")
+// getStateName returns an absolute path to update state file with given
+// extension, which is located in configured StateDir, otherwise next to current
+// executable.
+func (h *Host) getStateName(ext string) string {
+	if h.StateDir == "" {
+		return h.ExecName + ext
 	}
+	return filepath.Join(h.StateDir, filepath.Base(h.ExecName)+ext)
+}
+
+// removeState removes update state files of current executable, except the
+// update check timestamp and the backup when KeepState is true. It will return
+// error when it come across one.
+func (h *Host) removeState() error {
+	var err error
+	exts := []string{".cache", ".lock", ".part", ".part.url"}
+
+	if !h.KeepState {
+		// The backup might be left behind by a locked executable, best effort only.
+		if rmErr := osRemove(h.getStateName(h.getBackupSuffix())); rmErr != nil && !os.IsNotExist(rmErr) {
+			h.logger().Printf("%v", rmErr)
+		}
 
-	return response, downloadUrl
+		exts = append(exts, h.getCheckSuffix())
+	}
+
+	for _, ext := range exts {
+		if rmErr := osRemove(h.getStateName(ext)); rmErr != nil && !os.IsNotExist(rmErr) {
+			err = appendError(err, rmErr)
+		}
+	}
+
+	return err
+}
+
+// onUpdateError calls OnUpdateError hook with given error, if any, and returns
+// given error.
+func (h *Host) onUpdateError(err error) error {
+	if h.OnUpdateError != nil {
+		h.OnUpdateError(err)
+	}
+	return err
+}
+
+// startUpdate registers and returns an in-flight AutoUpdateCheck derived from
+// given context, or nil when one is already in progress.
+func (h *Host) startUpdate(ctx context.Context) *updateRun {
+	updateRuns.Lock()
+	defer updateRuns.Unlock()
+
+	if _, ok := updateRuns.runs[h]; ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	run := &updateRun{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	updateRuns.runs[h] = run
+	return run
 }
 
 // writeCheckTimestamp writes update check timestamp in Unix nanoseconds.
@@ -85,7 +470,13 @@ func (h *Host) needUpdate() (bool, string) {
 func (h *Host) writeCheckTimestamp() error {
 	timestamp := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
 
-	if err := ioutil.WriteFile(h.ExecName+".chk", timestamp, 0644); err != nil {
+	if h.StateDir != "" {
+		if err := osMkdirAll(h.StateDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := ioutil.WriteFile(h.getStateName(h.getCheckSuffix()), timestamp, 0644); err != nil {
 		return err
 	}
 
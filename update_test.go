@@ -0,0 +1,814 @@
+// update_test.go - Test for update check related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	messages []string
+}
+
+func (r *recorder) Printf(format string, v ...interface{}) {
+	r.messages = append(r.messages, fmt.Sprintf(format, v...))
+}
+
+// updatesXml returns an updates.xml content of tld.domain.sub.app.name with
+// given updatecheck entries.
+func updatesXml(updates string) string {
+	return `<?xml version='1.0' encoding='UTF-8'?>
+<gupdate xmlns='http://www.google.com/update2/response' protocol='2.0'>
+  <app appid='tld.domain.sub.app.name'>` + updates + `</app>
+</gupdate>`
+}
+
+// newUpdateServer returns a test server of updates.xml with given version,
+// whose download URL on the same server is handled by given download handler.
+// It is closed when the test and all its subtests complete.
+func newUpdateServer(t *testing.T, version string, download http.HandlerFunc) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/app" {
+			download(rw, req)
+			return
+		}
+		_, _ = rw.Write([]byte(updatesXml(`
+    <updatecheck codebase='` + server.URL + `/app' version='` + version + `' />
+  `)))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestUpdateLogger(t *testing.T) {
+	t.Parallel()
+
+	execName := "testdata/logger"
+	timestamp := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	if err := ioutil.WriteFile(execName+".chk", timestamp, 0644); err != nil {
+		t.Fatalf("write timestamp error: %v", err)
+	}
+	defer func() {
+		os.Remove(execName + ".chk")
+		os.Remove(execName + ".lock")
+	}()
+
+	r := &recorder{}
+	h := &Host{AutoUpdate: true, ExecName: execName, Logger: r}
+	h.AutoUpdateCheck()
+
+	if len(r.messages) != 1 || r.messages[0] != "Update already checked recently" {
+		t.Errorf("message mismatch: %v", r.messages)
+	}
+}
+
+func TestUpdateIsCheckedRecently(t *testing.T) {
+	t.Parallel()
+
+	compare := func(want bool, interval, ago time.Duration) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			execName := fmt.Sprintf("testdata/recent-%d-%d", interval, ago)
+			timestamp := []byte(strconv.FormatInt(time.Now().Add(-ago).UnixNano(), 10))
+
+			if err := ioutil.WriteFile(execName+".chk", timestamp, 0644); err != nil {
+				t.Fatalf("write timestamp error: %v", err)
+			}
+			defer func() { os.Remove(execName + ".chk") }()
+
+			h := &Host{ExecName: execName, UpdateInterval: interval}
+			if got := h.isCheckedRecently(); got != want {
+				t.Errorf("mismatch %s ago with %s interval (want: %t, got: %t)",
+					ago, interval, want, got)
+			}
+		}
+	}
+
+	t.Run("with sub-day interval checked", compare(true, time.Hour, 30*time.Minute))
+	t.Run("with sub-day interval expired", compare(false, time.Hour, 2*time.Hour))
+	t.Run("with multi-day interval checked", compare(true, 7*24*time.Hour, 3*24*time.Hour))
+	t.Run("with multi-day interval expired", compare(false, 7*24*time.Hour, 8*24*time.Hour))
+	t.Run("with default interval checked", compare(true, 0, 23*time.Hour))
+	t.Run("with default interval expired", compare(false, -time.Hour, 25*time.Hour))
+	t.Run("with future timestamp", compare(false, time.Hour, -time.Hour))
+}
+
+func TestUpdateNeedUpdate(t *testing.T) {
+	t.Parallel()
+
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(want bool, wantMessage, local, updates string, wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_, _ = rw.Write([]byte(updatesXml(updates)))
+			}))
+			defer server.Close()
+
+			execName := fmt.Sprintf("testdata/need-%t-%s-%d", want, local, len(updates))
+			defer func() { os.Remove(execName + ".chk") }()
+
+			r := &recorder{}
+			h := &Host{
+				AppName:   "tld.domain.sub.app.name",
+				ExecName:  execName,
+				Logger:    r,
+				UpdateUrl: server.URL,
+				Version:   local,
+			}
+
+			got, _, err := h.needUpdate()
+			if wantErr != (err != nil) {
+				t.Fatalf("error mismatch (want: %t, got: %v)", wantErr, err)
+			}
+
+			if got != want {
+				t.Errorf("mismatch (want: %t, got: %t)", want, got)
+			}
+
+			if wantMessage == "" {
+				if len(r.messages) != 0 {
+					t.Errorf("message mismatch: %v", r.messages)
+				}
+			} else if len(r.messages) != 1 || !strings.HasPrefix(r.messages[0], wantMessage) {
+				t.Errorf("message mismatch: %v", r.messages)
+			}
+		}
+	}
+
+	t.Run("with no update entries", compare(false, "No update entries", "1.0.0", "", false))
+	t.Run("with same version", compare(false, "Already up to date", "1.0.0",
+		`<updatecheck codebase='https://sub.domain.tld/app' version='1.0.0' />`, false))
+	t.Run("with newer version", compare(true, "Latest update is found", "1.0.0",
+		`<updatecheck codebase='https://sub.domain.tld/app' version='1.0.1' />`, false))
+	t.Run("with non-semver remote version", compare(false, "", "1.0.0",
+		`<updatecheck codebase='https://sub.domain.tld/app' version='latest' />`, true))
+	t.Run("with non-semver local version", compare(false, "", "dev",
+		`<updatecheck codebase='https://sub.domain.tld/app' version='1.0.1' />`, true))
+}
+
+func TestUpdateCheckForUpdate(t *testing.T) {
+	t.Parallel()
+
+	compare := func(wantAvailable bool, wantVersion, wantUrl, local, updates string,
+		wantErr bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			downloaded := false
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/" {
+					downloaded = true
+				}
+				_, _ = rw.Write([]byte(updatesXml(updates)))
+			}))
+			defer server.Close()
+
+			execName := fmt.Sprintf("testdata/dry-%s-%d", local, len(updates))
+			defer func() { os.Remove(execName + ".chk") }()
+
+			h := &Host{
+				AppName:   "tld.domain.sub.app.name",
+				ExecName:  execName,
+				UpdateUrl: server.URL,
+				Version:   local,
+			}
+
+			available, version, url, err := h.CheckForUpdate()
+			if wantErr != (err != nil) {
+				t.Fatalf("error mismatch (want: %t, got: %v)", wantErr, err)
+			}
+
+			if available != wantAvailable || version != wantVersion || url != wantUrl {
+				t.Errorf("mismatch (want: %t %q %q, got: %t %q %q)", wantAvailable,
+					wantVersion, wantUrl, available, version, url)
+			}
+
+			if _, err := os.Stat(execName + ".chk"); !os.IsNotExist(err) {
+				t.Errorf("timestamp is written: %v", err)
+			}
+
+			if downloaded {
+				t.Error("update is downloaded")
+			}
+		}
+	}
+
+	t.Run("with same version", compare(false, "1.0.0", "https://sub.domain.tld/app",
+		"1.0.0", `<updatecheck codebase='https://sub.domain.tld/app' version='1.0.0' />`, false))
+	t.Run("with newer version", compare(true, "1.0.1", "https://sub.domain.tld/app",
+		"1.0.0", `<updatecheck codebase='https://sub.domain.tld/app' version='1.0.1' />`, false))
+	t.Run("with no update entries", compare(false, "", "", "1.0.0", "", false))
+	t.Run("with malformed remote version", compare(false, "junk", "https://sub.domain.tld/app",
+		"1.0.0", `<updatecheck codebase='https://sub.domain.tld/app' version='junk' />`, true))
+	t.Run("with malformed local version", compare(false, "", "", "junk",
+		`<updatecheck codebase='https://sub.domain.tld/app' version='1.0.1' />`, true))
+}
+
+func TestUpdateHooks(t *testing.T) {
+	t.Parallel()
+
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(wantVersions []string, wantErr bool, local string, status int) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			server := newUpdateServer(t, "1.0.1", func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(status)
+				_, _ = rw.Write([]byte("NEW"))
+			})
+
+			execName := fmt.Sprintf("testdata/hooks-%s-%d", local, status)
+			if err := ioutil.WriteFile(execName, []byte("OLD"), 0755); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+			defer func() {
+				os.Remove(execName)
+				os.Remove(execName + ".bak")
+				os.Remove(execName + ".chk")
+				os.Remove(execName + ".lock")
+				os.Remove(execName + ".new")
+			}()
+
+			var versions []string
+			var updateErr error
+			h := &Host{
+				AppName:       "tld.domain.sub.app.name",
+				AutoUpdate:    true,
+				ExecName:      execName,
+				OnUpdate:      func(oldVer, newVer string) { versions = []string{oldVer, newVer} },
+				OnUpdateError: func(err error) { updateErr = err },
+				UpdateUrl:     server.URL,
+				Version:       local,
+			}
+			h.AutoUpdateCheck()
+
+			if diff := cmp.Diff(wantVersions, versions); diff != "" {
+				t.Errorf("OnUpdate mismatch (-want +got):\n%s", diff)
+			}
+
+			if wantErr != (updateErr != nil) {
+				t.Errorf("OnUpdateError mismatch (want: %t, got: %v)", wantErr, updateErr)
+			}
+		}
+	}
+
+	t.Run("with downloaded update", compare([]string{"1.0.0", "1.0.1"}, false, "1.0.0", http.StatusOK))
+	t.Run("with download error", compare(nil, true, "1.0.0", http.StatusNotFound))
+	t.Run("with non-semver local version", compare(nil, true, "dev", http.StatusOK))
+	t.Run("with same version", compare(nil, false, "1.0.1", http.StatusOK))
+}
+
+func TestUpdateAutoUpdateCheckE(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	// In-place replacement is enough to tell the failure class.
+	oldRuntimeGOOS := runtimeGOOS
+	defer func() { runtimeGOOS = oldRuntimeGOOS }()
+	runtimeGOOS = "linux"
+
+	compare := func(name, remote string, status int, exists bool, want *H) func(t *testing.T) {
+		return func(t *testing.T) {
+			server := newUpdateServer(t, remote, func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(status)
+				_, _ = rw.Write([]byte("NEW"))
+			})
+
+			execName := "testdata/classes-" + name
+			if exists {
+				if err := ioutil.WriteFile(execName, []byte("OLD"), 0755); err != nil {
+					t.Fatalf("touch file error: %v", err)
+				}
+			}
+			defer func() {
+				for _, ext := range []string{"", ".bak", ".chk", ".lock", ".part", ".part.url"} {
+					os.Remove(execName + ext)
+				}
+			}()
+
+			var hookErr error
+			h := &Host{
+				AppName:       "tld.domain.sub.app.name",
+				AutoUpdate:    true,
+				ExecName:      execName,
+				OnUpdateError: func(err error) { hookErr = err },
+				UpdateUrl:     server.URL,
+				Version:       "1.0.0",
+			}
+			err := h.AutoUpdateCheckE()
+
+			var checkErr *UpdateCheckError
+			var downloadErr *DownloadError
+			var swapErr *SwapError
+			got := &H{
+				"check":    errors.As(err, &checkErr),
+				"download": errors.As(err, &downloadErr),
+				"swap":     errors.As(err, &swapErr),
+				"hook":     hookErr == err,
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s (%v)", diff, err)
+			}
+		}
+	}
+
+	t.Run("with update", compare("ok", "1.0.1", http.StatusOK, true,
+		&H{"check": false, "download": false, "swap": false, "hook": true}))
+	t.Run("with check error", compare("check", "latest", http.StatusOK, true,
+		&H{"check": true, "download": false, "swap": false, "hook": true}))
+	t.Run("with download error", compare("download", "1.0.1", http.StatusNotFound, true,
+		&H{"check": false, "download": true, "swap": false, "hook": true}))
+	t.Run("with swap error", compare("swap", "1.0.1", http.StatusOK, false,
+		&H{"check": false, "download": false, "swap": true, "hook": true}))
+}
+
+func TestUpdateStateDir(t *testing.T) {
+	t.Parallel()
+
+	log.SetOutput(ioutil.Discard)
+
+	stateDir := "testdata/state"
+	defer func() { os.RemoveAll(stateDir) }()
+
+	compare := func(h *Host, ext, want string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			if diff := cmp.Diff(want, h.getStateName(ext)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with default state dir", func(t *testing.T) {
+		t.Run("with .chk", compare(&Host{ExecName: "/usr/bin/app"}, ".chk", "/usr/bin/app.chk"))
+		t.Run("with .new", compare(&Host{ExecName: "/usr/bin/app"}, ".new", "/usr/bin/app.new"))
+	})
+	t.Run("with custom state dir", func(t *testing.T) {
+		t.Run("with .chk", compare(&Host{ExecName: "/usr/bin/app", StateDir: "/var/cache"}, ".chk",
+			filepath.Join("/var/cache", "app.chk")))
+		t.Run("with .bak", compare(&Host{ExecName: "/usr/bin/app", StateDir: "/var/cache"}, ".bak",
+			filepath.Join("/var/cache", "app.bak")))
+	})
+
+	t.Run("with check timestamp", func(t *testing.T) {
+		execName := "testdata/stateful"
+		h := &Host{ExecName: execName, StateDir: stateDir}
+
+		if h.isCheckedRecently() {
+			t.Fatal("checked recently before any check")
+		}
+
+		if err := h.writeCheckTimestamp(); err != nil {
+			t.Fatalf("write timestamp error: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(stateDir, "stateful.chk")); err != nil {
+			t.Errorf("missing timestamp: %v", err)
+		}
+
+		if _, err := os.Stat(execName + ".chk"); !os.IsNotExist(err) {
+			t.Errorf("timestamp is written next to executable: %v", err)
+		}
+
+		if !h.isCheckedRecently() {
+			t.Error("not checked recently after a check")
+		}
+	})
+}
+
+func TestUpdateStateSuffix(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(h *Host, want []string) func(t *testing.T) {
+		return func(t *testing.T) {
+			defer func() { os.Remove(h.getStateName(h.getCheckSuffix())) }()
+
+			if err := h.writeCheckTimestamp(); err != nil {
+				t.Fatalf("write timestamp error: %v", err)
+			}
+
+			if !h.isCheckedRecently() {
+				t.Error("not checked recently after a check")
+			}
+
+			oldOsRemove := osRemove
+			oldRuntimeGoexit := runtimeGoexit
+			defer func() {
+				osRemove = oldOsRemove
+				runtimeGoexit = oldRuntimeGoexit
+			}()
+
+			removed := []string{}
+			osRemove = func(name string) error {
+				removed = append(removed, name)
+				return oldOsRemove(name)
+			}
+			runtimeGoexit = func() {}
+
+			if err := h.Uninstall(); err != nil {
+				t.Fatalf("uninstall error: %v", err)
+			}
+
+			for _, name := range want {
+				found := false
+				for _, r := range removed {
+					found = found || r == name
+				}
+				if !found {
+					t.Errorf("%s is not removed: %v", name, removed)
+				}
+			}
+
+			if _, err := os.Stat(want[1]); !os.IsNotExist(err) {
+				t.Errorf("timestamp is left behind: %v", err)
+			}
+		}
+	}
+
+	t.Run("with default suffixes", compare(&Host{AppName: "suffix", ExecName: "testdata/suffix-default"},
+		[]string{"testdata/suffix-default.bak", "testdata/suffix-default.chk"}))
+	t.Run("with custom suffixes", compare(&Host{AppName: "suffix", BackupSuffix: ".old",
+		CheckSuffix: "-checked", ExecName: "testdata/suffix-custom"},
+		[]string{"testdata/suffix-custom.old", "testdata/suffix-custom-checked"}))
+}
+
+func TestUpdateKeepState(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	compare := func(keepState bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			h := &Host{AppName: "keepstate", ExecName: "testdata/keepstate", KeepState: keepState}
+			kept := []string{h.getStateName(".bak"), h.getStateName(".chk")}
+			removed := []string{h.getStateName(".cache"), h.getStateName(".lock")}
+			defer func() {
+				for _, name := range append(kept, removed...) {
+					os.Remove(name)
+				}
+			}()
+
+			for _, name := range append(kept, removed...) {
+				if err := ioutil.WriteFile(name, []byte("state"), 0644); err != nil {
+					t.Fatalf("write state error: %v", err)
+				}
+			}
+
+			oldRuntimeGoexit := runtimeGoexit
+			defer func() { runtimeGoexit = oldRuntimeGoexit }()
+			runtimeGoexit = func() {}
+
+			if err := h.Uninstall(); err != nil {
+				t.Fatalf("uninstall error: %v", err)
+			}
+
+			for _, name := range kept {
+				if _, err := os.Stat(name); keepState && err != nil {
+					t.Errorf("%s is not kept: %v", name, err)
+				} else if !keepState && !os.IsNotExist(err) {
+					t.Errorf("%s is left behind: %v", name, err)
+				}
+			}
+
+			for _, name := range removed {
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("%s is left behind: %v", name, err)
+				}
+			}
+		}
+	}
+
+	t.Run("with KeepState", compare(true))
+	t.Run("without KeepState", compare(false))
+}
+
+func TestUpdateLockUpdate(t *testing.T) {
+	t.Parallel()
+
+	h := &Host{ExecName: "testdata/locked"}
+	defer func() { os.Remove(h.getStateName(".lock")) }()
+
+	unlock, err := h.lockUpdate()
+	if err != nil {
+		t.Fatalf("lock error: %v", err)
+	}
+
+	if _, err := h.lockUpdate(); err != errUpdateLocked {
+		t.Errorf("want errUpdateLocked: %v", err)
+	}
+
+	unlock()
+
+	unlock, err = h.lockUpdate()
+	if err != nil {
+		t.Fatalf("relock error: %v", err)
+	}
+	unlock()
+}
+
+func TestUpdateConcurrentAutoUpdateCheck(t *testing.T) {
+	t.Parallel()
+
+	log.SetOutput(ioutil.Discard)
+
+	var mutex sync.Mutex
+	downloads := 0
+	server := newUpdateServer(t, "1.0.1", func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		downloads++
+		mutex.Unlock()
+		// Keep the lock held while other instances start.
+		time.Sleep(100 * time.Millisecond)
+		_, _ = rw.Write([]byte("NEW"))
+	})
+
+	execName := "testdata/concurrent"
+	if err := ioutil.WriteFile(execName, []byte("OLD"), 0755); err != nil {
+		t.Fatalf("touch file error: %v", err)
+	}
+	defer func() {
+		for _, ext := range []string{"", ".bak", ".chk", ".lock", ".new"} {
+			os.Remove(execName + ext)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			(&Host{
+				AppName:    "tld.domain.sub.app.name",
+				AutoUpdate: true,
+				ExecName:   execName,
+				UpdateUrl:  server.URL,
+				Version:    "1.0.0",
+			}).AutoUpdateCheck()
+		}()
+	}
+	wg.Wait()
+
+	if downloads != 1 {
+		t.Errorf("download count mismatch (want: 1, got: %d)", downloads)
+	}
+
+	if got, _ := ioutil.ReadFile(execName); string(got) != "NEW" {
+		t.Errorf("content mismatch (want: NEW, got: %s)", got)
+	}
+}
+
+func TestUpdateStartAutoUpdate(t *testing.T) {
+	t.Parallel()
+
+	log.SetOutput(ioutil.Discard)
+
+	server := newUpdateServer(t, "1.0.1", func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("NEW"))
+	})
+
+	compare := func(name string, stopByCancel bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			execName := "testdata/ticker-" + name
+			if err := ioutil.WriteFile(execName, []byte("OLD"), 0755); err != nil {
+				t.Fatalf("touch file error: %v", err)
+			}
+			defer func() {
+				for _, ext := range []string{"", ".bak", ".cache", ".chk", ".lock", ".new", ".part", ".part.url"} {
+					os.Remove(execName + ext)
+				}
+			}()
+
+			// The running version stays, so every due check downloads again.
+			var mu sync.Mutex
+			updates := 0
+			h := &Host{
+				AppName:    "tld.domain.sub.app.name",
+				AutoUpdate: true,
+				ExecName:   execName,
+				OnUpdate: func(string, string) {
+					mu.Lock()
+					updates++
+					mu.Unlock()
+				},
+				UpdateInterval: 50 * time.Millisecond,
+				UpdateUrl:      server.URL,
+				Version:        "1.0.0",
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stop := h.StartAutoUpdate(ctx)
+
+			count := func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				return updates
+			}
+
+			for deadline := time.Now().Add(5 * time.Second); count() < 3; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("update is not periodic: %d", count())
+				}
+			}
+
+			if stopByCancel {
+				cancel()
+			}
+			stop()
+			stop()
+
+			stopped := count()
+			time.Sleep(150 * time.Millisecond)
+			if got := count(); got != stopped {
+				t.Errorf("update after stop (want: %d, got: %d)", stopped, got)
+			}
+		}
+	}
+
+	t.Run("with stop", compare("stop", false))
+	t.Run("with cancelled context", compare("cancel", true))
+}
+
+func TestUpdateStartAutoUpdateOtherRun(t *testing.T) {
+	t.Parallel()
+
+	log.SetOutput(ioutil.Discard)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := newUpdateServer(t, "1.0.1", func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		_, _ = rw.Write([]byte("NEW"))
+	})
+
+	execName := "testdata/ticker-other"
+	if err := ioutil.WriteFile(execName, []byte("OLD"), 0755); err != nil {
+		t.Fatalf("touch file error: %v", err)
+	}
+	defer func() {
+		for _, ext := range []string{"", ".bak", ".cache", ".chk", ".lock", ".new", ".part", ".part.url"} {
+			os.Remove(execName + ext)
+		}
+	}()
+
+	var updateErr error
+	h := &Host{
+		AppName:       "tld.domain.sub.app.name",
+		AutoUpdate:    true,
+		ExecName:      execName,
+		OnUpdateError: func(err error) { updateErr = err },
+		UpdateUrl:     server.URL,
+		Version:       "1.0.0",
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.AutoUpdateCheck()
+	}()
+	<-started
+
+	// Stopping the background run leaves the other in-flight run alone.
+	h.StartAutoUpdate(context.Background())()
+	close(release)
+	<-done
+
+	if updateErr != nil {
+		t.Errorf("update error: %v", updateErr)
+	}
+
+	if got, _ := ioutil.ReadFile(execName); string(got) != "NEW" {
+		t.Errorf("content mismatch (want: NEW, got: %s)", got)
+	}
+}
+
+func TestUpdateNextCheckDelay(t *testing.T) {
+	t.Parallel()
+
+	compare := func(name string, checked time.Duration, want time.Duration) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			execName := "testdata/delay-" + name
+			defer func() { os.Remove(execName + ".chk") }()
+
+			if checked != 0 {
+				timestamp := []byte(strconv.FormatInt(time.Now().Add(-checked).UnixNano(), 10))
+				if err := ioutil.WriteFile(execName+".chk", timestamp, 0644); err != nil {
+					t.Fatalf("write timestamp error: %v", err)
+				}
+			}
+
+			h := &Host{ExecName: execName, UpdateInterval: time.Hour}
+			if got := h.getNextCheckDelay(); got > want || got < want-time.Minute {
+				t.Errorf("mismatch (want: %s, got: %s)", want, got)
+			}
+		}
+	}
+
+	t.Run("with no check", compare("none", 0, time.Hour))
+	t.Run("with recent check", compare("recent", 15*time.Minute, 45*time.Minute))
+	t.Run("with due check", compare("due", 2*time.Hour, time.Hour))
+	t.Run("with future check", compare("future", -2*time.Hour, time.Hour))
+}
+
+func TestUpdateClose(t *testing.T) {
+	t.Parallel()
+
+	log.SetOutput(ioutil.Discard)
+
+	started := make(chan struct{})
+	server := newUpdateServer(t, "1.0.1", func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		// Simulate a slow download until the request is cancelled.
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+			_, _ = rw.Write([]byte("NEW"))
+		}
+	})
+
+	execName := "testdata/closed"
+	if err := ioutil.WriteFile(execName, []byte("OLD"), 0755); err != nil {
+		t.Fatalf("touch file error: %v", err)
+	}
+	defer func() {
+		for _, ext := range []string{"", ".bak", ".chk", ".lock", ".new"} {
+			os.Remove(execName + ext)
+		}
+	}()
+
+	var updateErr error
+	h := &Host{
+		AppName:       "tld.domain.sub.app.name",
+		AutoUpdate:    true,
+		ExecName:      execName,
+		OnUpdateError: func(err error) { updateErr = err },
+		UpdateUrl:     server.URL,
+		Version:       "1.0.0",
+	}
+
+	// Nothing is in-flight.
+	if err := h.Close(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.AutoUpdateCheck()
+	}()
+
+	<-started
+	start := time.Now()
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("close is not prompt: %v", elapsed)
+	}
+
+	<-done
+
+	if !errors.Is(updateErr, context.Canceled) {
+		t.Errorf("want context.Canceled: %v", updateErr)
+	}
+
+	if got, _ := ioutil.ReadFile(execName); string(got) != "OLD" {
+		t.Errorf("content mismatch (want: OLD, got: %s)", got)
+	}
+
+	// The update lock is released.
+	unlock, err := h.lockUpdate()
+	if err != nil {
+		t.Fatalf("lock error: %v", err)
+	}
+	unlock()
+}
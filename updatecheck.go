@@ -22,12 +22,18 @@ type App struct {
 
 // An Update is represent application download URL and latest version.
 //
-// It can have target OS optionally. This is an extended attribute that is not
-// part of original Google Chrome update manifest.
+// It can have target architecture, release channel, target OS, and SHA-256
+// checksum optionally. These are extended attributes that are not part of
+// original Google Chrome update manifest.
 //
-//   <updatecheck codebase='https://sub.domain.tld/app.download.all' os='darwin' version='1.0.0' />
+//   <updatecheck arch='arm64' channel='beta'
+//     codebase='https://sub.domain.tld/app.download.all' hash_sha256='...'
+//     os='darwin' version='1.0.0' />
 type Update struct {
+	Channel *string `xml:"channel,attr"`
+	Goarch  *string `xml:"arch,attr"`
 	Goos    *string `xml:"os,attr"`
+	Hash    *string `xml:"hash_sha256,attr"`
 	Url     *string `xml:"codebase,attr"`
 	Version *string `xml:"version,attr"`
 }
@@ -50,40 +56,81 @@ func (a *App) getAppId() string {
 	return ""
 }
 
-// getUrlAndVersion returns application download URL and latest version that
-// match runtime.GOOS, otherwise it will return the first available one.
-func (a *App) getUrlAndVersion() (string, string) {
-	url := ""
-	version := ""
+// getUpdate returns application update on given channel that fits
+// runtime.GOOS and runtime.GOARCH, see selectUpdate. When nothing is on given
+// channel fits or given channel is empty, it will select from all updates
+// instead. It will return nil when no update fits.
+func (a *App) getUpdate(channel string) *Update {
+	if channel != "" {
+		updates := []*Update{}
+		for _, update := range a.Updates {
+			if update.getChannel() == channel {
+				updates = append(updates, update)
+			}
+		}
+
+		if update := selectUpdate(updates); update != nil {
+			return update
+		}
+	}
 
-	for _, update := range a.Updates {
-		if update.getGoos() == runtime.GOOS {
-			url = update.getUrl()
-			version = update.getVersion()
-			break
+	return selectUpdate(a.Updates)
+}
+
+// selectUpdate returns update that match both runtime.GOOS and runtime.GOARCH
+// from given updates, then the one that match runtime.GOOS without target
+// architecture, then the one that match runtime.GOARCH without target OS, then
+// the one without either. The updates for other OS or architecture are skipped,
+// and nil is returned when none fits.
+func selectUpdate(updates []*Update) *Update {
+	for _, target := range [][2]string{{runtime.GOOS, runtime.GOARCH}, {runtime.GOOS, ""},
+		{"", runtime.GOARCH}, {"", ""}} {
+		for _, update := range updates {
+			if update.getGoos() == target[0] && update.getGoarch() == target[1] &&
+				update.getUrl() != "" && update.getVersion() != "" {
+				return update
+			}
 		}
 	}
 
-	if (url == "" || version == "") && len(a.Updates) > 0 {
-		update := a.Updates[0]
-		url = update.getUrl()
-		version = update.getVersion()
+	return nil
+}
+
+// getChannel returns application release channel.
+func (u *Update) getChannel() string {
+	if u != nil && u.Channel != nil {
+		return *u.Channel
 	}
+	return ""
+}
 
-	return url, version
+// getGoarch returns application target architecture.
+func (u *Update) getGoarch() string {
+	if u != nil && u.Goarch != nil {
+		return *u.Goarch
+	}
+	return ""
 }
 
 // getGoos returns application target OS.
 func (u *Update) getGoos() string {
-	if u.Goos != nil {
+	if u != nil && u.Goos != nil {
 		return *u.Goos
 	}
 	return ""
 }
 
+// getHash returns application SHA-256 checksum in hexadecimal.
+func (u *Update) getHash() string {
+	if u != nil && u.Hash != nil {
+		return *u.Hash
+	}
+	return ""
+}
+
 // getUrl returns application download URL.
 func (u *Update) getUrl() string {
-	if u.Url != nil {
+	if u != nil && u.Url != nil {
 		return *u.Url
 	}
 	return ""
@@ -91,24 +138,49 @@ func (u *Update) getUrl() string {
 
 // getVersion returns application latest version.
 func (u *Update) getVersion() string {
-	if u.Version != nil {
+	if u != nil && u.Version != nil {
 		return *u.Version
 	}
 	return ""
 }
 
-// GetUrlAndVersion returns download URL and latest version of given
-// application name.
-func (u *UpdateCheckResponse) GetUrlAndVersion(appName string) (string, string) {
-	url := ""
-	version := ""
+// GetAllUpdates returns every update entry of given application name in
+// updates.xml order, across all matching app entries, i.e.: to apply a custom
+// channel, architecture, or OS selection.
+func (u *UpdateCheckResponse) GetAllUpdates(appName string) []*Update {
+	updates := []*Update{}
+	for _, app := range u.Apps {
+		if app.getAppId() == appName {
+			updates = append(updates, app.Updates...)
+		}
+	}
+
+	return updates
+}
 
+// GetChannelUpdate returns latest update of given application name on given
+// release channel. An empty channel is the same as GetUpdate. The update for
+// other OS or architecture is never returned, it will return nil when no update
+// fits.
+func (u *UpdateCheckResponse) GetChannelUpdate(appName, channel string) *Update {
 	for _, app := range u.Apps {
 		if app.getAppId() == appName {
-			url, version = app.getUrlAndVersion()
-			break
+			return app.getUpdate(channel)
 		}
 	}
 
-	return url, version
+	return nil
+}
+
+// GetUpdate returns latest update of given application name, or nil when no
+// update fits.
+func (u *UpdateCheckResponse) GetUpdate(appName string) *Update {
+	return u.GetChannelUpdate(appName, "")
+}
+
+// GetUrlAndVersion returns download URL and latest version of given
+// application name.
+func (u *UpdateCheckResponse) GetUrlAndVersion(appName string) (string, string) {
+	update := u.GetUpdate(appName)
+	return update.getUrl(), update.getVersion()
 }
@@ -0,0 +1,159 @@
+// updatecheck_test.go - Test for updates.xml related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"encoding/xml"
+	"github.com/google/go-cmp/cmp"
+	"runtime"
+	"testing"
+)
+
+func TestUpdateCheckGetAllUpdates(t *testing.T) {
+	t.Parallel()
+
+	response := &UpdateCheckResponse{}
+	if err := xml.Unmarshal([]byte(`<?xml version='1.0' encoding='UTF-8'?>
+<gupdate xmlns='http://www.google.com/update2/response' protocol='2.0'>
+  <app appid='tld.domain.sub.app.name'>
+    <updatecheck codebase='https://sub.domain.tld/stable' version='1.0.0' />
+    <updatecheck channel='beta' codebase='https://sub.domain.tld/beta' version='1.1.0-beta' />
+  </app>
+  <app appid='tld.domain.sub.other'>
+    <updatecheck codebase='https://sub.domain.tld/other' version='2.0.0' />
+  </app>
+  <app appid='tld.domain.sub.app.name'>
+    <updatecheck arch='arm64' codebase='https://sub.domain.tld/arm64' os='darwin' version='1.0.0' />
+  </app>
+</gupdate>`), response); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	compare := func(appName string, want []string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			got := []string{}
+			for _, update := range response.GetAllUpdates(appName) {
+				got = append(got, update.getUrl())
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	t.Run("with multiple entries", compare("tld.domain.sub.app.name", []string{
+		"https://sub.domain.tld/stable", "https://sub.domain.tld/beta", "https://sub.domain.tld/arm64"}))
+	t.Run("with single entry", compare("tld.domain.sub.other", []string{"https://sub.domain.tld/other"}))
+	t.Run("with unknown application", compare("tld.domain.sub.unknown", []string{}))
+}
+
+func TestUpdateCheckGetChannelUpdate(t *testing.T) {
+	t.Parallel()
+
+	compare := func(wantUrl, wantVersion, channel, updates string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			response := &UpdateCheckResponse{}
+			if err := xml.Unmarshal([]byte(updatesXml(updates)), response); err != nil {
+				t.Fatalf("unmarshal error: %v", err)
+			}
+
+			update := response.GetChannelUpdate("tld.domain.sub.app.name", channel)
+			if update.getUrl() != wantUrl || update.getVersion() != wantVersion {
+				t.Errorf("mismatch (want: %q %q, got: %q %q)", wantUrl, wantVersion,
+					update.getUrl(), update.getVersion())
+			}
+		}
+	}
+
+	mixed := `<updatecheck codebase='https://sub.domain.tld/stable' os='` + runtime.GOOS + `' version='1.0.0' />
+    <updatecheck channel='beta' codebase='https://sub.domain.tld/beta.other' os='other' version='1.1.0-beta' />
+    <updatecheck channel='beta' codebase='https://sub.domain.tld/beta' os='` + runtime.GOOS + `' version='1.1.0-beta' />`
+
+	t.Run("with empty channel", compare("https://sub.domain.tld/stable", "1.0.0", "", mixed))
+	t.Run("with matching channel and OS", compare("https://sub.domain.tld/beta", "1.1.0-beta",
+		"beta", mixed))
+	// The update for other OS is never selected.
+	t.Run("with matching channel on other OS", compare("https://sub.domain.tld/stable", "1.0.0",
+		"beta", `<updatecheck codebase='https://sub.domain.tld/stable' version='1.0.0' />
+    <updatecheck channel='beta' codebase='https://sub.domain.tld/beta.other' os='other' version='1.1.0-beta' />`))
+	t.Run("with unknown channel", compare("https://sub.domain.tld/stable", "1.0.0", "alpha", mixed))
+	t.Run("with unknown channel and OS match", compare("https://sub.domain.tld/beta", "1.1.0-beta",
+		"alpha", `<updatecheck codebase='https://sub.domain.tld/other' os='other' version='1.0.0' />
+    <updatecheck channel='beta' codebase='https://sub.domain.tld/beta' os='`+runtime.GOOS+`' version='1.1.0-beta' />`))
+	t.Run("with no update entries", compare("", "", "beta", ""))
+}
+
+func TestUpdateCheckGetUpdateArch(t *testing.T) {
+	t.Parallel()
+
+	compare := func(wantUrl, updates string) func(t *testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+
+			response := &UpdateCheckResponse{}
+			if err := xml.Unmarshal([]byte(updatesXml(updates)), response); err != nil {
+				t.Fatalf("unmarshal error: %v", err)
+			}
+
+			if got := response.GetUpdate("tld.domain.sub.app.name").getUrl(); got != wantUrl {
+				t.Errorf("mismatch (want: %q, got: %q)", wantUrl, got)
+			}
+		}
+	}
+
+	t.Run("with OS and arch match", compare("https://sub.domain.tld/exact",
+		`<updatecheck codebase='https://sub.domain.tld/all' version='1.0.0' />
+    <updatecheck arch='other' codebase='https://sub.domain.tld/other' os='`+runtime.GOOS+`' version='1.0.0' />
+    <updatecheck codebase='https://sub.domain.tld/os' os='`+runtime.GOOS+`' version='1.0.0' />
+    <updatecheck arch='`+runtime.GOARCH+`' codebase='https://sub.domain.tld/exact' os='`+runtime.GOOS+`' version='1.0.0' />`))
+	t.Run("with OS match only", compare("https://sub.domain.tld/os",
+		`<updatecheck codebase='https://sub.domain.tld/all' version='1.0.0' />
+    <updatecheck arch='other' codebase='https://sub.domain.tld/other' os='`+runtime.GOOS+`' version='1.0.0' />
+    <updatecheck codebase='https://sub.domain.tld/os' os='`+runtime.GOOS+`' version='1.0.0' />`))
+	t.Run("with arch mismatch", compare("https://sub.domain.tld/all",
+		`<updatecheck codebase='https://sub.domain.tld/all' version='1.0.0' />
+    <updatecheck arch='other' codebase='https://sub.domain.tld/other' os='`+runtime.GOOS+`' version='1.0.0' />`))
+	t.Run("with arch match on other OS", compare("https://sub.domain.tld/all",
+		`<updatecheck codebase='https://sub.domain.tld/all' version='1.0.0' />
+    <updatecheck arch='`+runtime.GOARCH+`' codebase='https://sub.domain.tld/other' os='other' version='1.0.0' />`))
+	t.Run("with arch match without OS", compare("https://sub.domain.tld/arch",
+		`<updatecheck codebase='https://sub.domain.tld/all' version='1.0.0' />
+    <updatecheck arch='`+runtime.GOARCH+`' codebase='https://sub.domain.tld/arch' version='1.0.0' />`))
+	t.Run("with other OS only", compare("",
+		`<updatecheck codebase='https://sub.domain.tld/other' os='other' version='1.0.0' />
+    <updatecheck arch='`+runtime.GOARCH+`' codebase='https://sub.domain.tld/other' os='other' version='1.0.0' />`))
+	t.Run("with other arch only", compare("",
+		`<updatecheck arch='other' codebase='https://sub.domain.tld/other' version='1.0.0' />
+    <updatecheck arch='other' codebase='https://sub.domain.tld/other' os='`+runtime.GOOS+`' version='1.0.0' />`))
+}
+
+func TestUpdateCheckGetUrlAndVersion(t *testing.T) {
+	t.Parallel()
+
+	response := &UpdateCheckResponse{}
+	if err := xml.Unmarshal([]byte(updatesXml(`
+    <updatecheck codebase='https://sub.domain.tld/stable' version='1.0.0' />
+    <updatecheck channel='beta' codebase='https://sub.domain.tld/beta' version='1.1.0-beta' />
+  `)), response); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if url, version := response.GetUrlAndVersion("tld.domain.sub.app.name"); url != "https://sub.domain.tld/stable" ||
+		version != "1.0.0" {
+		t.Errorf("mismatch (got: %q %q)", url, version)
+	}
+
+	if url, version := response.GetUrlAndVersion("unknown"); url != "" || version != "" {
+		t.Errorf("mismatch (got: %q %q)", url, version)
+	}
+}
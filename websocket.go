@@ -0,0 +1,379 @@
+// websocket.go - WebSocket debug transport related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// webSocketGuid is the RFC 6455 magic string to compute Sec-WebSocket-Accept.
+const webSocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The WebSocket frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// ServeWebSocket listens on given TCP address and upgrades HTTP requests on
+// given path to WebSocket connections, where every request message is answered
+// with given handler's response, if any, or {"error": "..."} on handler or
+// decode error. The messages are the same bodies as stdio without the length
+// header, since WebSocket frames them already, in text frames for JSON or in
+// binary frames for a custom Codec. It is meant for development, i.e.: to
+// debug from browser devtools with the same handler as stdio. The upgrade is
+// refused when Origin header isn't in AllowedExts, so other web pages can't use
+// it, a request without Origin is from a non-browser client and is accepted. It
+// blocks until given context is done, then closes the listener and the open
+// connections, and returns the context error. It will return error when it come
+// across one.
+//
+//   messaging := (&host.Host{AllowedExts: []string{"chrome-extension://XXX/"}}).Init()
+//
+//   ctx, cancel := context.WithCancel(context.Background())
+//   defer cancel()
+//
+//   // new WebSocket("ws://127.0.0.1:9000/host") from the extension devtools.
+//   err := messaging.ServeWebSocket(ctx, "127.0.0.1:9000", "/host", func(request host.H) (host.H, error) {
+//     return host.H{"echo": request}, nil
+//   })
+//   if err != nil && err != context.Canceled {
+//     log.Fatalf("messaging.ServeWebSocket error: %v", err)
+//   }
+func (h *Host) ServeWebSocket(ctx context.Context, addr, path string, handler HandlerFunc) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return h.serveWebSocket(ctx, listener, path, handler)
+}
+
+// serveWebSocket serves WebSocket connections on given path from given
+// listener with given handler until given context is done. It will return
+// error when it come across one.
+func (h *Host) serveWebSocket(ctx context.Context, listener net.Listener, path string, handler HandlerFunc) error {
+	// The hijacked connections aren't tracked by http.Server.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	closed := false
+	defer func() {
+		mu.Lock()
+		closed = true
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	// The open connections are closed on any return.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := upgradeWebSocket(w, r, h.IsAllowedOrigin)
+		if err != nil {
+			h.logger().Printf("WebSocket upgrade error %s: %v", r.RemoteAddr, err)
+			return
+		}
+
+		mu.Lock()
+		if closed {
+			mu.Unlock()
+			conn.Close()
+			return
+		}
+		wg.Add(1)
+		mu.Unlock()
+
+		defer wg.Done()
+		h.serveWebSocketConn(ctx, conn, rw, handler)
+	})
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	err := server.Serve(listener)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// serveWebSocketConn answers messages on given upgraded connection with given
+// handler until the peer disconnects or given context is done.
+func (h *Host) serveWebSocketConn(ctx context.Context, conn net.Conn, rw *bufio.ReadWriter, handler HandlerFunc) {
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	codec, opcode := h.Codec, byte(wsBinary)
+	if codec == nil {
+		codec, opcode = JSONCodec{}, wsText
+	}
+
+	for {
+		payload, err := readWebSocketMessage(rw)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				h.logger().Printf("WebSocket read error %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		var response H
+		request := H{}
+		err = h.readBody(bytes.NewReader(payload), uint32(len(payload)), &request)
+		if errors.Is(err, ErrEmptyMessage) {
+			// A keep-alive probe has nothing to handle.
+			continue
+		}
+		if err == nil {
+			response, err = handler(request)
+		}
+		if err != nil {
+			response = H{"error": err.Error()}
+		}
+
+		if response == nil {
+			continue
+		}
+
+		body, err := codec.Marshal(response)
+		if err == nil {
+			err = writeWebSocketFrame(rw, opcode, body)
+		}
+		if err != nil {
+			h.logger().Printf("WebSocket write error %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// upgradeWebSocket verifies given WebSocket opening handshake request and its
+// Origin header with given allowed function, then takes over its connection and
+// completes the handshake. A browser always sends Origin, so any web page can't
+// hijack the connection. It will return error when it come across one.
+//
+// See https://tools.ietf.org/html/rfc6455#section-4.2
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, allowed func(string) bool) (net.Conn, *bufio.ReadWriter, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade is required", http.StatusBadRequest)
+		return nil, nil, errors.New("Invalid WebSocket handshake")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, nil, fmt.Errorf("Unsupported WebSocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" && !allowed(origin) {
+		http.Error(w, "Origin is not allowed", http.StatusForbidden)
+		return nil, nil, fmt.Errorf("Origin %q is not allowed", origin)
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket is unsupported", http.StatusInternalServerError)
+		return nil, nil, errors.New("Connection can't be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + webSocketGuid))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, rw, nil
+}
+
+// headerContains returns true if given header has given comma separated token,
+// case-insensitively, otherwise false.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readWebSocketMessage reads frames from given connection until a whole data
+// message is read, and returns its payload. Ping is answered with pong, and
+// close is answered with close and returned as io.EOF. It will return error
+// when it come across one.
+func readWebSocketMessage(rw *bufio.ReadWriter) ([]byte, error) {
+	var message []byte
+	started := false
+
+	for {
+		fin, opcode, payload, err := readWebSocketFrame(rw.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsClose:
+			// Echo the status code, if any, then the peer closes the connection.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			writeWebSocketFrame(rw, wsClose, payload)
+			return nil, io.EOF
+		case wsPing:
+			if err := writeWebSocketFrame(rw, wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsText, wsBinary:
+			if started {
+				return nil, errors.New("Unexpected WebSocket data frame")
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, errors.New("Unexpected WebSocket continuation frame")
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported WebSocket opcode %#x", opcode)
+		}
+
+		if len(message)+len(payload) > MaxWebSocketMessageSize {
+			return nil, fmt.Errorf("WebSocket message exceeds %d bytes", MaxWebSocketMessageSize)
+		}
+		message = append(message, payload...)
+
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// readWebSocketFrame reads a masked client frame from given reader, and returns
+// its final flag, opcode, and unmasked payload. It will return error when it
+// come across one.
+func readWebSocketFrame(r io.Reader) (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin, opcode := header[0]&0x80 != 0, header[0]&0x0f
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("Unmasked WebSocket client frame")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(r, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(r, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+
+	if length > MaxWebSocketMessageSize {
+		return false, 0, nil, fmt.Errorf("WebSocket frame exceeds %d bytes", MaxWebSocketMessageSize)
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(r, mask); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// writeWebSocketFrame writes given payload as an unmasked final server frame
+// of given opcode. It will return error when it come across one.
+func writeWebSocketFrame(rw *bufio.ReadWriter, opcode byte, payload []byte) error {
+	length := len(payload)
+	header := []byte{0x80 | opcode, 0}
+
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	if _, err := rw.Write(header); err != nil {
+		return err
+	}
+
+	if _, err := rw.Write(payload); err != nil {
+		return err
+	}
+
+	return rw.Flush()
+}
@@ -0,0 +1,265 @@
+// websocket_test.go - Test for WebSocket debug transport related functionality.
+// Copyright (c) 2018 - 2020  Richard Huang <rickypc@users.noreply.github.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package host
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// wsClient is a minimal WebSocket client that sends masked frames.
+type wsClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, addr, path string) *wsClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("handshake error: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatalf("handshake response error: %v", err)
+	}
+
+	// The example accept key from RFC 6455.
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake mismatch: %s %v", resp.Status, resp.Header)
+	}
+
+	return &wsClient{conn: conn, reader: reader}
+}
+
+func (c *wsClient) write(fin bool, opcode byte, payload []byte) error {
+	header := []byte{opcode, 0x80}
+	if fin {
+		header[0] |= 0x80
+	}
+
+	if len(payload) < 126 {
+		header[1] |= byte(len(payload))
+	} else {
+		header[1] |= 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+
+	_, err := c.conn.Write(append(append(header, mask...), masked...))
+	return err
+}
+
+func (c *wsClient) read() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(extended))
+	}
+
+	payload := make([]byte, length)
+	_, err := io.ReadFull(c.reader, payload)
+	return header[0] & 0x0f, payload, err
+}
+
+func TestWebSocketServeWebSocket(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+
+	h := &Host{Logger: &recorder{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- h.serveWebSocket(ctx, listener, "/host", func(request H) (H, error) {
+			switch request["type"] {
+			case "ping":
+				return H{"type": "pong", "id": request["id"]}, nil
+			case "silent":
+				return nil, nil
+			}
+			return nil, errors.New("unknown type")
+		})
+	}()
+
+	addr := listener.Addr().String()
+
+	// A plain request without upgrade is rejected.
+	if resp, err := http.Get("http://" + addr + "/host"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain request mismatch (want: 400, got: %v %v)", resp, err)
+	}
+
+	client := dialWebSocket(t, addr, "/host")
+	defer client.conn.Close()
+
+	compare := func(name string, frames func() error, wantOpcode byte, want interface{}) {
+		if err := frames(); err != nil {
+			t.Fatalf("%s write error: %v", name, err)
+		}
+
+		opcode, payload, err := client.read()
+		if err != nil {
+			t.Fatalf("%s read error: %v", name, err)
+		}
+
+		got := interface{}(string(payload))
+		if wantOpcode == wsText {
+			response := H{}
+			if err := json.Unmarshal(payload, &response); err != nil {
+				t.Fatalf("%s response error: %v", name, err)
+			}
+			got = response
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" || opcode != wantOpcode {
+			t.Errorf("%s mismatch (opcode: %#x, -want +got):\n%s", name, opcode, diff)
+		}
+	}
+
+	compare("with message", func() error {
+		return client.write(true, wsText, []byte(`{"type":"ping","id":1}`))
+	}, wsText, H{"type": "pong", "id": 1.0})
+	compare("with silent and fragmented message", func() error {
+		if err := client.write(true, wsText, []byte(`{"type":"silent"}`)); err != nil {
+			return err
+		}
+		if err := client.write(false, wsText, []byte(`{"type":"pi`)); err != nil {
+			return err
+		}
+		if err := client.write(false, wsContinuation, []byte(`ng","id`)); err != nil {
+			return err
+		}
+		return client.write(true, wsContinuation, []byte(`":2}`))
+	}, wsText, H{"type": "pong", "id": 2.0})
+	compare("with handler error", func() error {
+		return client.write(true, wsText, []byte(`{"type":"other"}`))
+	}, wsText, H{"error": "unknown type"})
+	compare("with invalid message", func() error {
+		return client.write(true, wsText, []byte(`{"type":`))
+	}, wsText, H{"error": "unexpected EOF"})
+	compare("with ping", func() error {
+		return client.write(true, wsPing, []byte("probe"))
+	}, wsPong, "probe")
+	compare("with close", func() error {
+		return client.write(true, wsClose, []byte{0x03, 0xe8})
+	}, wsClose, "\x03\xe8")
+
+	// Another connection is closed on return.
+	other := dialWebSocket(t, addr, "/host")
+	defer other.conn.Close()
+
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Errorf("serve error mismatch (want: %v, got: %v)", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve did not return after cancel")
+	}
+
+	if _, _, err := other.read(); err != io.EOF {
+		t.Errorf("connection error mismatch (want: %v, got: %v)", io.EOF, err)
+	}
+}
+
+func TestWebSocketServeWebSocketOrigin(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+
+	h := &Host{AllowedExts: []string{"chrome-extension://XXX/"}, Logger: &recorder{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go h.serveWebSocket(ctx, listener, "/host", func(request H) (H, error) {
+		return request, nil
+	})
+
+	addr := listener.Addr().String()
+
+	compare := func(origin string, want int) func(t *testing.T) {
+		return func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/host", nil)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			if origin != "" {
+				req.Header.Set("Origin", origin)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("handshake error: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != want {
+				t.Errorf("status mismatch (want: %d, got: %d)", want, resp.StatusCode)
+			}
+		}
+	}
+
+	t.Run("with allowed origin", compare("chrome-extension://XXX", http.StatusSwitchingProtocols))
+	t.Run("with foreign origin", compare("https://evil.example", http.StatusForbidden))
+	t.Run("with null origin", compare("null", http.StatusForbidden))
+	t.Run("with no origin", compare("", http.StatusSwitchingProtocols))
+}
+
+func TestWebSocketServeWebSocketAddr(t *testing.T) {
+	t.Parallel()
+
+	err := (&Host{}).ServeWebSocket(context.Background(), "127.0.0.1:-1", "/", nil)
+	if err == nil {
+		t.Error("want error")
+	}
+}